@@ -1,288 +1,234 @@
 package main
 
 import (
-	"bufio"
 	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
-	"math"
 	"os"
-	"strings"
+	"os/signal"
+	"syscall"
+	"time"
 
-	"github.com/doug-martin/goqu/v9"
-	_ "github.com/doug-martin/goqu/v9/dialect/postgres"
-	_ "github.com/doug-martin/goqu/v9/dialect/sqlite3"
-	_ "github.com/jackc/pgx/v5/stdlib"
-	"github.com/jmoiron/sqlx"
-	_ "github.com/mattn/go-sqlite3"
+	"stash_sqlite_to_pgsql/migrate"
 )
 
-var anon_dialect = goqu.Dialect("sqlite3")
-var dialect = goqu.Dialect("postgres")
-
-const restart_seq = `
-SELECT setval(pg_get_serial_sequence('%[1]s', 'id')
-            , COALESCE(max(id) + 1, 1)
-            , false)
-FROM %[1]s;
-`
-
-func open_sqlite(path string) (conn *sqlx.DB, err error) {
-	const disableForeignKeys = false
-	const writable = false
-
-	// https://github.com/mattn/go-sqlite3
-	url := "file:" + path + "?_journal=WAL&_sync=NORMAL&_busy_timeout=50"
-	if !disableForeignKeys {
-		url += "&_fk=true"
-	}
-
-	if writable {
-		url += "&_txlock=immediate"
-	} else {
-		url += "&mode=ro"
-	}
-
-	conn, err = sqlx.Open("sqlite3", url)
+var log = migrate.NewTerminalLogger()
+
+// connectorCheckTimeout bounds the test connection to a typed-in
+// connector, which would otherwise wait for a mistyped host to time out.
+const connectorCheckTimeout = 15 * time.Second
+
+// Exit codes, for scripts to tell what to do about a failure.
+const (
+	exitFailure = 1 // anything not below
+	exitUsage   = 2 // bad flags or options
+	exitSource  = 3 // the sqlite database can't be opened or read
+	exitConnect = 4 // postgres can't be reached, retry later
+	exitSchema  = 5 // the destination schema doesn't match, run stash first
+	exitData    = 6 // rows were refused or violate constraints
+	exitVerify  = 7 // the destination doesn't match the source afterwards
+)
 
-	if err != nil {
-		return nil, fmt.Errorf("db.Open(): %w", err)
+// exit_code maps the class of err onto the exit codes.
+func exit_code(err error) int {
+	for _, class := range []struct {
+		err  error
+		code int
+	}{
+		{migrate.ErrUsage, exitUsage},
+		{migrate.ErrSource, exitSource},
+		{migrate.ErrDestConnect, exitConnect},
+		{migrate.ErrSchema, exitSchema},
+		{migrate.ErrData, exitData},
+		{migrate.ErrVerify, exitVerify},
+	} {
+		if errors.Is(err, class.err) {
+			return class.code
+		}
 	}
+	return exitFailure
+}
 
-	return conn, nil
+// fail logs err and exits with its exit code.
+func fail(err error) {
+	exit(exit_code(err), err)
 }
 
-func open_pgsql(connector string) (conn *sqlx.DB, err error) {
-	const disableForeignKeys = true
-	const writable = true
+func exit(code int, err error) {
+	log.Errorf("%v", err)
+	log.Close()
+	os.Exit(code)
+}
 
-	conn, err = sqlx.Open("pgx", connector)
+// watch_signals returns a context that SIGTERM cancels. SIGINT stops m after
+// the batch in flight, a second one exits without waiting for anything;
+// Postgres rolls back the open transaction when the connection drops.
+// Container runtimes send SIGTERM and follow up with SIGKILL after a short
+// grace period, so instead of finishing the batch the in-flight statement is
+// cancelled right away, and if cleanup takes longer than gracePeriod the
+// process exits regardless.
+func watch_signals(m *migrate.Migrator, gracePeriod time.Duration) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		stopping := false
+		for sig := range signals {
+			switch sig {
+			case os.Interrupt:
+				if stopping {
+					log.Errorf("Interrupted again, exiting immediately")
+					log.Close()
+					os.Exit(130)
+				}
+				log.Warnf("Interrupted, stopping after the current batch (press Ctrl+C again to exit immediately)")
+				stopping = true
+				m.Stop()
+			case syscall.SIGTERM:
+				log.Warnf("Terminated, cancelling the current batch")
+				stopping = true
+				m.Stop()
+				cancel()
+				time.AfterFunc(gracePeriod, func() {
+					log.Errorf("cleanup took longer than %s, exiting", gracePeriod)
+					log.Close()
+					os.Exit(1)
+				})
+			}
+		}
+	}()
 
-	if err != nil {
-		return nil, fmt.Errorf("db.Open(): %w", err)
+	return ctx, func() {
+		signal.Stop(signals)
+		cancel()
 	}
+}
 
-	if disableForeignKeys {
-		_, err = conn.Exec("SET session_replication_role = replica;")
-
-		if err != nil {
-			return nil, fmt.Errorf("conn.Exec(): %w", err)
+func main() {
+	var opts migrate.Options
+	migrate.BindFlags(flag.CommandLine, &opts)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [repair] [flags]\n\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "repair fixes sequences and reports schema problems of an already migrated\ndestination without needing the sqlite source, -fix-sequences only resets\nthe sequences.\n\n")
+		flag.PrintDefaults()
+		fmt.Fprintf(flag.CommandLine.Output(), "\nexit codes: %d bad arguments, %d source open or read failure, %d postgres\nconnection failure, %d schema mismatch, %d data or constraint errors, %d\nverification failure, %d anything else\n",
+			exitUsage, exitSource, exitConnect, exitSchema, exitData, exitVerify, exitFailure)
+	}
+
+	command := "migrate"
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "repair" {
+		command, args = args[0], args[1:]
+	}
+	flag.CommandLine.Parse(args)
+
+	if opts.ConfigFile != "" {
+		if err := migrate.LoadConfigFile(flag.CommandLine, opts.ConfigFile); err != nil {
+			exit(exitUsage, err)
 		}
 	}
-	if !writable {
-		_, err = conn.Exec("SET SESSION CHARACTERISTICS AS TRANSACTION READ ONLY;")
-
-		if err != nil {
-			return nil, fmt.Errorf("conn.Exec(): %w", err)
+	var preset string
+	if opts.Preset != "" {
+		var err error
+		if preset, err = migrate.ApplyPreset(flag.CommandLine, opts.Preset); err != nil {
+			exit(exitUsage, err)
 		}
 	}
-
-	return conn, nil
-}
-
-func clampInt64ToInt32(value int64) int32 {
-	if value > int64(math.MaxInt32) {
-		return math.MaxInt32
-	} else if value < int64(math.MinInt32) {
-		return math.MinInt32
+	if err := opts.Validate(); err != nil {
+		exit(exitUsage, err)
 	}
-	return int32(value)
-}
-
-func migrate(connector string, dbpath string) error {
-	const batchSize = 1000
 
-	sourceDB, err := open_sqlite(dbpath)
-	if err != nil {
-		return fmt.Errorf("failed to open db: %w", err)
+	log.Verbose = opts.Verbose
+	if opts.LogFile != "" {
+		if err := log.OpenFile(opts.LogFile); err != nil {
+			fail(err)
+		}
+		defer log.Close()
 	}
-
-	destDB, err := open_pgsql(connector)
-	if err != nil {
-		return fmt.Errorf("failed to open db: %w", err)
+	opts.Logger = log
+	if opts.Preset != "" {
+		log.Infof("Preset %s: %s", opts.Preset, preset)
 	}
 
-	ctx := context.Background()
-	for _, table := range []string{
-		"blobs",
-		"files",
-		"files_fingerprints",
-		"folders",
-		"galleries",
-		"galleries_chapters",
-		"galleries_files",
-		"galleries_images",
-		"galleries_tags",
-		"gallery_urls",
-		"group_urls",
-		"groups",
-		"groups_relations",
-		"groups_scenes",
-		"groups_tags",
-		"image_files",
-		"image_urls",
-		"images",
-		"images_files",
-		"images_tags",
-		"performer_aliases",
-		"performer_stash_ids",
-		"performer_urls",
-		"performers",
-		"performers_galleries",
-		"performers_images",
-		"performers_scenes",
-		"performers_tags",
-		"saved_filters",
-		"scene_markers",
-		"scene_markers_tags",
-		"scene_stash_ids",
-		"scene_urls",
-		"scenes",
-		"scenes_files",
-		"scenes_galleries",
-		"scenes_o_dates",
-		"scenes_tags",
-		"scenes_view_dates",
-		"studio_aliases",
-		"studio_stash_ids",
-		"studios",
-		"studios_tags",
-		"tag_aliases",
-		"tags",
-		"tags_relations",
-		"video_captions",
-		"video_files",
-	} {
-		offset := 0
-
-		fmt.Printf("Fetching %s\n", table)
-		for {
-			var rowsSlice []map[string]interface{}
-
-			// Fetch
-			{
-				txn, err := sourceDB.BeginTxx(ctx, nil)
-				if err != nil {
-					return fmt.Errorf("source begin tx: %w", err)
-				}
-
-				goquTable := goqu.I(table)
-				q := anon_dialect.From(goquTable).Select(goquTable.All()).Limit(uint(batchSize)).Offset(uint(offset))
-				sql, args, err := q.ToSQL()
-				if err != nil {
-					return fmt.Errorf("source failed tosql: %w", err)
-				}
-
-				r, err := txn.QueryxContext(ctx, sql, args...)
-				if err != nil {
-					return fmt.Errorf("query `%s` [%v]: %w", sql, args, err)
-				}
-
-				for r.Next() {
-					row := make(map[string]interface{})
-					if err := r.MapScan(row); err != nil {
-						return fmt.Errorf("failed structscan: %w", err)
-					}
-					rowsSlice = append(rowsSlice, row)
-				}
-
-				if len(rowsSlice) == 0 {
-					break
-				}
-			}
-
-			// Insert
-			{
-				txn, err := destDB.BeginTxx(ctx, nil)
-				if err != nil {
-					return fmt.Errorf("dest begin tx: %w", err)
-				}
-
-				// Hotfix the funspeed generator
-				if table == "video_files" {
-					for idx := range rowsSlice {
-						if v, ok := rowsSlice[idx]["interactive_speed"].(int64); ok {
-							rowsSlice[idx]["interactive_speed"] = clampInt64ToInt32(v)
-						}
-					}
-				}
-
-				q := dialect.Insert(table).Rows(rowsSlice)
-				sql, args, err := q.ToSQL()
-				if err != nil {
-					return fmt.Errorf("failed tosql: %w", err)
-				}
-
-				_, err = txn.ExecContext(ctx, sql, args...)
-				if err != nil {
-					return fmt.Errorf("exec `%s` [%v]: %w", sql, args, err)
-				}
-
-				if err := txn.Commit(); err != nil {
-					return fmt.Errorf("commit: %w", err)
-				}
-			}
+	// A dump is written without connecting to postgres, and -pg-host or
+	// -pg-db make up the connector by themselves
+	if opts.Output == "" && opts.OutputDir == "" && opts.Pg.Host == "" && opts.Pg.Database == "" {
+		pg_connector, err := ask_valid("postgres connector:", func(connector string) error {
+			ctx, cancel := context.WithTimeout(context.Background(), connectorCheckTimeout)
+			defer cancel()
+			return opts.CheckConnector(ctx, connector)
+		})
+		if err != nil {
+			fail(err)
+		}
+		opts.Postgres = pg_connector
+	}
 
-			// Move to the next batch
-			offset += batchSize
+	if opts.FixSequences {
+		if err := migrate.New(opts).FixSequences(context.Background()); err != nil {
+			fail(err)
 		}
+		log.Infof("Sequences fixed!")
+		return
+	}
+	if command == "repair" {
+		// Every repair step commits on its own, so the default signal
+		// behaviour of exiting right away is fine here.
+		if err := migrate.New(opts).Repair(context.Background()); err != nil {
+			fail(err)
+		}
+		log.Infof("Repair finished!")
+		return
 	}
 
-	if err := sourceDB.Close(); err != nil {
-		return fmt.Errorf("source close: %w", err)
+	sqlite_path, err := ask_valid("sqlite db path:", migrate.CheckSource)
+	if err != nil {
+		fail(err)
 	}
+	opts.SQLite = sqlite_path
 
-	fmt.Printf("Setting sequences...\n")
-	for _, table_name := range []string{
-		"files", "folders", "galleries_chapters",
-		"groups", "images", "performers",
-		"saved_filters", "scene_markers",
-		"scenes", "studios", "tags",
-	} {
-		txn, err := destDB.BeginTxx(ctx, nil)
-		if err != nil {
-			return fmt.Errorf("dest begin tx: %w", err)
+	if opts.Reverse {
+		rep, err := migrate.New(opts).Reverse(context.Background())
+		if rep != nil {
+			rep.Print(opts.DryRun)
 		}
-
-		sql := fmt.Sprintf(restart_seq, table_name)
-
-		_, err = txn.QueryxContext(ctx, sql)
 		if err != nil {
-			return fmt.Errorf("exec `%s`: %w", sql, err)
-		}
-
-		if err := txn.Commit(); err != nil {
-			return fmt.Errorf("commit: %w", err)
+			fail(err)
 		}
+		log.Infof("Reverse migration successful!")
+		return
 	}
 
-	if err := destDB.Close(); err != nil {
-		return fmt.Errorf("dest close: %w", err)
+	if is_interactive() {
+		opts.Confirm = confirm
 	}
 
-	return nil
-}
+	m := migrate.New(opts)
+	ctx, stop := watch_signals(m, opts.GracePeriod)
+	defer stop()
 
-func main() {
-	fmt.Println("postgres connector:")
-	reader := bufio.NewReader(os.Stdin)
-	pg_connector, err := reader.ReadString('\n')
-	if err != nil {
-		log.Fatal(err)
+	rep, err := m.Run(ctx)
+	if errors.Is(err, migrate.ErrInterrupted) {
+		rep.Print(opts.DryRun)
+		rep.PrintInterrupted()
+		fail(err)
+	}
+	if rep != nil {
+		rep.Print(opts.DryRun)
 	}
-	pg_connector = strings.TrimSpace(pg_connector)
-
-	fmt.Println("sqlite db path:")
-	reader = bufio.NewReader(os.Stdin)
-	sqlite_path, err := reader.ReadString('\n')
 	if err != nil {
-		log.Fatal(err)
+		fail(err)
 	}
-	sqlite_path = strings.TrimSpace(sqlite_path)
 
-	err = migrate(pg_connector, sqlite_path)
-	if err != nil {
-		log.Fatal(err)
+	if opts.DryRun {
+		if n := rep.Rejected(); n > 0 {
+			exit(exitData, fmt.Errorf("dry run: %d rows would have been rejected", n))
+		}
+		log.Infof("Dry run successful!")
+		return
 	}
-	fmt.Printf("Migration successful!")
+	log.Infof("Migration successful!")
 }
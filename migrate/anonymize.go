@@ -0,0 +1,123 @@
+package migrate
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+)
+
+// -anonymize replaces the text that identifies a library, its titles,
+// paths, URLs, names and descriptions, with pseudonyms, for handing a copy
+// of a database to someone debugging a query plan. A pseudonym is a keyed
+// hash of the value, so equal values stay equal and distinct ones distinct:
+// unique indexes hold, and so do the blob checksums other tables reference.
+// The key is drawn anew for each run, so the pseudonyms can't be reversed
+// by hashing guesses. Images are emptied, in the blobs table and in the
+// columns that held them before it.
+
+// anonymized_columns are the columns -anonymize replaces, by table. Columns
+// an older source lacks are passed over.
+var anonymized_columns = map[string][]string{
+	"blobs":                   {"checksum"},
+	"files":                   {"basename"},
+	"files_fingerprints":      {"fingerprint"},
+	"folders":                 {"path"},
+	"galleries":               {"title", "code", "details", "photographer"},
+	"galleries_chapters":      {"title"},
+	"gallery_urls":            {"url"},
+	"group_urls":              {"url"},
+	"groups":                  {"name", "aliases", "director", "description", "front_image_blob", "back_image_blob"},
+	"image_urls":              {"url"},
+	"images":                  {"title", "code", "details", "photographer"},
+	"performer_aliases":       {"alias"},
+	"performer_custom_fields": {"value"},
+	"performer_stash_ids":     {"stash_id"},
+	"performer_urls":          {"url"},
+	"performers":              {"name", "disambiguation", "details", "tattoos", "piercings", "image_blob"},
+	"saved_filters":           {"name"},
+	"scene_markers":           {"title"},
+	"scene_stash_ids":         {"stash_id"},
+	"scene_urls":              {"url"},
+	"scenes":                  {"title", "code", "details", "director", "cover_blob"},
+	"studio_aliases":          {"alias"},
+	"studio_stash_ids":        {"stash_id"},
+	"studios":                 {"name", "url", "details", "image_blob"},
+	"tag_aliases":             {"alias"},
+	"tags":                    {"name", "description", "image_blob"},
+	"video_captions":          {"filename"},
+}
+
+// anonymized_images are the columns -anonymize empties, by table.
+var anonymized_images = map[string][]string{
+	"blobs":      {"blob"},
+	"performers": {"image"},
+	"studios":    {"image"},
+	"tags":       {"image"},
+}
+
+// pseudonymLength is the number of hex digits of a pseudonym, enough that
+// two values of a library don't collide.
+const pseudonymLength = 24
+
+// anonymizer replaces the anonymized columns of rows with pseudonyms and
+// remembers the columns it found, for the report.
+type anonymizer struct {
+	key  []byte
+	seen map[string]bool
+}
+
+func new_anonymizer() (*anonymizer, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("anonymization key: %w", err)
+	}
+	return &anonymizer{key: key, seen: map[string]bool{}}, nil
+}
+
+// pseudonym returns the pseudonym of value.
+func (a *anonymizer) pseudonym(value string) string {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))[:pseudonymLength]
+}
+
+// apply anonymizes rows of table. NULLs and empty strings are kept, and so
+// are values that aren't text, like the numbers among custom fields.
+func (a *anonymizer) apply(table string, rows []map[string]interface{}, stats *tableStats) {
+	if a == nil {
+		return
+	}
+	names := anonymized_columns[table]
+	for _, row := range rows {
+		for _, name := range names {
+			value, ok := text_value(row[name])
+			if !ok || value == "" {
+				continue
+			}
+			row[name] = a.pseudonym(value)
+			a.seen[table+"."+name] = true
+			stats.anonymized++
+		}
+		for _, name := range anonymized_images[table] {
+			if row[name] == nil {
+				continue
+			}
+			row[name] = []byte{}
+			a.seen[table+"."+name] = true
+			stats.anonymized++
+		}
+	}
+}
+
+// columns returns the anonymized columns that had values, sorted.
+func (a *anonymizer) columns() []string {
+	var columns []string
+	for column := range a.seen {
+		columns = append(columns, column)
+	}
+	slices.Sort(columns)
+	return columns
+}
@@ -0,0 +1,71 @@
+package migrate
+
+import "time"
+
+const minBatchSize = 10
+
+// maxFetchBytes caps the data fetched from the source at once. Tables with
+// rows of a few bytes are unaffected, the blobs table with its images of
+// several megabytes is read a row or a few at a time.
+const maxFetchBytes = 16 << 20
+
+// batchSizer adapts the number of rows per INSERT to how long the
+// destination takes for them. Tables with wide rows, or a destination busy
+// with autovacuum, get smaller batches; fast batches grow back towards max.
+type batchSizer struct {
+	size     int
+	max      int
+	smallest int
+	// budget is the time a batch may take, zero to keep the size fixed.
+	budget time.Duration
+	// rowBytes is the average row size of the last fetched batch.
+	rowBytes int64
+	log      Logger
+}
+
+func new_batch_sizer(max int, budget time.Duration, log Logger) *batchSizer {
+	return &batchSizer{size: max, max: max, smallest: max, budget: budget, log: log}
+}
+
+// fetch_limit is the number of rows to fetch next: the batch size, unless
+// rows are so large that fewer of them fill maxFetchBytes.
+func (b *batchSizer) fetch_limit() int {
+	if b.rowBytes == 0 {
+		return b.size
+	}
+	return int(max(1, min(int64(b.size), maxFetchBytes/b.rowBytes)))
+}
+
+// observe_rows records the size of a fetched batch.
+func (b *batchSizer) observe_rows(rows int, bytes int64) {
+	if rows > 0 {
+		b.rowBytes = bytes / int64(rows)
+	}
+}
+
+// shrink halves the size after a batch ran out of time. It reports false
+// once the size can't get any smaller.
+func (b *batchSizer) shrink(table string) bool {
+	if b.budget == 0 || b.size <= minBatchSize {
+		return false
+	}
+	b.set(table, max(b.size/2, minBatchSize), "over its time budget")
+	return true
+}
+
+// observe adjusts the size to a batch that completed in took.
+func (b *batchSizer) observe(table string, took time.Duration) {
+	switch {
+	case b.budget == 0:
+	case took > b.budget/2 && b.size > minBatchSize:
+		b.set(table, max(b.size/2, minBatchSize), "close to its time budget")
+	case took < b.budget/10 && b.size < b.max:
+		b.set(table, min(b.size*2, b.max), "well within its time budget")
+	}
+}
+
+func (b *batchSizer) set(table string, size int, why string) {
+	b.log.Infof("%s: batch %s, batch size %d -> %d", table, why, b.size, size)
+	b.size = size
+	b.smallest = min(b.smallest, size)
+}
@@ -0,0 +1,250 @@
+package migrate
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Writing the blobs table out to stash's filesystem blob storage. Stash
+// names every blob after the MD5 checksum of its content and shards them in
+// two levels of directories named after the first characters of it:
+// <dir>/ab/cd/abcd...
+
+const (
+	fsyncFile = "file"
+	fsyncDir  = "dir"
+	fsyncNone = "none"
+)
+
+func blob_path(dir string, checksum string) string {
+	return filepath.Join(dir, checksum[0:2], checksum[2:4], checksum)
+}
+
+type blobJob struct {
+	checksum string
+	data     []byte
+}
+
+// blobStats summarizes what the writer did.
+type blobStats struct {
+	written int64
+	skipped int64
+	bytes   int64
+	// verified counts the files found on disk with the expected size after
+	// all were written.
+	verified int64
+}
+
+// blobWriter writes blobs with a bounded pool of workers. Every file is
+// written under a temporary name and renamed into place, and existing files
+// with the right content are skipped, so an interrupted run can simply be
+// repeated.
+type blobWriter struct {
+	dir          string
+	fsync        string
+	retries      int
+	retryBackoff time.Duration
+
+	jobs chan blobJob
+	wg   sync.WaitGroup
+
+	// directories already created, and with fsyncDir, to be synced
+	dirsMu sync.Mutex
+	dirs   map[string]bool
+
+	errOnce sync.Once
+	err     error
+	failed  atomic.Bool
+
+	written atomic.Int64
+	skipped atomic.Int64
+	bytes   atomic.Int64
+
+	// sizes of every blob queued, by checksum, for verify
+	sizes map[string]int64
+
+	log Logger
+}
+
+func new_blob_writer(dir string, fsync string, workers int, retries int, retryBackoff time.Duration, log Logger) (*blobWriter, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("blob dir: %w", err)
+	}
+
+	w := &blobWriter{
+		dir:          dir,
+		fsync:        fsync,
+		retries:      retries,
+		retryBackoff: retryBackoff,
+		jobs:         make(chan blobJob, workers),
+		dirs:         map[string]bool{},
+		sizes:        map[string]int64{},
+		log:          log,
+	}
+	for i := 0; i < workers; i++ {
+		w.wg.Add(1)
+		go w.work()
+	}
+	return w, nil
+}
+
+// write queues a blob, blocking while all workers are busy. It returns the
+// first error any worker ran into, after which nothing more is written.
+func (w *blobWriter) write(checksum string, data []byte) error {
+	if w.failed.Load() {
+		return w.err
+	}
+	w.sizes[checksum] = int64(len(data))
+	w.jobs <- blobJob{checksum: checksum, data: data}
+	return nil
+}
+
+func (w *blobWriter) fail(err error) {
+	w.errOnce.Do(func() {
+		w.err = err
+		w.failed.Store(true)
+	})
+}
+
+func (w *blobWriter) work() {
+	defer w.wg.Done()
+
+	for job := range w.jobs {
+		if w.failed.Load() {
+			continue
+		}
+
+		var err error
+		for attempt := 0; ; attempt++ {
+			err = w.write_file(job)
+			if err == nil || attempt >= w.retries {
+				break
+			}
+			wait := backoff(attempt, w.retryBackoff)
+			w.log.Warnf("blob %s: %v, retrying in %s", job.checksum, err, wait)
+			time.Sleep(wait)
+		}
+		if err != nil {
+			w.fail(fmt.Errorf("blob %s: %w", job.checksum, err))
+		}
+	}
+}
+
+func (w *blobWriter) ensure_dir(dir string) error {
+	w.dirsMu.Lock()
+	defer w.dirsMu.Unlock()
+
+	if w.dirs[dir] {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	w.dirs[dir] = true
+	return nil
+}
+
+func (w *blobWriter) write_file(job blobJob) error {
+	sum := md5.Sum(job.data)
+	if hex.EncodeToString(sum[:]) != job.checksum {
+		return fmt.Errorf("content doesn't match its checksum")
+	}
+
+	path := blob_path(w.dir, job.checksum)
+	if existing, err := os.ReadFile(path); err == nil {
+		if !bytes.Equal(existing, job.data) {
+			return fmt.Errorf("%s already exists with different content", path)
+		}
+		w.skipped.Add(1)
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	dir := filepath.Dir(path)
+	if err := w.ensure_dir(dir); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, ".tmp-"+job.checksum+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(job.data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if w.fsync == fsyncFile {
+		if err := tmp.Sync(); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	w.written.Add(1)
+	w.bytes.Add(int64(len(job.data)))
+	return nil
+}
+
+// close waits for all queued blobs, syncs the directories when asked to,
+// and returns the first error.
+func (w *blobWriter) close() (blobStats, error) {
+	close(w.jobs)
+	w.wg.Wait()
+
+	stats := blobStats{written: w.written.Load(), skipped: w.skipped.Load(), bytes: w.bytes.Load()}
+	if w.err != nil {
+		return stats, w.err
+	}
+
+	if w.fsync != fsyncNone {
+		for dir := range w.dirs {
+			if err := sync_dir(dir); err != nil {
+				return stats, fmt.Errorf("sync %s: %w", dir, err)
+			}
+		}
+	}
+
+	// Count what actually ended up on disk rather than trusting the
+	// bookkeeping above
+	var missing []string
+	for checksum, size := range w.sizes {
+		info, err := os.Stat(blob_path(w.dir, checksum))
+		if err != nil || info.Size() != size {
+			missing = append(missing, checksum)
+			continue
+		}
+		stats.verified++
+	}
+	if len(missing) > 0 {
+		return stats, fmt.Errorf("%d of %d blobs are missing or incomplete in %s, e.g. %s", len(missing), len(w.sizes), w.dir, missing[0])
+	}
+	return stats, nil
+}
+
+func sync_dir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
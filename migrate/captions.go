@@ -0,0 +1,114 @@
+package migrate
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Stash names a caption's language by the short code in its file name, like
+// movie.en.srt, and uses 00 when there is none. Plugins have stored whole
+// language names and empty strings there too, which the destination column
+// may not have room for. Stash finds the caption file by the code and type,
+// so values that are fine are kept exactly as they are.
+
+// captionLanguageUnknown is stash's code for a caption of unknown language.
+const captionLanguageUnknown = "00"
+
+// language_codes maps language names and three letter ISO 639-2 codes to
+// the two letter codes stash uses.
+var language_codes = map[string]string{
+	"arabic": "ar", "ara": "ar",
+	"chinese": "zh", "chi": "zh", "zho": "zh",
+	"czech": "cs", "cze": "cs", "ces": "cs",
+	"danish": "da", "dan": "da",
+	"dutch": "nl", "dut": "nl", "nld": "nl",
+	"english": "en", "eng": "en",
+	"finnish": "fi", "fin": "fi",
+	"french": "fr", "français": "fr", "fre": "fr", "fra": "fr",
+	"german": "de", "deutsch": "de", "ger": "de", "deu": "de",
+	"greek": "el", "gre": "el", "ell": "el",
+	"hebrew": "he", "heb": "he",
+	"hindi": "hi", "hin": "hi",
+	"hungarian": "hu", "hun": "hu",
+	"indonesian": "id", "ind": "id",
+	"italian": "it", "italiano": "it", "ita": "it",
+	"japanese": "ja", "jpn": "ja",
+	"korean": "ko", "kor": "ko",
+	"norwegian": "no", "nor": "no",
+	"polish": "pl", "polski": "pl", "pol": "pl",
+	"portuguese": "pt", "português": "pt", "por": "pt",
+	"romanian": "ro", "rum": "ro", "ron": "ro",
+	"russian": "ru", "rus": "ru",
+	"spanish": "es", "español": "es", "spa": "es",
+	"swedish": "sv", "swe": "sv",
+	"thai": "th", "tha": "th",
+	"turkish": "tr", "tur": "tr",
+	"ukrainian": "uk", "ukr": "uk",
+	"vietnamese": "vi", "vie": "vi",
+}
+
+// language_code_re matches a language code with an optional region, like
+// en, pt-BR or pt_br.
+var language_code_re = regexp.MustCompile(`^(?i)([a-z]{2})(?:[-_][a-z0-9]{2,3})?$`)
+
+// caption_language returns the code to store for a caption language: value
+// itself when it is a code that fits in maxLength (0 for any length), the
+// short code of a recognized language, or fallback.
+func caption_language(value string, maxLength int, fallback string) string {
+	fits := maxLength == 0 || len(value) <= maxLength
+	if value == captionLanguageUnknown || (language_code_re.MatchString(value) && fits) {
+		return value
+	}
+	s := strings.ToLower(strings.TrimSpace(value))
+	if m := language_code_re.FindStringSubmatch(s); m != nil {
+		return m[1]
+	}
+	// Names like "English (SDH)" or "english forced"
+	if i := strings.IndexAny(s, " (["); i > 0 {
+		s = s[:i]
+	}
+	if code, ok := language_codes[s]; ok {
+		return code
+	}
+	return fallback
+}
+
+// captions_transform normalizes the language codes and caption types of
+// video_captions rows, logging every change by file.
+func captions_transform(columns tableColumns, opts Options) Transform {
+	log := opts.logger()
+	maxLength := columns["language_code"].maxLength
+	return func(table string, row map[string]interface{}) (bool, error) {
+		if value, ok := text_value(row["language_code"]); ok {
+			code := caption_language(value, maxLength, opts.CaptionLanguage)
+			if code != value {
+				log.Infof("%s (%s): language %q stored as %q", table, row_ident(row), value, code)
+				row["language_code"] = code
+			}
+		} else if value, present := row["language_code"]; present && value == nil && !columns["language_code"].nullable {
+			log.Infof("%s (%s): no language, stored as %q", table, row_ident(row), opts.CaptionLanguage)
+			row["language_code"] = opts.CaptionLanguage
+		}
+
+		// Stash writes the file extension, srt or vtt, without its dot
+		if value, ok := text_value(row["caption_type"]); ok {
+			captionType := strings.TrimPrefix(strings.TrimSpace(value), ".")
+			if captionType != value {
+				log.Infof("%s (%s): caption type %q stored as %q", table, row_ident(row), value, captionType)
+				row["caption_type"] = captionType
+			}
+		}
+		return true, nil
+	}
+}
+
+// text_value returns the text of a string or []byte value.
+func text_value(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case []byte:
+		return string(v), true
+	}
+	return "", false
+}
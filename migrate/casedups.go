@@ -0,0 +1,117 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Stash's postgres schema makes names unique regardless of case, where the
+// sqlite one allowed both "Blonde" and "blonde". Such pairs are found before
+// migrating and either merged into the row with the lowest id, with every
+// reference to the others pointed at it, or renamed with a numeric suffix.
+
+const (
+	caseDuplicatesMerge  = "merge"
+	caseDuplicatesRename = "rename"
+)
+
+// case_unique_names are the columns whose values, compared without case,
+// must be unique per table.
+var case_unique_names = map[string][]string{
+	"performers": {"name", "disambiguation"},
+	"studios":    {"name"},
+	"tags":       {"name"},
+}
+
+// find_case_duplicates looks for rows of the selected tables whose names
+// differ only in case, and records how to merge or rename them.
+func find_case_duplicates(ctx context.Context, sourceDB *sqlx.DB, selected []string, mode string, merges *rowMerges) error {
+	log := logger(ctx)
+	for table, keyColumns := range case_unique_names {
+		if !slices.Contains(selected, table) {
+			continue
+		}
+		available, err := source_columns(ctx, sourceDB, table)
+		if err != nil {
+			return fmt.Errorf("source %s: %w", table, err)
+		}
+		var columns []string
+		for _, column := range keyColumns {
+			if slices.Contains(available, column) {
+				columns = append(columns, column)
+			}
+		}
+
+		sql := fmt.Sprintf("SELECT id, %s FROM %s ORDER BY id", strings.Join(columns, ", "), table)
+		rows, err := sourceDB.QueryxContext(ctx, sql)
+		if err != nil {
+			return fmt.Errorf("query `%s`: %w", sql, err)
+		}
+
+		first := map[string]int64{}
+		names := map[int64]string{}
+		var losers []int64
+		scanner, err := new_row_scanner(rows)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("source columns: %w", err)
+		}
+		for rows.Next() {
+			row, err := scanner.scan(rows)
+			if err != nil {
+				rows.Close()
+				return fmt.Errorf("failed mapscan: %w", err)
+			}
+			id, _ := row["id"].(int64)
+			name := fmt.Sprint(row["name"])
+			names[id] = name
+			key := case_key(row, columns)
+			if winner, ok := first[key]; ok {
+				losers = append(losers, id)
+				log.Warnf("%s: %q (id=%d) differs from %q (id=%d) only in case", table, name, id, names[winner], winner)
+				if mode == caseDuplicatesMerge {
+					merges.merge(table, id, winner)
+				}
+				continue
+			}
+			first[key] = id
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		if mode == caseDuplicatesRename {
+			taken := map[string]bool{}
+			for _, id := range first {
+				taken[strings.ToLower(names[id])] = true
+			}
+			for _, id := range losers {
+				for n := 2; ; n++ {
+					name := fmt.Sprintf("%s (%d)", names[id], n)
+					if !taken[strings.ToLower(name)] {
+						taken[strings.ToLower(name)] = true
+						merges.set(table, id, "name", name)
+						break
+					}
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func case_key(row map[string]interface{}, columns []string) string {
+	parts := make([]string, len(columns))
+	for i, column := range columns {
+		if row[column] != nil {
+			parts[i] = strings.ToLower(fmt.Sprint(row[column]))
+		}
+	}
+	return strings.Join(parts, "\x00")
+}
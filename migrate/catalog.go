@@ -0,0 +1,315 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+// Queries against the destination catalog. Everything here looks at the
+// current schema only.
+
+// sequenceInfo is a serial or identity column and the sequence behind it.
+type sequenceInfo struct {
+	schema   string
+	table    string
+	column   string
+	sequence string
+}
+
+const select_sequences = `
+SELECT table_schema, table_name, column_name, seq
+FROM (
+	SELECT c.table_schema, c.table_name, c.column_name,
+		pg_get_serial_sequence(quote_ident(c.table_schema) || '.' || quote_ident(c.table_name), c.column_name) AS seq
+	FROM information_schema.columns c
+	JOIN information_schema.tables t ON t.table_schema = c.table_schema AND t.table_name = c.table_name
+	WHERE c.table_schema = current_schema() AND t.table_type = 'BASE TABLE'
+) s
+WHERE seq IS NOT NULL
+ORDER BY table_name, column_name
+`
+
+func discover_sequences(ctx context.Context, db *sqlx.DB) ([]sequenceInfo, error) {
+	rows, err := db.QueryxContext(ctx, select_sequences)
+	if err != nil {
+		return nil, fmt.Errorf("discover sequences: %w", err)
+	}
+	defer rows.Close()
+
+	var sequences []sequenceInfo
+	for rows.Next() {
+		var s sequenceInfo
+		if err := rows.Scan(&s.schema, &s.table, &s.column, &s.sequence); err != nil {
+			return nil, fmt.Errorf("discover sequences: %w", err)
+		}
+		sequences = append(sequences, s)
+	}
+	return sequences, rows.Err()
+}
+
+// reset_sequence sets the sequence so that the next value is max(column)+1
+// and returns the previous and the new next value. The sequence name comes
+// from pg_get_serial_sequence, quoted and qualified already; the table is
+// qualified with its schema so that the search path doesn't matter.
+func reset_sequence(ctx context.Context, txn *sqlx.Tx, s sequenceInfo) (before int64, after int64, err error) {
+	if err := txn.GetContext(ctx, &before, "SELECT CASE WHEN is_called THEN last_value + 1 ELSE last_value END FROM "+s.sequence); err != nil {
+		return 0, 0, fmt.Errorf("read %s: %w", s.sequence, err)
+	}
+
+	sql := fmt.Sprintf("SELECT setval($1, COALESCE(max(%s) + 1, 1), false) FROM %s",
+		pgx.Identifier{s.column}.Sanitize(), pgx.Identifier{s.schema, s.table}.Sanitize())
+	if err := txn.GetContext(ctx, &after, sql, s.sequence); err != nil {
+		return 0, 0, fmt.Errorf("exec `%s`: %w", sql, err)
+	}
+	return before, after, nil
+}
+
+// reset_sequences resets the sequences of every serial and identity column
+// of the selected tables. Tables skipped by -start-from were copied by an
+// earlier run, so their sequences are reset too.
+func reset_sequences(ctx context.Context, destDB *sqlx.DB, selected []string) error {
+	log := logger(ctx)
+	sequences, err := discover_sequences(ctx, destDB)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Setting sequences...")
+	for _, s := range sequences {
+		if !slices.Contains(selected, s.table) {
+			continue
+		}
+		txn, err := begin_dest(ctx, destDB)
+		if err != nil {
+			return err
+		}
+		_, after, err := reset_sequence(ctx, txn, s)
+		if err != nil {
+			txn.Rollback()
+			return err
+		}
+		if err := txn.Commit(); err != nil {
+			return fmt.Errorf("commit: %w", err)
+		}
+		log.Infof("  %-40s next value %d", s.sequence, after)
+	}
+	return nil
+}
+
+// dest_tables lists the tables of the current schema.
+func dest_tables(ctx context.Context, db *sqlx.DB) ([]string, error) {
+	var tables []string
+	err := db.SelectContext(ctx, &tables, `SELECT table_name FROM information_schema.tables
+WHERE table_schema = current_schema() AND table_type = 'BASE TABLE' ORDER BY table_name`)
+	if err != nil {
+		return nil, fmt.Errorf("list tables: %w", err)
+	}
+	return tables, nil
+}
+
+// foreignKey is a foreign key constraint of the destination schema.
+type foreignKey struct {
+	name       string
+	table      string
+	columns    []string
+	refTable   string
+	refColumns []string
+}
+
+const select_foreign_keys = `
+SELECT con.conname, cl.relname, ref.relname,
+	array_to_string(ARRAY(
+		SELECT a.attname FROM unnest(con.conkey) WITH ORDINALITY k(n, i)
+		JOIN pg_attribute a ON a.attrelid = con.conrelid AND a.attnum = k.n ORDER BY k.i), ','),
+	array_to_string(ARRAY(
+		SELECT a.attname FROM unnest(con.confkey) WITH ORDINALITY k(n, i)
+		JOIN pg_attribute a ON a.attrelid = con.confrelid AND a.attnum = k.n ORDER BY k.i), ',')
+FROM pg_constraint con
+JOIN pg_class cl ON cl.oid = con.conrelid
+JOIN pg_class ref ON ref.oid = con.confrelid
+JOIN pg_namespace ns ON ns.oid = cl.relnamespace
+WHERE con.contype = 'f' AND ns.nspname = current_schema()
+ORDER BY cl.relname, con.conname
+`
+
+func load_foreign_keys(ctx context.Context, db *sqlx.DB) ([]foreignKey, error) {
+	rows, err := db.QueryxContext(ctx, select_foreign_keys)
+	if err != nil {
+		return nil, fmt.Errorf("load foreign keys: %w", err)
+	}
+	defer rows.Close()
+
+	var fks []foreignKey
+	for rows.Next() {
+		var fk foreignKey
+		var columns, refColumns string
+		if err := rows.Scan(&fk.name, &fk.table, &fk.refTable, &columns, &refColumns); err != nil {
+			return nil, fmt.Errorf("load foreign keys: %w", err)
+		}
+		fk.columns = strings.Split(columns, ",")
+		fk.refColumns = strings.Split(refColumns, ",")
+		fks = append(fks, fk)
+	}
+	return fks, rows.Err()
+}
+
+// orphan_query returns a query counting the rows of fk.table whose key has
+// no referent.
+func (fk foreignKey) orphan_query() string {
+	var notNull, join []string
+	for i, column := range fk.columns {
+		c := "c." + pgx.Identifier{column}.Sanitize()
+		notNull = append(notNull, c+" IS NOT NULL")
+		join = append(join, "p."+pgx.Identifier{fk.refColumns[i]}.Sanitize()+" = "+c)
+	}
+	return fmt.Sprintf("SELECT count(*) FROM %s c WHERE %s AND NOT EXISTS (SELECT 1 FROM %s p WHERE %s)",
+		pgx.Identifier{fk.table}.Sanitize(), strings.Join(notNull, " AND "),
+		pgx.Identifier{fk.refTable}.Sanitize(), strings.Join(join, " AND "))
+}
+
+func count_orphans(ctx context.Context, db *sqlx.DB, fk foreignKey) (int64, error) {
+	var count int64
+	if err := db.GetContext(ctx, &count, fk.orphan_query()); err != nil {
+		return 0, fmt.Errorf("check %s: %w", fk.name, err)
+	}
+	return count, nil
+}
+
+// schemaColumn is a column of any table in the destination schema.
+type schemaColumn struct {
+	table string
+	columnInfo
+}
+
+const select_schema_columns = `
+SELECT c.table_name, c.column_name, c.data_type, c.is_nullable = 'YES'
+FROM information_schema.columns c
+JOIN information_schema.tables t ON t.table_schema = c.table_schema AND t.table_name = c.table_name
+WHERE c.table_schema = current_schema() AND t.table_type = 'BASE TABLE'
+ORDER BY c.table_name, c.ordinal_position
+`
+
+func load_schema_columns(ctx context.Context, db *sqlx.DB) ([]schemaColumn, error) {
+	rows, err := db.QueryxContext(ctx, select_schema_columns)
+	if err != nil {
+		return nil, fmt.Errorf("load columns: %w", err)
+	}
+	defer rows.Close()
+
+	var columns []schemaColumn
+	for rows.Next() {
+		var c schemaColumn
+		if err := rows.Scan(&c.table, &c.name, &c.dataType, &c.nullable); err != nil {
+			return nil, fmt.Errorf("load columns: %w", err)
+		}
+		columns = append(columns, c)
+	}
+	return columns, rows.Err()
+}
+
+// select_unique_keys lists the primary key and full unique indexes of a
+// table, as index name and comma separated columns. Expression indexes are
+// left out.
+const select_unique_keys = `
+SELECT ix.relname, array_to_string(ARRAY(
+	SELECT a.attname FROM unnest(i.indkey) WITH ORDINALITY k(n, o)
+	JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = k.n ORDER BY k.o), ',')
+FROM pg_index i
+JOIN pg_class cl ON cl.oid = i.indrelid
+JOIN pg_class ix ON ix.oid = i.indexrelid
+JOIN pg_namespace ns ON ns.oid = cl.relnamespace
+WHERE ns.nspname = current_schema() AND cl.relname = $1
+	AND i.indisunique AND i.indpred IS NULL AND NOT 0 = ANY(i.indkey)
+ORDER BY i.indisprimary DESC, ix.relname
+`
+
+// select_conflict_key finds the primary key of a table, or failing that its
+// first full unique index, as many stash join tables only have the latter.
+const select_conflict_key = `SELECT columns FROM (` + select_unique_keys + `) k(name, columns) LIMIT 1`
+
+// uniqueKey is a primary key or unique index.
+type uniqueKey struct {
+	name    string
+	columns []string
+}
+
+// load_unique_keys returns the primary key and unique indexes of table.
+func load_unique_keys(ctx context.Context, db *sqlx.DB, table string) ([]uniqueKey, error) {
+	rows, err := db.QueryxContext(ctx, select_unique_keys, table)
+	if err != nil {
+		return nil, fmt.Errorf("load unique keys of %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	var keys []uniqueKey
+	for rows.Next() {
+		var name, columns string
+		if err := rows.Scan(&name, &columns); err != nil {
+			return nil, fmt.Errorf("load unique keys of %s: %w", table, err)
+		}
+		keys = append(keys, uniqueKey{name: name, columns: strings.Split(columns, ",")})
+	}
+	return keys, rows.Err()
+}
+
+// load_conflict_key returns the columns identifying a row of table, or nil
+// when it has neither a primary key nor a unique index.
+func load_conflict_key(ctx context.Context, db *sqlx.DB, table string) ([]string, error) {
+	var columns []string
+	if err := db.SelectContext(ctx, &columns, select_conflict_key, table); err != nil {
+		return nil, fmt.Errorf("load key of %s: %w", table, err)
+	}
+	if len(columns) == 0 {
+		return nil, nil
+	}
+	return strings.Split(columns[0], ","), nil
+}
+
+// select_unvalidated_constraints lists the constraints added NOT VALID, which
+// postgres has never checked against existing rows.
+const select_unvalidated_constraints = `
+SELECT cl.relname, con.conname
+FROM pg_constraint con
+JOIN pg_class cl ON cl.oid = con.conrelid
+JOIN pg_namespace ns ON ns.oid = cl.relnamespace
+WHERE ns.nspname = current_schema() AND NOT con.convalidated
+ORDER BY cl.relname, con.conname
+`
+
+// validate_constraints has postgres check every constraint not validated
+// yet against the migrated rows.
+func validate_constraints(ctx context.Context, db *sqlx.DB) error {
+	log := logger(ctx)
+	rows, err := db.QueryxContext(ctx, select_unvalidated_constraints)
+	if err != nil {
+		return fmt.Errorf("load constraints: %w", err)
+	}
+	var constraints [][2]string
+	for rows.Next() {
+		var c [2]string
+		if err := rows.Scan(&c[0], &c[1]); err != nil {
+			rows.Close()
+			return fmt.Errorf("load constraints: %w", err)
+		}
+		constraints = append(constraints, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("load constraints: %w", err)
+	}
+
+	log.Infof("Validating %d constraints...", len(constraints))
+	for _, c := range constraints {
+		sql := fmt.Sprintf("ALTER TABLE %s VALIDATE CONSTRAINT %s", pgx.Identifier{c[0]}.Sanitize(), pgx.Identifier{c[1]}.Sanitize())
+		log.Debugf("%s", sql)
+		if _, err := db.ExecContext(ctx, sql); err != nil {
+			return fmt.Errorf("exec `%s`: %w", sql, err)
+		}
+	}
+	return nil
+}
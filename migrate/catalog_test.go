@@ -0,0 +1,133 @@
+package migrate
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+)
+
+var sequence_columns = []string{"table_schema", "table_name", "column_name", "seq"}
+
+func TestDiscoverSequences(t *testing.T) {
+	fake, dest := new_fake_dest(t)
+	fake.answer(select_sequences, sequence_columns,
+		[]driver.Value{"public", "scenes", "id", "public.scenes_id_seq"},
+		[]driver.Value{"public", "Scenes", "id", `public."Scenes_id_seq"`},
+		[]driver.Value{"Stash", "tags", "id", `"Stash".tags_id_seq`},
+	)
+
+	sequences, err := discover_sequences(context.Background(), dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []sequenceInfo{
+		{schema: "public", table: "scenes", column: "id", sequence: "public.scenes_id_seq"},
+		{schema: "public", table: "Scenes", column: "id", sequence: `public."Scenes_id_seq"`},
+		{schema: "Stash", table: "tags", column: "id", sequence: `"Stash".tags_id_seq`},
+	}
+	if len(sequences) != len(want) {
+		t.Fatalf("discovered %v, want %v", sequences, want)
+	}
+	for i := range want {
+		if sequences[i] != want[i] {
+			t.Errorf("sequence %d = %+v, want %+v", i, sequences[i], want[i])
+		}
+	}
+}
+
+func TestResetSequence(t *testing.T) {
+	tests := []struct {
+		name string
+		s    sequenceInfo
+		// read and setval are the queries reading and setting the sequence.
+		read   string
+		setval string
+	}{
+		{
+			"lowercase",
+			sequenceInfo{schema: "public", table: "scenes", column: "id", sequence: "public.scenes_id_seq"},
+			"SELECT CASE WHEN is_called THEN last_value + 1 ELSE last_value END FROM public.scenes_id_seq",
+			`SELECT setval($1, COALESCE(max("id") + 1, 1), false) FROM "public"."scenes"`,
+		},
+		{
+			"mixed case",
+			sequenceInfo{schema: "public", table: "Scenes", column: "ID", sequence: `public."Scenes_ID_seq"`},
+			`SELECT CASE WHEN is_called THEN last_value + 1 ELSE last_value END FROM public."Scenes_ID_seq"`,
+			`SELECT setval($1, COALESCE(max("ID") + 1, 1), false) FROM "public"."Scenes"`,
+		},
+		{
+			"schema qualified",
+			sequenceInfo{schema: "Stash", table: "tags", column: "id", sequence: `"Stash".tags_id_seq`},
+			`SELECT CASE WHEN is_called THEN last_value + 1 ELSE last_value END FROM "Stash".tags_id_seq`,
+			`SELECT setval($1, COALESCE(max("id") + 1, 1), false) FROM "Stash"."tags"`,
+		},
+		// A dot in a table name is part of the name
+		{
+			"dotted name",
+			sequenceInfo{schema: "public", table: "stash.tags", column: "id", sequence: `public."stash.tags_id_seq"`},
+			`SELECT CASE WHEN is_called THEN last_value + 1 ELSE last_value END FROM public."stash.tags_id_seq"`,
+			`SELECT setval($1, COALESCE(max("id") + 1, 1), false) FROM "public"."stash.tags"`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake, dest := new_fake_dest(t)
+			fake.answer("SELECT CASE WHEN is_called", []string{"last_value"}, []driver.Value{int64(5)})
+			fake.answer("SELECT setval(", []string{"setval"}, []driver.Value{int64(12)})
+
+			txn, err := dest.BeginTxx(context.Background(), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer txn.Rollback()
+			before, after, err := reset_sequence(context.Background(), txn, test.s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if before != 5 || after != 12 {
+				t.Errorf("reset from %d to %d, want 5 to 12", before, after)
+			}
+
+			if read := fake.ran("SELECT CASE"); len(read) != 1 || read[0] != test.read {
+				t.Errorf("read with %v, want %s", read, test.read)
+			}
+			setval := fake.ran("SELECT setval(")
+			if len(setval) != 1 || setval[0] != test.setval {
+				t.Fatalf("set with %v, want %s", setval, test.setval)
+			}
+			// The sequence is passed as its quoted name, which setval parses
+			args := fake.args[len(fake.args)-1]
+			if len(args) != 1 || args[0].Value != test.s.sequence {
+				t.Errorf("setval arguments = %v, want %s", args, test.s.sequence)
+			}
+		})
+	}
+}
+
+// TestResetSequences checks that only the sequences of the selected tables
+// are reset, each in its own transaction.
+func TestResetSequences(t *testing.T) {
+	fake, dest := new_fake_dest(t)
+	fake.answer(select_sequences, sequence_columns,
+		[]driver.Value{"public", "Scenes", "id", `public."Scenes_id_seq"`},
+		[]driver.Value{"public", "scenes", "id", "public.scenes_id_seq"},
+		[]driver.Value{"public", "tags", "id", "public.tags_id_seq"},
+	)
+	fake.answer("SELECT CASE WHEN is_called", []string{"last_value"}, []driver.Value{int64(1)})
+	fake.answer("SELECT setval(", []string{"setval"}, []driver.Value{int64(3)})
+
+	if err := reset_sequences(context.Background(), dest, []string{"Scenes", "tags"}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`SELECT setval($1, COALESCE(max("id") + 1, 1), false) FROM "public"."Scenes"`,
+		`SELECT setval($1, COALESCE(max("id") + 1, 1), false) FROM "public"."tags"`,
+	}
+	setval := fake.ran("SELECT setval(")
+	if len(setval) != len(want) || setval[0] != want[0] || setval[1] != want[1] {
+		t.Errorf("set %v, want %v", setval, want)
+	}
+	if commits := fake.ran("COMMIT"); len(commits) != 2 {
+		t.Errorf("%d commits, want 2", len(commits))
+	}
+}
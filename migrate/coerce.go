@@ -0,0 +1,399 @@
+package migrate
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// coerce_empty_strings decides what an empty or whitespace-only string means
+// for a numeric or boolean destination column. It must never become a silent
+// zero: nullable columns get NULL, and rows with a NOT NULL column are
+// rejected. Returns the rows that are kept.
+func coerce_empty_strings(table string, rows []map[string]interface{}, columns tableColumns, opts Options, stats *tableStats) []map[string]interface{} {
+	log := opts.logger()
+	kept := rows[:0]
+	for _, row := range rows {
+		keep := true
+		for name, value := range row {
+			col, ok := columns[name]
+			if !ok || !(is_numeric_type(col.dataType) || col.dataType == "boolean") {
+				continue
+			}
+
+			var s string
+			switch v := value.(type) {
+			case string:
+				s = v
+			case []byte:
+				s = string(v)
+			default:
+				continue
+			}
+			if strings.TrimSpace(s) != "" {
+				continue
+			}
+
+			if col.nullable {
+				log.Debugf("%s (%s): empty %s value %q stored as NULL", table, row_ident(row), name, s)
+				row[name] = nil
+				stats.modified++
+				continue
+			}
+
+			reason := fmt.Sprintf("empty string %q for NOT NULL %s column %s", s, col.dataType, name)
+			log.Errorf("%s (%s): %s", table, row_ident(row), reason)
+			opts.rejects.add(rejectEntry{Table: table, Row: row_ident(row), Column: name, Reason: reason})
+			keep = false
+			break
+		}
+
+		if !keep {
+			stats.skipped++
+			continue
+		}
+		kept = append(kept, row)
+	}
+	return kept
+}
+
+const (
+	utf8Replace = "replace"
+	utf8Latin1  = "latin1"
+)
+
+// destDefault stands for a value left to the destination column's default:
+// the insert writes DEFAULT in its place.
+type destDefault struct{}
+
+// apply_dest_defaults leaves NULLs in NOT NULL columns that have a default
+// to that default, instead of failing the row. Ancient rows of some tables
+// lack values stash's postgres schema fills in by default, like created_at.
+func apply_dest_defaults(table string, rows []map[string]interface{}, columns tableColumns, opts Options, stats *tableStats) {
+	log := opts.logger()
+	for _, row := range rows {
+		for name, value := range row {
+			col, ok := columns[name]
+			if !ok || value != nil || col.nullable || col.defaultExpr == "" {
+				continue
+			}
+			log.Debugf("%s (%s): NULL in NOT NULL column %s, using its default %s", table, row_ident(row), name, col.defaultExpr)
+			row[name] = destDefault{}
+			stats.defaulted++
+			stats.modified++
+		}
+	}
+}
+
+// repair_text makes text values storable in postgres text columns, which
+// can't hold NUL bytes or invalid UTF-8. Broken scrapers left NUL bytes in
+// some titles, and files scanned on Windows with odd codepages left invalid
+// UTF-8 in paths. bytea columns are left alone.
+func repair_text(table string, rows []map[string]interface{}, columns tableColumns, opts Options, stats *tableStats) {
+	log := opts.logger()
+	for _, row := range rows {
+		for name, value := range row {
+			var s string
+			switch v := value.(type) {
+			case string:
+				s = v
+			case []byte:
+				if col, ok := columns[name]; !ok || col.dataType == "bytea" {
+					continue
+				}
+				s = string(v)
+			default:
+				continue
+			}
+
+			repaired := s
+			if !utf8.ValidString(repaired) {
+				if opts.InvalidUTF8 == utf8Latin1 {
+					repaired = decode_latin1(repaired)
+				} else {
+					repaired = strings.ToValidUTF8(repaired, "\uFFFD")
+				}
+				log.Warnf("%s (%s): repaired invalid UTF-8 in %s: %q", table, row_ident(row), name, repaired)
+				stats.utf8Repaired++
+			}
+			if strings.Contains(repaired, "\x00") {
+				log.Warnf("%s (%s): removed NUL bytes from %s", table, row_ident(row), name)
+				repaired = strings.ReplaceAll(repaired, "\x00", "")
+				stats.nulStripped++
+			}
+			if repaired != s {
+				row[name] = repaired
+				stats.modified++
+			}
+		}
+	}
+}
+
+// decode_latin1 reads every byte of s as a latin-1 character.
+func decode_latin1(s string) string {
+	runes := make([]rune, len(s))
+	for i := 0; i < len(s); i++ {
+		runes[i] = rune(s[i])
+	}
+	return string(runes)
+}
+
+const (
+	nonFiniteNull = "null"
+	nonFiniteZero = "zero"
+)
+
+// non_finite reports whether value is NaN or an infinity, also when sqlite
+// kept it as text.
+func non_finite(value interface{}) bool {
+	var f float64
+	switch v := value.(type) {
+	case float64:
+		f = v
+	case float32:
+		f = float64(v)
+	case string:
+		parsed, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return false
+		}
+		f = parsed
+	case []byte:
+		return non_finite(string(v))
+	default:
+		return false
+	}
+	return math.IsNaN(f) || math.IsInf(f, 0)
+}
+
+// replace_non_finite replaces NaN and infinities in numeric columns, left
+// behind by corrupt video scans, which either fail the insert or break
+// sorting in stash later. NOT NULL columns get 0 either way.
+func replace_non_finite(table string, rows []map[string]interface{}, columns tableColumns, opts Options, stats *tableStats) {
+	log := opts.logger()
+	for _, row := range rows {
+		for name, value := range row {
+			col, ok := columns[name]
+			if !ok || !is_numeric_type(col.dataType) || !non_finite(value) {
+				continue
+			}
+
+			var replacement interface{}
+			if opts.NonFinite == nonFiniteZero || !col.nullable {
+				replacement = 0
+			}
+			log.Warnf("%s (%s): %s is %v, replaced with %v; rescan it in stash", table, row_ident(row), name, value, replacement)
+			row[name] = replacement
+			stats.modified++
+			stats.nonFinite++
+		}
+	}
+}
+
+const (
+	intOverflowClamp = "clamp"
+	intOverflowNull  = "null"
+)
+
+// integer_range returns the range of a postgres integer type.
+func integer_range(dataType string) (int64, int64, bool) {
+	switch dataType {
+	case "smallint":
+		return math.MinInt16, math.MaxInt16, true
+	case "integer":
+		return math.MinInt32, math.MaxInt32, true
+	}
+	return 0, 0, false
+}
+
+// clamp_integers fits sqlite's 64 bit integers into narrower destination
+// columns, as broken generators and imports left values like an
+// interactive_speed or o_counter beyond the range of an integer.
+func clamp_integers(table string, rows []map[string]interface{}, columns tableColumns, opts Options, stats *tableStats) {
+	log := opts.logger()
+	for _, row := range rows {
+		for name, value := range row {
+			v, ok := value.(int64)
+			if !ok {
+				continue
+			}
+			col, ok := columns[name]
+			if !ok {
+				continue
+			}
+			lo, hi, ok := integer_range(col.dataType)
+			if !ok || (v >= lo && v <= hi) {
+				continue
+			}
+
+			var replacement interface{} = max(lo, min(v, hi))
+			if opts.IntOverflow == intOverflowNull && col.nullable {
+				replacement = nil
+			}
+			log.Warnf("%s (%s): %s %d is out of range for %s, replaced with %v", table, row_ident(row), name, v, col.dataType, replacement)
+			row[name] = replacement
+			stats.modified++
+			stats.intClamped++
+		}
+	}
+}
+
+// convert_booleans turns the 0/1 integers sqlite stores for stash's flags
+// into bools for boolean destination columns, so that the insert doesn't
+// depend on how willing pgx is to convert them, which it isn't for text.
+// Rows with any other value are rejected. Returns the rows that are kept.
+func convert_booleans(table string, rows []map[string]interface{}, columns tableColumns, opts Options, stats *tableStats) []map[string]interface{} {
+	log := opts.logger()
+	kept := rows[:0]
+	for _, row := range rows {
+		keep := true
+		for name, value := range row {
+			col, ok := columns[name]
+			if !ok || col.dataType != "boolean" {
+				continue
+			}
+
+			var b bool
+			var err error
+			switch v := value.(type) {
+			case nil, bool:
+				continue
+			case int64:
+				if v != 0 && v != 1 {
+					err = fmt.Errorf("%d is not a boolean", v)
+				}
+				b = v == 1
+			case string, []byte:
+				b, err = parse_boolean(v)
+			default:
+				err = fmt.Errorf("%T %v is not a boolean", value, value)
+			}
+			if err != nil {
+				reason := fmt.Sprintf("boolean column %s: %v", name, err)
+				log.Errorf("%s (%s): %s", table, row_ident(row), reason)
+				opts.rejects.add(rejectEntry{Table: table, Row: row_ident(row), Column: name, Reason: reason})
+				keep = false
+				break
+			}
+			row[name] = b
+		}
+
+		if !keep {
+			stats.skipped++
+			continue
+		}
+		kept = append(kept, row)
+	}
+	return kept
+}
+
+func parse_boolean(value interface{}) (bool, error) {
+	var s string
+	switch v := value.(type) {
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	}
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "1", "t", "true":
+		return true, nil
+	case "0", "f", "false":
+		return false, nil
+	}
+	return false, fmt.Errorf("%q is not a boolean", s)
+}
+
+// coerce_affinity converts values sqlite stored with a different type than
+// the destination column has, which pgx refuses to bind: numbers stored as
+// text, integers stored as REAL, text stored as blobs or numbers. Lossy
+// conversions are logged, and rows with values that don't convert at all are
+// rejected. Returns the rows that are kept.
+func coerce_affinity(table string, rows []map[string]interface{}, columns tableColumns, opts Options, stats *tableStats) []map[string]interface{} {
+	log := opts.logger()
+	kept := rows[:0]
+	for _, row := range rows {
+		keep := true
+		for name, value := range row {
+			col, ok := columns[name]
+			if !ok || value == nil {
+				continue
+			}
+
+			converted, lossy, err := coerce_value(value, col.dataType)
+			if err != nil {
+				reason := fmt.Sprintf("column %s: %v", name, err)
+				log.Errorf("%s (%s): %s", table, row_ident(row), reason)
+				opts.rejects.add(rejectEntry{Table: table, Row: row_ident(row), Column: name, Reason: reason})
+				keep = false
+				break
+			}
+			if lossy {
+				log.Warnf("%s (%s): %s %v stored as %v", table, row_ident(row), name, value, converted)
+				stats.modified++
+			}
+			row[name] = converted
+		}
+
+		if !keep {
+			stats.skipped++
+			continue
+		}
+		kept = append(kept, row)
+	}
+	return kept
+}
+
+// coerce_value converts value for a column of dataType, reporting whether
+// the conversion lost information.
+func coerce_value(value interface{}, dataType string) (interface{}, bool, error) {
+	if b, ok := value.([]byte); ok && dataType != "bytea" {
+		value = string(b)
+	}
+
+	switch {
+	case is_integer_type(dataType):
+		switch v := value.(type) {
+		case string:
+			s := strings.TrimSpace(v)
+			if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+				return i, false, nil
+			}
+			f, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return nil, false, fmt.Errorf("%q is not an integer", v)
+			}
+			return float_to_integer(f)
+		case float64:
+			return float_to_integer(v)
+		}
+	case is_numeric_type(dataType):
+		if v, ok := value.(string); ok {
+			f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil {
+				return nil, false, fmt.Errorf("%q is not a number", v)
+			}
+			return f, false, nil
+		}
+	case dataType == "text" || dataType == "character varying":
+		switch v := value.(type) {
+		case int64:
+			return strconv.FormatInt(v, 10), false, nil
+		case float64:
+			return strconv.FormatFloat(v, 'g', -1, 64), false, nil
+		}
+	}
+	return value, false, nil
+}
+
+// float_to_integer rounds f to the nearest integer; anything with a
+// fraction is lossy.
+func float_to_integer(f float64) (interface{}, bool, error) {
+	r := math.Round(f)
+	if r < math.MinInt64 || r >= math.MaxInt64 {
+		return nil, false, fmt.Errorf("%v is out of range for an integer", f)
+	}
+	return int64(r), r != f, nil
+}
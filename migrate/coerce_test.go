@@ -0,0 +1,73 @@
+package migrate
+
+import "testing"
+
+// TestEmptyStringsNeverZero runs "", whitespace and "0" through the
+// conversions for integer, numeric and boolean columns: empty values become
+// NULL or reject the row, and only "0" is a zero.
+func TestEmptyStringsNeverZero(t *testing.T) {
+	tests := []struct {
+		dataType string
+		nullable bool
+		value    interface{}
+		// want is the value stored, rejected set when the row is
+		// rejected instead.
+		want     interface{}
+		rejected bool
+	}{
+		{"integer", true, "", nil, false},
+		{"integer", true, "  ", nil, false},
+		{"integer", true, []byte(" \t"), nil, false},
+		{"integer", false, "", nil, true},
+		{"integer", false, " ", nil, true},
+		{"integer", false, "0", int64(0), false},
+		{"bigint", true, "0", int64(0), false},
+		{"numeric", true, "", nil, false},
+		{"numeric", true, "\n", nil, false},
+		{"numeric", false, "", nil, true},
+		{"numeric", false, "0", float64(0), false},
+		{"double precision", false, " ", nil, true},
+		{"boolean", true, "", nil, false},
+		{"boolean", true, "  ", nil, false},
+		{"boolean", false, "", nil, true},
+		{"boolean", false, "0", false, false},
+		{"boolean", false, int64(0), false, false},
+		{"boolean", false, "1", true, false},
+		// Not a boolean either, the row is rejected rather than the run
+		{"boolean", false, "maybe", nil, true},
+		{"boolean", false, int64(2), nil, true},
+	}
+	for _, test := range tests {
+		columns := tableColumns{
+			"id":    {name: "id", dataType: "integer"},
+			"value": {name: "value", dataType: test.dataType, nullable: test.nullable},
+		}
+		stats := &tableStats{table: "t"}
+		rows := []map[string]interface{}{
+			{"id": int64(1), "value": test.value},
+			{"id": int64(2), "value": nil},
+		}
+		if !test.nullable {
+			rows[1]["value"] = "1"
+		}
+
+		kept, err := transform_rows("t", 0, rows, columns, DefaultOptions(), stats)
+		if err != nil {
+			t.Errorf("%s %q: %v", test.dataType, test.value, err)
+			continue
+		}
+		if test.rejected {
+			if len(kept) != 1 || kept[0]["id"] != int64(2) || stats.skipped != 1 {
+				t.Errorf("%s NOT NULL %q: kept %v, want the row rejected", test.dataType, test.value, kept)
+			}
+			continue
+		}
+		if len(kept) != 2 {
+			t.Errorf("%s %q: kept %d rows, want both", test.dataType, test.value, len(kept))
+			continue
+		}
+		if got := kept[0]["value"]; got != test.want {
+			t.Errorf("%s %q: stored %#v, want %#v", test.dataType, test.value, got, test.want)
+		}
+	}
+}
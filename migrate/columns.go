@@ -0,0 +1,84 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// columnInfo describes a destination column.
+type columnInfo struct {
+	name     string
+	dataType string
+	nullable bool
+	// defaultExpr is the column's DEFAULT expression, empty without one.
+	defaultExpr string
+	// maxLength is the length limit of a character column, 0 without one.
+	maxLength int
+}
+
+// tableColumns maps column names to their destination description.
+type tableColumns map[string]columnInfo
+
+const select_columns = `
+SELECT column_name, data_type, is_nullable = 'YES', COALESCE(column_default, ''), COALESCE(character_maximum_length, 0)
+FROM information_schema.columns
+WHERE table_schema = current_schema() AND table_name = $1
+`
+
+// load_dest_columns reads the column types of a destination table once, so
+// that values can be converted to what the destination expects.
+func load_dest_columns(ctx context.Context, db *sqlx.DB, table string) (tableColumns, error) {
+	rows, err := db.QueryxContext(ctx, select_columns, table)
+	if err != nil {
+		return nil, fmt.Errorf("dest columns of %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	columns := tableColumns{}
+	for rows.Next() {
+		var c columnInfo
+		if err := rows.Scan(&c.name, &c.dataType, &c.nullable, &c.defaultExpr, &c.maxLength); err != nil {
+			return nil, fmt.Errorf("dest columns of %s: %w", table, err)
+		}
+		columns[c.name] = c
+	}
+	return columns, rows.Err()
+}
+
+func is_numeric_type(dataType string) bool {
+	switch dataType {
+	case "smallint", "integer", "bigint", "numeric", "real", "double precision":
+		return true
+	}
+	return false
+}
+
+// stash_boolean_columns are the columns stash declares as booleans. Generic
+// converters tend to turn them into integers.
+var stash_boolean_columns = map[string][]string{
+	"galleries":   {"organized"},
+	"images":      {"organized"},
+	"performers":  {"favorite", "ignore_auto_tag"},
+	"scenes":      {"organized"},
+	"studios":     {"favorite", "ignore_auto_tag"},
+	"tags":        {"favorite", "ignore_auto_tag"},
+	"video_files": {"interactive"},
+}
+
+func is_integer_type(dataType string) bool {
+	switch dataType {
+	case "smallint", "integer", "bigint":
+		return true
+	}
+	return false
+}
+
+func is_time_type(dataType string) bool {
+	switch dataType {
+	case "date", "timestamp without time zone", "timestamp with time zone":
+		return true
+	}
+	return false
+}
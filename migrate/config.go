@@ -0,0 +1,62 @@
+package migrate
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LoadConfigFile applies a config file of `flag-name = value` lines, with
+// blank lines and # comments ignored. Flags given on the command line take
+// precedence over the file.
+func LoadConfigFile(fs *flag.FlagSet, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open config: %w", err)
+	}
+	defer file.Close()
+
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		if s := find_setting(f.Name); s != nil {
+			explicit[s.name] = true
+		}
+	})
+	dir := filepath.Dir(path)
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(text, "=")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected key = value", path, line)
+		}
+		key = strings.TrimSpace(key)
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+
+		s := find_setting(key)
+		if s == nil || fs.Lookup(key) == nil {
+			return fmt.Errorf("%s:%d: unknown setting %q", path, line, key)
+		}
+		if key == "config" {
+			return fmt.Errorf("%s:%d: config files can't include other config files", path, line)
+		}
+		if explicit[s.name] {
+			continue
+		}
+		if s.path && value != "" && !filepath.IsAbs(value) {
+			value = filepath.Join(dir, value)
+		}
+		if err := fs.Set(key, value); err != nil {
+			return fmt.Errorf("%s:%d: %s: %w", path, line, key, err)
+		}
+	}
+	return scanner.Err()
+}
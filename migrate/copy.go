@@ -0,0 +1,563 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/doug-martin/goqu/v9"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	onConflictError  = "error"
+	onConflictSkip   = "skip"
+	onConflictUpdate = "update"
+)
+
+// migration holds the state shared by the tables of one run.
+type migration struct {
+	sourceDB *sqlx.DB
+	destDB   *sqlx.DB
+	opts     Options
+	rep      *Report
+	notify   *notifier
+
+	// since is set for an incremental sync.
+	since time.Time
+	// tables are the tables being migrated, in order.
+	tables []string
+	// merges is set when rows are merged or changed before migrating, like
+	// names differing only in case.
+	merges *rowMerges
+	// settings are extra SET LOCAL statements for every table's
+	// transaction, from -fast.
+	settings []string
+	// orphans are the references to missing rows to leave out, with
+	// -prune-orphans, and to rows left out by the filters.
+	orphans orphans
+	// filters leave rows out, nil without -where or Filters.
+	filters *rowFilters
+}
+
+func fetch_batch(ctx context.Context, txn *sqlx.Tx, table string, where goqu.Expression, offset int, limit int) ([]map[string]interface{}, error) {
+	goquTable := goqu.I(table)
+	q := anon_dialect.From(goquTable).Select(goquTable.All()).Limit(uint(limit)).Offset(uint(offset))
+	if where != nil {
+		q = q.Where(where)
+	}
+	sql, args, err := q.ToSQL()
+	if err != nil {
+		return nil, fmt.Errorf("source failed tosql: %w", err)
+	}
+
+	r, err := txn.QueryxContext(ctx, sql, args...)
+	if err != nil {
+		return nil, classify(ErrSource, fmt.Errorf("query `%s` [%v]: %w", sql, args, err))
+	}
+	defer r.Close()
+
+	scanner, err := new_row_scanner(r)
+	if err != nil {
+		return nil, classify(ErrSource, fmt.Errorf("source columns: %w", err))
+	}
+	rowsSlice := make([]map[string]interface{}, 0, limit)
+	for r.Next() {
+		row, err := scanner.scan(r)
+		if err != nil {
+			return nil, classify(ErrSource, fmt.Errorf("failed structscan: %w", err))
+		}
+		rowsSlice = append(rowsSlice, row)
+	}
+	return rowsSlice, classify(ErrSource, r.Err())
+}
+
+// with_statement_timeout runs fn, the fetch or insert of a batch, bounded
+// by -statement-timeout, and names the batch, as what, when it runs out of
+// time or the run does.
+func with_statement_timeout(ctx context.Context, opts Options, what string, fn func(ctx context.Context) error) error {
+	sctx := ctx
+	if opts.StatementTimeout > 0 {
+		var cancel context.CancelFunc
+		sctx, cancel = context.WithTimeout(ctx, opts.StatementTimeout)
+		defer cancel()
+	}
+
+	err := fn(sctx)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return fmt.Errorf("%s: -timeout %s reached: %w", what, opts.Timeout, err)
+	case ctx.Err() == nil && sctx.Err() != nil:
+		return fmt.Errorf("%s: took longer than -statement-timeout %s: %w", what, opts.StatementTimeout, err)
+	}
+	return err
+}
+
+// insert_batch inserts one batch inside a savepoint, so that a failing batch
+// is rolled back on its own instead of aborting the table's transaction.
+func (m *migration) insert_batch(ctx context.Context, dtxn *sqlx.Tx, table string, sql string, args []interface{}, rowsSlice []map[string]interface{}) error {
+	if _, err := dtxn.ExecContext(ctx, "SAVEPOINT batch"); err != nil {
+		return fmt.Errorf("savepoint: %w", err)
+	}
+
+	err := func() error {
+		if _, err := dtxn.ExecContext(ctx, sql, args...); err != nil {
+			return fmt.Errorf("exec `%.200s` [%d args]: %w", sql, len(args), err)
+		}
+		if m.opts.Provenance {
+			return record_provenance(ctx, dtxn, table, m.opts.SourceLabel, rowsSlice)
+		}
+		return nil
+	}()
+	if err != nil {
+		if _, rerr := dtxn.ExecContext(ctx, "ROLLBACK TO SAVEPOINT batch"); rerr != nil {
+			return fmt.Errorf("%w: %w (rollback to savepoint: %v)", errTxnLost, err, rerr)
+		}
+		return err
+	}
+
+	if _, err := dtxn.ExecContext(ctx, "RELEASE SAVEPOINT batch"); err != nil {
+		return fmt.Errorf("release savepoint: %w", err)
+	}
+	return nil
+}
+
+// rowFailure is a row of a failed batch that also fails on its own.
+type rowFailure struct {
+	index int
+	row   map[string]interface{}
+	err   error
+}
+
+// isolate_rows inserts the rows of a failed batch one at a time, each in its
+// own savepoint, so that the rest of the batch still lands and the rows
+// responsible for the failure can be named.
+func (m *migration) isolate_rows(ctx context.Context, dtxn *sqlx.Tx, table string, insert *insertBuilder, rowsSlice []map[string]interface{}) ([]rowFailure, error) {
+	var failures []rowFailure
+	for idx, row := range rowsSlice {
+		one := rowsSlice[idx : idx+1]
+		sql, args, err := insert.build(one)
+		if err != nil {
+			return nil, err
+		}
+		if err := m.insert_batch(ctx, dtxn, table, sql, args, one); err != nil {
+			if ctx.Err() != nil || errors.Is(err, errTxnLost) {
+				return nil, err
+			}
+			failures = append(failures, rowFailure{index: idx, row: row, err: err})
+		}
+	}
+	return failures, nil
+}
+
+// rowError is the error of a failed row described by describe_row_error,
+// still wrapping what postgres said for classify_error.
+type rowError struct {
+	msg string
+	err error
+}
+
+func (e *rowError) Error() string { return e.msg }
+func (e *rowError) Unwrap() error { return e.err }
+
+// describe_row_error names the offending column and its value when postgres
+// reports one.
+func describe_row_error(row map[string]interface{}, err error) string {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return err.Error()
+	}
+
+	msg := pgErr.Message
+	if pgErr.Detail != "" {
+		msg += " (" + pgErr.Detail + ")"
+	}
+	if pgErr.ColumnName != "" {
+		value := fmt.Sprintf("%v", row[pgErr.ColumnName])
+		if len(value) > 100 {
+			value = value[:100] + "..."
+		}
+		msg = fmt.Sprintf("column %s = %q: %s", pgErr.ColumnName, value, msg)
+	}
+	return msg
+}
+
+// restart_table forgets what an aborted attempt at table did, before it is
+// copied again from the start.
+func (m *migration) restart_table(table string) {
+	stats := m.rep.table(table)
+	m.opts.progress.add_rows(-stats.fetched)
+	*stats = tableStats{table: table}
+
+	failures := m.rep.failures[:0]
+	for _, f := range m.rep.failures {
+		if f.table != table {
+			failures = append(failures, f)
+		}
+	}
+	m.rep.failures = failures
+}
+
+// transform_rows fixes up a batch of source rows for the destination. Rows
+// that can't be migrated are removed from the returned slice.
+func transform_rows(table string, offset int, rows []map[string]interface{}, columns tableColumns, opts Options, stats *tableStats) ([]map[string]interface{}, error) {
+	rows, err := run_transforms(table, offset, rows, opts.Transforms.for_table(table, columns, opts), stats)
+	if err != nil {
+		return nil, err
+	}
+
+	sanitize_timestamps(table, rows, columns, opts, stats)
+	repair_text(table, rows, columns, opts, stats)
+	replace_non_finite(table, rows, columns, opts, stats)
+	rows = repair_json_columns(table, rows, opts, stats)
+	rows = coerce_empty_strings(table, rows, columns, opts, stats)
+	rows = coerce_affinity(table, rows, columns, opts, stats)
+	clamp_integers(table, rows, columns, opts, stats)
+	rows = convert_booleans(table, rows, columns, opts, stats)
+	apply_dest_defaults(table, rows, columns, opts, stats)
+
+	return check_value_sizes(table, offset, rows, opts, stats)
+}
+
+// insert_rows inserts rows in batches of the sizer's size. A batch that
+// fails is retried after transient errors, split after running out of time,
+// and otherwise inserted row by row to find and report the failing rows.
+func (m *migration) insert_rows(ctx context.Context, dtxn *sqlx.Tx, table string, insert *insertBuilder, sizer *batchSizer, offset int, rows []map[string]interface{}) error {
+	log := logger(ctx)
+	opts := m.opts
+	stats := m.rep.table(table)
+
+	for done := 0; done < len(rows); {
+		batch := rows[done:min(done+sizer.size, len(rows))]
+		first := offset + done
+		sql, args, err := insert.build(batch)
+		if err != nil {
+			return err
+		}
+
+		start := time.Now()
+		err = m.insert_batch(ctx, dtxn, table, sql, args, batch)
+		for attempt := 0; err != nil && is_transient(err) && !errors.Is(err, errTxnLost) && attempt < opts.Retries; attempt++ {
+			wait := backoff(attempt, opts.RetryBackoff)
+			log.Warnf("%s: batch at row %d failed (%v), retrying in %s", table, first, err, wait)
+			if err := sleep_ctx(ctx, wait); err != nil {
+				return err
+			}
+			start = time.Now()
+			err = m.insert_batch(ctx, dtxn, table, sql, args, batch)
+		}
+		if is_statement_timeout(err) && sizer.shrink(table) {
+			continue
+		}
+		sizer.observe(table, time.Since(start))
+		done += len(batch)
+
+		if err == nil {
+			stats.inserted += int64(len(batch))
+			stats.bytesWritten += rows_bytes(batch)
+			log.Debugf("%s: inserted rows %d-%d", table, first, first+len(batch)-1)
+			continue
+		}
+		if ctx.Err() != nil || errors.Is(err, errTxnLost) {
+			return err
+		}
+
+		log.Warnf("%s: batch of rows %d-%d failed, retrying row by row: %v", table, first, first+len(batch)-1, err)
+		failures, err := m.isolate_rows(ctx, dtxn, table, insert, batch)
+		if err != nil {
+			return err
+		}
+		stats.inserted += int64(len(batch) - len(failures))
+		stats.bytesWritten += rows_bytes(batch)
+		for _, f := range failures {
+			stats.bytesWritten -= row_bytes(f.row)
+		}
+
+		for _, f := range failures {
+			row := first + f.index
+			msg := describe_row_error(f.row, f.err)
+			if !opts.ContinueOnError {
+				return fmt.Errorf("%s row %d (%s): %w", table, row, row_ident(f.row), &rowError{msg: msg, err: f.err})
+			}
+
+			log.Errorf("%s: row %d (%s) failed: %s", table, row, row_ident(f.row), msg)
+			m.rep.add_failure(table, row, row, f.err)
+			opts.rejects.add(rejectEntry{Table: table, Row: row_ident(f.row), Reason: msg})
+			stats.failed++
+
+			if opts.MaxErrors > 0 && len(m.rep.failures) >= opts.MaxErrors {
+				return fmt.Errorf("giving up after %d failed rows (--max-errors)", len(m.rep.failures))
+			}
+		}
+	}
+	return nil
+}
+
+// copy_table copies one table inside a single destination transaction, so
+// that a table is either fully migrated or not at all.
+func (m *migration) copy_table(ctx context.Context, tableIdx int, table string) error {
+	log := logger(ctx)
+	opts := m.opts
+	stats := m.rep.table(table)
+	opts.progress.start_table(table, tableIdx, len(m.tables))
+
+	if opts.Resume {
+		done, err := table_already_migrated(ctx, m.sourceDB, m.destDB, table)
+		if err != nil {
+			return err
+		}
+		if done {
+			log.Infof("Skipping %s, already migrated", table)
+			stats.resumed = true
+			return nil
+		}
+	}
+
+	start := time.Now()
+	stxn, err := m.sourceDB.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("source begin tx: %w", err)
+	}
+	defer stxn.Rollback()
+
+	var dtxn *sqlx.Tx
+	if !opts.DryRun {
+		dtxn, err = begin_dest(ctx, m.destDB, m.settings...)
+		if err != nil {
+			return err
+		}
+		// Does nothing once the transaction is committed
+		defer dtxn.Rollback()
+	}
+
+	columns, err := load_dest_columns(ctx, m.destDB, table)
+	if err != nil {
+		return err
+	}
+
+	var blobs *blobWriter
+	if table == "blobs" && opts.BlobsDir != "" && !opts.DryRun {
+		blobs, err = new_blob_writer(opts.BlobsDir, opts.BlobFsync, opts.BlobWorkers, opts.Retries, opts.RetryBackoff, log)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if blobs != nil {
+				blobs.close()
+			}
+		}()
+	}
+
+	// An incremental sync updates the rows that changed since the last run.
+	// Tables without a timestamp are copied in full, skipping what is
+	// already there.
+	var where goqu.Expression
+	if !m.since.IsZero() {
+		column, err := sync_column(ctx, m.sourceDB, table)
+		if err != nil {
+			return err
+		}
+		if column != "" {
+			where = changed_since(column, m.since)
+		}
+		if opts.OnConflict == onConflictError {
+			opts.OnConflict = onConflictSkip
+			if column != "" {
+				opts.OnConflict = onConflictUpdate
+			}
+		}
+	}
+
+	if condition := m.filters.condition(table); condition != nil {
+		if where != nil {
+			where = goqu.And(where, condition)
+		} else {
+			where = condition
+		}
+		stats.filtered += m.filters.filtered[table]
+	}
+
+	var conflictKey []string
+	if opts.OnConflict != onConflictError {
+		conflictKey, err = load_conflict_key(ctx, m.destDB, table)
+		if err != nil {
+			return err
+		}
+		if conflictKey == nil {
+			log.Warnf("%s has no primary key or unique index, only conflicts with other constraints are skipped", table)
+		}
+	}
+
+	// Merging rows can turn the rows referencing them into duplicates
+	var dedupe *deduper
+	if opts.Dedupe || (m.merges != nil && m.merges.remaps(table)) {
+		keys, err := load_unique_keys(ctx, m.destDB, table)
+		if err != nil {
+			return err
+		}
+		dedupe = new_deduper(keys)
+	} else if key, ok := collapsed_tables[table]; ok {
+		dedupe = new_deduper([]uniqueKey{key})
+		dedupe.collapse = true
+	}
+
+	sizer := new_batch_sizer(opts.BatchSize, opts.BatchTimeout, log)
+	if dtxn != nil && opts.BatchTimeout > 0 {
+		// A statement timeout, unlike a cancelled context, leaves the
+		// connection and the transaction usable
+		sql := fmt.Sprintf("SET LOCAL statement_timeout = %d", opts.BatchTimeout.Milliseconds())
+		if _, err := dtxn.ExecContext(ctx, sql); err != nil {
+			return fmt.Errorf("exec `%s`: %w", sql, err)
+		}
+	}
+	defer func() {
+		stats.batchSize, stats.smallestBatch = sizer.size, sizer.smallest
+	}()
+	if table == "blobs" {
+		// Don't find out the hard way, with a thousand images in memory
+		sizer.rowBytes = maxFetchBytes
+	}
+
+	var indexes []indexDef
+	if dtxn != nil && opts.RebuildIndexes {
+		indexes, err = drop_indexes(ctx, dtxn, table)
+		if err != nil {
+			return err
+		}
+	}
+
+	var insert *insertBuilder
+
+	log.Infof("Fetching %s", table)
+	fetched := 0
+	for offset := 0; ; offset += fetched {
+		if err := ctx.Err(); errors.Is(err, context.DeadlineExceeded) {
+			return fmt.Errorf("%s: -timeout %s reached before the batch from row %d: %w", table, opts.Timeout, offset, err)
+		} else if err != nil {
+			return fmt.Errorf("%s: %w", table, ErrInterrupted)
+		}
+		// Checked before every batch, as dry runs and batches left empty
+		// by the filters and transforms insert nothing
+		if opts.stopping.requested() {
+			return fmt.Errorf("%s: %w", table, ErrInterrupted)
+		}
+		if m.notify != nil {
+			m.notify.extend()
+			m.notify.status("Migrating %s (table %d/%d), %.1f%% done", table, tableIdx+1, len(m.tables), opts.progress.snapshot().Percent)
+		}
+
+		var rowsSlice []map[string]interface{}
+		fetchStart := time.Now()
+		err := with_statement_timeout(ctx, opts, fmt.Sprintf("%s: fetching the batch from row %d", table, offset), func(ctx context.Context) (err error) {
+			rowsSlice, err = fetch_batch(ctx, stxn, table, where, offset, sizer.fetch_limit())
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		stats.fetchTime += m.rep.phases.fetched(fetchStart)
+		if len(rowsSlice) == 0 {
+			break
+		}
+		fetched = len(rowsSlice)
+		bytes := rows_bytes(rowsSlice)
+		sizer.observe_rows(fetched, bytes)
+
+		stats.fetched += int64(len(rowsSlice))
+		stats.bytesRead += bytes
+		opts.progress.add_rows(int64(len(rowsSlice)))
+
+		rowsSlice, err = m.filters.apply(table, offset, rowsSlice, stats)
+		if err != nil {
+			return err
+		}
+
+		// Only the checksum rows go to the database, the content to disk
+		if blobs != nil {
+			for _, row := range rowsSlice {
+				checksum, _ := row["checksum"].(string)
+				data, ok := row["blob"].([]byte)
+				if !ok {
+					continue
+				}
+				if err := blobs.write(checksum, data); err != nil {
+					return err
+				}
+				row["blob"] = nil
+			}
+		}
+
+		transformStart := time.Now()
+		rowsSlice, err = transform_rows(table, offset, rowsSlice, columns, opts, stats)
+		if err != nil {
+			return err
+		}
+		if m.merges != nil {
+			rowsSlice = m.merges.apply(table, rowsSlice, stats)
+		}
+		rowsSlice = m.orphans.prune(table, rowsSlice, columns, opts, stats)
+		if dedupe != nil {
+			rowsSlice = dedupe_rows(table, dedupe, rowsSlice, opts, stats)
+		}
+		// Last, so that renamed and merged values are anonymized too
+		opts.anonymizer.apply(table, rowsSlice, stats)
+		m.rep.phases.transformed(transformStart)
+		if len(rowsSlice) == 0 {
+			continue
+		}
+
+		if insert == nil {
+			insert = new_insert_builder(table, columns)
+			if opts.OnConflict != onConflictError {
+				insert.on_conflict(opts.OnConflict, conflictKey)
+			}
+		}
+		if opts.DryRun {
+			sql, _, err := insert.build(rowsSlice)
+			if err != nil {
+				return err
+			}
+			stats.inserted += int64(len(rowsSlice))
+			log.Debugf("%s: would insert rows %d-%d (%d bytes of SQL)", table, offset, offset+len(rowsSlice)-1, len(sql))
+			continue
+		}
+
+		insertStart := time.Now()
+		err = with_statement_timeout(ctx, opts, fmt.Sprintf("%s: inserting the batch from row %d", table, offset), func(ctx context.Context) error {
+			return m.insert_rows(ctx, dtxn, table, insert, sizer, offset, rowsSlice)
+		})
+		if err != nil {
+			return err
+		}
+		stats.insertTime += m.rep.phases.inserted(insertStart)
+	}
+
+	if blobs != nil {
+		blobStats, err := blobs.close()
+		blobs = nil
+		m.rep.blobs = &blobStats
+		if err != nil {
+			return err
+		}
+	}
+
+	if dtxn != nil {
+		if err := recreate_indexes(ctx, dtxn, table, indexes); err != nil {
+			return err
+		}
+		if err := dtxn.Commit(); err != nil {
+			return fmt.Errorf("commit %s: %w", table, err)
+		}
+		stats.committed = true
+		stats.elapsed = time.Since(start)
+		log.Infof("Committed %s (%d rows in %s, %s)", table, stats.inserted, stats.elapsed.Round(time.Millisecond), stats.throughput())
+		return nil
+	}
+	stats.elapsed = time.Since(start)
+	log.Infof("Read %s (%d rows in %s, %s)", table, stats.fetched, stats.elapsed.Round(time.Millisecond), stats.throughput())
+	return nil
+}
@@ -0,0 +1,151 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// tags_columns are the destination columns of a minimal tags table.
+var tags_columns = []columnInfo{
+	{name: "id", dataType: "integer"},
+	{name: "name", dataType: "character varying", maxLength: 255},
+}
+
+// new_test_migration returns a migration of a source with two tags into a
+// fake destination, through handles given in the options.
+func new_test_migration(t *testing.T) (*migration, *fakeDest) {
+	t.Helper()
+	source := open_test_source(t,
+		"CREATE TABLE tags (id INTEGER PRIMARY KEY, name VARCHAR(255))",
+		"INSERT INTO tags (id, name) VALUES (1, 'a'), (2, 'b')",
+	)
+	fake, dest := new_fake_dest(t)
+	fake.columns["tags"] = tags_columns
+
+	opts := DefaultOptions()
+	opts.SourceDB = source
+	opts.DestDB = dest
+	return &migration{sourceDB: source, destDB: dest, opts: opts, rep: new_report(opts), tables: []string{"tags"}}, fake
+}
+
+func TestCopyTableCommits(t *testing.T) {
+	m, fake := new_test_migration(t)
+	if err := m.copy_table(context.Background(), 0, "tags"); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.ran("INSERT INTO")) != 1 || len(fake.ran("COMMIT")) != 1 {
+		t.Errorf("ran %v, want an insert and a commit", fake.statements)
+	}
+	if stats := m.rep.table("tags"); !stats.committed || stats.inserted != 2 {
+		t.Errorf("committed = %v, inserted = %d, want 2 committed", stats.committed, stats.inserted)
+	}
+}
+
+// TestCopyTableColumnOnSomeRows checks that a column a transform sets on
+// only some rows is inserted, NULL on the others.
+func TestCopyTableColumnOnSomeRows(t *testing.T) {
+	m, fake := new_test_migration(t)
+	fake.columns["tags"] = append(tags_columns, columnInfo{name: "description", dataType: "text", nullable: true})
+	m.opts.Transforms.Add("tags", "describe", func(table string, row map[string]interface{}) (bool, error) {
+		if row["id"] == int64(1) {
+			row["description"] = "the first"
+		}
+		return true, nil
+	})
+
+	if err := m.copy_table(context.Background(), 0, "tags"); err != nil {
+		t.Fatal(err)
+	}
+	want := `INSERT INTO "tags" ("description", "id", "name") VALUES ($1, $2, $3), ($4, $5, $6)`
+	if inserts := fake.ran("INSERT INTO"); len(inserts) != 1 || inserts[0] != want {
+		t.Errorf("inserted with %v, want %s", inserts, want)
+	}
+}
+
+// TestCopyTableRollsBack fails each step of copying a table and checks
+// that the error is returned with the destination transaction rolled back
+// and the source transaction ended.
+func TestCopyTableRollsBack(t *testing.T) {
+	failure := errors.New("injected failure")
+	tests := []struct {
+		name   string
+		inject func(m *migration, fake *fakeDest)
+		// committed is set when the failure is the commit's, which ends
+		// the transaction itself.
+		committed bool
+	}{
+		{"settings", func(m *migration, fake *fakeDest) {
+			fake.fail("session_replication_role", failure)
+		}, false},
+		{"columns", func(m *migration, fake *fakeDest) {
+			fake.fail("information_schema.columns", failure)
+		}, false},
+		// The insert is built from the transformed rows, where goqu's ToSQL
+		// used to fail
+		{"build", func(m *migration, fake *fakeDest) {
+			m.opts.Transforms.Add("tags", "failing", func(table string, row map[string]interface{}) (bool, error) {
+				return false, failure
+			})
+		}, false},
+		{"exec", func(m *migration, fake *fakeDest) {
+			fake.fail("SAVEPOINT batch", failure)
+		}, false},
+		{"commit", func(m *migration, fake *fakeDest) {
+			fake.commitErr = failure
+		}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, fake := new_test_migration(t)
+			test.inject(m, fake)
+
+			err := m.copy_table(context.Background(), 0, "tags")
+			if !errors.Is(err, failure) {
+				t.Fatalf("copy_table = %v, want the injected failure", err)
+			}
+			if n := fake.open_transactions(); n != 0 {
+				t.Errorf("%d destination transactions left open", n)
+			}
+			if test.committed {
+				if len(fake.ran("ROLLBACK")) != 0 {
+					t.Errorf("rolled back after the commit: %v", fake.statements)
+				}
+			} else if len(fake.ran("COMMIT")) != 0 || len(fake.ran("ROLLBACK")) != 1 {
+				t.Errorf("ran %v, want a rollback and no commit", fake.statements)
+			}
+			if m.rep.table("tags").committed {
+				t.Errorf("tags reported committed")
+			}
+			if inUse := m.sourceDB.Stats().InUse; inUse != 0 {
+				t.Errorf("%d source connections still in use", inUse)
+			}
+		})
+	}
+}
+
+// TestGivenHandlesStayOpen checks that handles given in the options are
+// left open for their owner, on error paths too.
+func TestGivenHandlesStayOpen(t *testing.T) {
+	m, _ := new_test_migration(t)
+
+	source, closeSource, err := open_source(m.opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest, closeDest, err := open_dest(context.Background(), "", m.opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source != m.opts.SourceDB || dest != m.opts.DestDB {
+		t.Fatalf("the given handles weren't used")
+	}
+	closeSource()
+	closeDest()
+	if err := source.Ping(); err != nil {
+		t.Errorf("source closed: %v", err)
+	}
+	if err := dest.Ping(); err != nil {
+		t.Errorf("destination closed: %v", err)
+	}
+}
@@ -0,0 +1,138 @@
+package migrate
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+// -output-dir writes a dump as one file per table in COPY's text format,
+// which postgres loads much faster than INSERT statements, and a
+// restore.sql that loads them with psql's \copy. \copy resolves the file
+// names against psql's working directory, so the script is run from inside
+// the directory.
+
+// copyEscaper escapes text for a COPY text format field: backslashes and
+// the delimiter, row and line separators.
+var copyEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	"\t", `\t`,
+	"\n", `\n`,
+	"\r", `\r`,
+)
+
+// copy_text formats a scanned value as a COPY text format field.
+func copy_text(value interface{}) string {
+	if value == nil {
+		return `\N`
+	}
+	return copyEscaper.Replace(literal_text(value))
+}
+
+// write_copy_file writes the rows of table to path, returning their columns
+// and serial column. The file is left out when the table has no rows.
+func write_copy_file(ctx context.Context, sourceDB *sqlx.DB, table string, path string, opts Options, stats *tableStats) ([]string, string, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("create %s: %w", path, err)
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	var names []string
+	serial, err := dump_rows(ctx, sourceDB, table, opts, stats, func(columns []string, rows []map[string]interface{}) error {
+		// The COPY of a file has one column list
+		if names != nil && len(columns) != len(names) {
+			return fmt.Errorf("%s: a transform added columns after the first batch, which a COPY file can't hold, use -output instead", table)
+		}
+		names = slices.Clone(columns)
+		fields := make([]string, len(columns))
+		for _, row := range rows {
+			for i, column := range columns {
+				fields[i] = copy_text(row[column])
+			}
+			w.WriteString(strings.Join(fields, "\t"))
+			w.WriteByte('\n')
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	if err := w.Flush(); err != nil {
+		return nil, "", fmt.Errorf("write %s: %w", path, err)
+	}
+	if err := file.Close(); err != nil {
+		return nil, "", fmt.Errorf("write %s: %w", path, err)
+	}
+	if names == nil {
+		if err := os.Remove(path); err != nil {
+			return nil, "", err
+		}
+	}
+	return names, serial, nil
+}
+
+// dump_copy writes the migration of the source to opts.OutputDir as COPY
+// files and their restore.sql.
+func dump_copy(ctx context.Context, opts Options) (*Report, error) {
+	log := logger(ctx)
+	if opts.SourceLabel == "" {
+		opts.SourceLabel = default_source_label(opts.SQLite)
+	}
+	rep, sourceDB, closeSource, err := dump_source(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer closeSource()
+
+	if err := os.MkdirAll(opts.OutputDir, 0755); err != nil {
+		return nil, fmt.Errorf("create %s: %w", opts.OutputDir, err)
+	}
+	restorePath := filepath.Join(opts.OutputDir, "restore.sql")
+	file, err := os.Create(restorePath)
+	if err != nil {
+		return nil, fmt.Errorf("create restore script: %w", err)
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	fmt.Fprintf(w, "-- Migration of %s, generated %s. Apply from this directory with\n", opts.SourceLabel, format_time(wall_clock()))
+	fmt.Fprintf(w, "-- psql -f restore.sql.\n")
+	fmt.Fprintf(w, "\\set ON_ERROR_STOP on\n")
+	dump_header(w, opts)
+
+	for i, table := range rep.planned {
+		log.Infof("Writing %s...", table)
+		opts.progress.start_table(table, i, len(rep.planned))
+		name := table + ".copy"
+		columns, serial, err := write_copy_file(ctx, sourceDB, table, filepath.Join(opts.OutputDir, name), opts, rep.table(table))
+		if err != nil {
+			return rep, err
+		}
+		if columns != nil {
+			fmt.Fprintf(w, "\\copy %s (%s) FROM '%s'\n", pgx.Identifier{table}.Sanitize(), quote_columns(columns), name)
+		}
+		if serial != "" {
+			w.WriteString(setval_statement(table, serial))
+		}
+	}
+	fmt.Fprintf(w, "COMMIT;\n")
+
+	if err := w.Flush(); err != nil {
+		return rep, fmt.Errorf("write restore script: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return rep, fmt.Errorf("write restore script: %w", err)
+	}
+	log.Infof("Wrote the migration to %s, load it with psql -f restore.sql from there", opts.OutputDir)
+	return rep, nil
+}
@@ -0,0 +1,135 @@
+package migrate
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCopyText(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		want  string
+	}{
+		{nil, `\N`},
+		{"plain", "plain"},
+		{"", ""},
+		{"a\tb", `a\tb`},
+		{"a\nb", `a\nb`},
+		{"a\r\nb", `a\r\nb`},
+		{`C:\scenes`, `C:\\scenes`},
+		// The text \N is not NULL
+		{`\N`, `\\N`},
+		{[]byte(`\N`), `\\x5c4e`},
+		// bytea is written as hex, its backslash escaped like any other
+		{[]byte{0x00, 0xff, '\t'}, `\\x00ff09`},
+		{[]byte{}, `\\x`},
+		{int64(-3), "-3"},
+		{true, "true"},
+	}
+	for _, test := range tests {
+		if got := copy_text(test.value); got != test.want {
+			t.Errorf("copy_text(%#v) = %s, want %s", test.value, got, test.want)
+		}
+	}
+}
+
+// file_fixture is run_fixture with the files in folders, their paths and
+// names holding what the COPY text format escapes.
+var file_fixture = slices.Concat(run_fixture, []string{
+	"CREATE TABLE folders (id INTEGER PRIMARY KEY, path TEXT, parent_folder_id INTEGER)",
+	`INSERT INTO folders VALUES (1, 'C:\media', NULL), (2, 'C:\media\new	folder', 1), (3, '/srv/line
+break', NULL), (4, '\N', NULL)`,
+	"ALTER TABLE files ADD COLUMN parent_folder_id INTEGER",
+	"UPDATE files SET parent_folder_id = id",
+	`INSERT INTO files (id, basename, parent_folder_id) VALUES (3, 'tab	name\.jpg', 3), (4, 'crlf` + "\r\n" + `.png', 4), (5, NULL, 2)`,
+})
+
+// copyUnescaper undoes copyEscaper, as COPY reads a text format field.
+var copyUnescaper = strings.NewReplacer(`\\`, `\`, `\t`, "\t", `\n`, "\n", `\r`, "\r")
+
+// read_copy_file reads the rows of a COPY text format file, nil for NULL.
+func read_copy_file(t *testing.T, path string) [][]interface{} {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rows [][]interface{}
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		var row []interface{}
+		for _, field := range strings.Split(line, "\t") {
+			if field == `\N` {
+				row = append(row, nil)
+			} else {
+				row = append(row, copyUnescaper.Replace(field))
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+var copyCommand = regexp.MustCompile(`^\\copy "([^"]+)" \((.+)\) FROM '([^']+)'$`)
+
+// TestCopyRoundTrip writes a library with files to COPY files, reads them
+// back as COPY would and checks that every row and path arrives as it is in
+// the source.
+func TestCopyRoundTrip(t *testing.T) {
+	opts := DefaultOptions()
+	opts.SourceDB = open_test_source(t, file_fixture...)
+	opts.OutputDir = t.TempDir()
+	opts.Yes = true
+	if _, err := New(opts).Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	script, err := os.ReadFile(filepath.Join(opts.OutputDir, "restore.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied := map[string]bool{}
+	for _, line := range strings.Split(string(script), "\n") {
+		m := copyCommand.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		table, file := m[1], m[3]
+		columns := strings.Split(strings.ReplaceAll(m[2], `"`, ""), ", ")
+		copied[table] = true
+
+		got := read_copy_file(t, filepath.Join(opts.OutputDir, file))
+		source, err := opts.SourceDB.Queryx("SELECT " + quote_columns(columns) + " FROM " + table + " ORDER BY rowid")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want [][]interface{}
+		for source.Next() {
+			values, err := source.SliceScan()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, value := range values {
+				if value != nil {
+					values[i] = literal_text(value)
+				}
+			}
+			want = append(want, values)
+		}
+		source.Close()
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s (%s) restores as\n%q\nwant\n%q", table, strings.Join(columns, ", "), got, want)
+		}
+	}
+
+	for _, table := range []string{"folders", "files", "images", "images_files"} {
+		if !copied[table] {
+			t.Errorf("restore.sql doesn't load %s", table)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// create_database creates the database connector points at, connecting to
+// the postgres maintenance database with the same credentials, and reports
+// whether it did. An existing database is left alone.
+func create_database(ctx context.Context, connector string, opts Options) (bool, error) {
+	log := logger(ctx)
+	config, err := parse_connector(connector)
+	if err != nil {
+		return false, err
+	}
+	name := config.Database
+	if name == "" || name == "postgres" {
+		return false, fmt.Errorf("-create-db needs a database name other than postgres in the connector")
+	}
+	config.Database = "postgres"
+
+	conn, err := pgx.ConnectConfig(ctx, config)
+	if err != nil {
+		return false, classify(ErrDestConnect, fmt.Errorf("connect to the postgres database: %w", err))
+	}
+	defer conn.Close(context.Background())
+
+	var exists bool
+	if err := conn.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM pg_database WHERE datname = $1)", name).Scan(&exists); err != nil {
+		return false, fmt.Errorf("look up database %s: %w", name, err)
+	}
+	if exists {
+		log.Infof("Database %s already exists", name)
+		return false, nil
+	}
+
+	sql := "CREATE DATABASE " + pgx.Identifier{name}.Sanitize()
+	if opts.CreateDBOwner != "" {
+		sql += " OWNER " + pgx.Identifier{opts.CreateDBOwner}.Sanitize()
+	}
+	if opts.CreateDBEncoding != "" {
+		sql += " ENCODING " + sql_literal(opts.CreateDBEncoding)
+	}
+	if opts.CreateDBLocale != "" {
+		// Only template0 may be copied with another locale
+		sql += " LC_COLLATE " + sql_literal(opts.CreateDBLocale) + " LC_CTYPE " + sql_literal(opts.CreateDBLocale) + " TEMPLATE template0"
+	}
+
+	log.Infof("%s", sql)
+	if _, err := conn.Exec(ctx, sql); err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "42501" {
+			return false, fmt.Errorf("role %s may not create databases: have an administrator create %s, or grant the role CREATEDB", config.User, name)
+		}
+		return false, fmt.Errorf("exec `%s`: %w", sql, err)
+	}
+	log.Infof("Created database %s", name)
+	return true, nil
+}
@@ -0,0 +1,116 @@
+package migrate
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Stash keeps performer custom field values in an untyped sqlite column, so
+// one column holds integers, floats, strings and booleans side by side, and
+// NULL where a value was cleared. Text may come back as string or []byte
+// depending on how it was written. The postgres schema stores the value's
+// type next to it, using stash's names for the types rather than Go's.
+const (
+	customFieldString = "string"
+	customFieldInt    = "int"
+	customFieldFloat  = "float"
+	customFieldBool   = "bool"
+)
+
+// custom_fields_transform fills in the type column, when the destination
+// has one, and converts every value for the destination's value column.
+func custom_fields_transform(columns tableColumns, _ Options) Transform {
+	_, hasType := columns["type"]
+	dataType := columns["value"].dataType
+	return func(table string, row map[string]interface{}) (bool, error) {
+		value := custom_field_parse(row["value"])
+		if hasType {
+			row["type"] = custom_field_type(value)
+		}
+		row["value"] = custom_field_value(value, dataType)
+		return true, nil
+	}
+}
+
+// custom_field_parse reads text that is a number or boolean as one, as
+// values set through older stash versions were always stored as text. Only
+// text that is exactly how the value is written back is converted, so that
+// "007", "1.50" or " 42 " stay the strings the user typed.
+func custom_field_parse(value interface{}) interface{} {
+	if b, ok := value.([]byte); ok {
+		value = string(b)
+	}
+	s, ok := value.(string)
+	if !ok {
+		return value
+	}
+
+	var parsed interface{}
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		parsed = i
+	} else if f, err := strconv.ParseFloat(s, 64); err == nil && !math.IsInf(f, 0) && !math.IsNaN(f) {
+		// Infinities and NaN are text to a user
+		parsed = f
+	} else if b, err := strconv.ParseBool(s); err == nil {
+		parsed = b
+	}
+	if parsed == nil || custom_field_text(parsed) != s {
+		return s
+	}
+	return parsed
+}
+
+// custom_field_type returns stash's type name for a parsed value, nil for
+// NULL.
+func custom_field_type(value interface{}) interface{} {
+	switch value.(type) {
+	case nil:
+		return nil
+	case int64, int32:
+		return customFieldInt
+	case float64:
+		return customFieldFloat
+	case bool:
+		return customFieldBool
+	}
+	return customFieldString
+}
+
+// custom_field_value converts a custom field value for a destination column
+// of the given type. NULL stays NULL whatever the type.
+func custom_field_value(value interface{}, dataType string) interface{} {
+	if value == nil {
+		return nil
+	}
+
+	switch dataType {
+	case "json", "jsonb":
+		// The supported values always marshal
+		encoded, _ := json.Marshal(value)
+		return string(encoded)
+	case "bytea":
+		return []byte(custom_field_text(value))
+	case "text", "character varying":
+		return custom_field_text(value)
+	}
+	return value
+}
+
+func custom_field_text(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case time.Time:
+		return format_time(v)
+	}
+	return fmt.Sprint(value)
+}
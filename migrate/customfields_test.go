@@ -0,0 +1,148 @@
+package migrate
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"testing"
+)
+
+func TestCustomFieldParse(t *testing.T) {
+	tests := []struct {
+		text string
+		want interface{}
+	}{
+		{"42", int64(42)},
+		{"-7", int64(-7)},
+		{"1.5", 1.5},
+		{"0.1", 0.1},
+		{"true", true},
+		{"false", false},
+		{"blue", "blue"},
+		{"", ""},
+		// Text that doesn't round-trip is kept as typed
+		{"007", "007"},
+		{"1.50", "1.50"},
+		{" 42 ", " 42 "},
+		{"1e3", "1e3"},
+		{"-0", "-0"},
+		{"+1", "+1"},
+		{"TRUE", "TRUE"},
+		{"t", "t"},
+		{"inf", "inf"},
+		{"+Inf", "+Inf"},
+		{"NaN", "NaN"},
+		{"99999999999999999999", "99999999999999999999"},
+	}
+	for _, test := range tests {
+		got := custom_field_parse(test.text)
+		if got != test.want {
+			t.Errorf("custom_field_parse(%q) = %#v, want %#v", test.text, got, test.want)
+		}
+		// Stored as bytes, the same
+		if got := custom_field_parse([]byte(test.text)); got != test.want {
+			t.Errorf("custom_field_parse([]byte(%q)) = %#v, want %#v", test.text, got, test.want)
+		}
+	}
+}
+
+// TestCustomFieldRoundTrip checks that every converted value is written to
+// a text column exactly as it was stored.
+func TestCustomFieldRoundTrip(t *testing.T) {
+	for _, text := range []string{"42", "-7", "1.5", "0.1", "1e+21", "true", "false", "007", "1.50", " 42 ", "1e3", "blue"} {
+		value := custom_field_parse(text)
+		for _, dataType := range []string{"text", "character varying"} {
+			if got := custom_field_value(value, dataType); got != text {
+				t.Errorf("%q as %s: got %#v", text, dataType, got)
+			}
+		}
+		if got := custom_field_value(value, "bytea"); string(got.([]byte)) != text {
+			t.Errorf("%q as bytea: got %q", text, got)
+		}
+	}
+}
+
+func TestCustomFieldType(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		want  interface{}
+	}{
+		{nil, nil},
+		{int64(1), customFieldInt},
+		{1.5, customFieldFloat},
+		{true, customFieldBool},
+		{"1.50", customFieldString},
+	}
+	for _, test := range tests {
+		if got := custom_field_type(test.value); got != test.want {
+			t.Errorf("custom_field_type(%#v) = %#v, want %#v", test.value, got, test.want)
+		}
+	}
+}
+
+// TestCustomFieldsFixture copies custom fields of every type from a sqlite
+// source, as stash stores them, into destination value columns of each
+// supported type.
+func TestCustomFieldsFixture(t *testing.T) {
+	source := open_test_source(t,
+		"CREATE TABLE performer_custom_fields (performer_id INTEGER NOT NULL, field VARCHAR(64) NOT NULL, value BLOB)",
+		"INSERT INTO performer_custom_fields VALUES (1, 'cleared', NULL), (1, 'height', 180), (1, 'rating', 4.5), "+
+			"(1, 'eyes', 'blue'), (1, 'active', 'true'), (1, 'zip', '007'), (1, 'typed', CAST('12' AS BLOB))",
+	)
+	tests := []struct {
+		dataType string
+		// want are the values inserted by field, and types their type.
+		want  map[string]interface{}
+		types map[string]interface{}
+	}{
+		{
+			"jsonb",
+			map[string]interface{}{"cleared": nil, "height": "180", "rating": "4.5", "eyes": `"blue"`, "active": "true", "zip": `"007"`, "typed": "12"},
+			map[string]interface{}{"cleared": nil, "height": "int", "rating": "float", "eyes": "string", "active": "bool", "zip": "string", "typed": "int"},
+		},
+		{
+			"text",
+			map[string]interface{}{"cleared": nil, "height": "180", "rating": "4.5", "eyes": "blue", "active": "true", "zip": "007", "typed": "12"},
+			map[string]interface{}{"cleared": nil, "height": "int", "rating": "float", "eyes": "string", "active": "bool", "zip": "string", "typed": "int"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.dataType, func(t *testing.T) {
+			fake, dest := new_fake_dest(t)
+			fake.columns["performer_custom_fields"] = []columnInfo{
+				{name: "performer_id", dataType: "integer"},
+				{name: "field", dataType: "character varying", maxLength: 64},
+				{name: "value", dataType: test.dataType, nullable: true},
+				{name: "type", dataType: "character varying", nullable: true},
+			}
+			opts := DefaultOptions()
+			opts.SourceDB = source
+			opts.DestDB = dest
+			m := &migration{sourceDB: source, destDB: dest, opts: opts, rep: new_report(opts), tables: []string{"performer_custom_fields"}}
+
+			if err := m.copy_table(context.Background(), 0, "performer_custom_fields"); err != nil {
+				t.Fatal(err)
+			}
+			want := `INSERT INTO "performer_custom_fields" ("field", "performer_id", "type", "value") VALUES `
+			var args []driver.NamedValue
+			for i, s := range fake.statements {
+				if strings.HasPrefix(s, want) {
+					args = append(args, fake.args[i]...)
+				}
+			}
+			if len(args) != 4*len(test.want) {
+				t.Fatalf("inserted %d values, want %d: %v", len(args), 4*len(test.want), fake.statements)
+			}
+			for i := 0; i < len(args); i += 4 {
+				field := args[i].Value.(string)
+				value := args[i+3].Value
+				if b, ok := value.([]byte); ok {
+					value = string(b)
+				}
+				if value != test.want[field] || args[i+2].Value != test.types[field] {
+					t.Errorf("%s: inserted %#v of type %#v, want %#v of type %#v", field, value, args[i+2].Value, test.want[field], test.types[field])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package migrate
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+)
+
+// Old stash versions didn't enforce every uniqueness rule the destination
+// schema has, like unique tag names, so a source can hold rows that collide.
+// A deduper drops every row after the first with the same values for one of
+// the destination's unique keys. Rows are fetched in rowid order, so the
+// first is usually the one with the lowest id.
+type deduper struct {
+	keys []uniqueKey
+	// seen maps a hash of the key values of every kept row, per key, to
+	// the row's identity. Tables like files_fingerprints have millions of
+	// rows, so the values themselves aren't kept.
+	seen []map[keyHash]string
+	// collapse is set when the keys cover whole rows, so that duplicates
+	// are dropped without losing anything and aren't rejects. The
+	// identities aren't kept then either.
+	collapse bool
+}
+
+// keyHash is the 128-bit FNV hash of a row's values for a key, long enough
+// that distinct values don't collide.
+type keyHash [16]byte
+
+func key_hash(values string) keyHash {
+	var h keyHash
+	f := fnv.New128a()
+	f.Write([]byte(values))
+	f.Sum(h[:0])
+	return h
+}
+
+// collapsed_tables are deduplicated on every run, as old stash versions and
+// plugins could write the same row twice, and a destination unique key
+// covers the whole row. Other tables with duplicates need -dedupe.
+var collapsed_tables = map[string]uniqueKey{
+	"files_fingerprints": {name: "files_fingerprints_pkey", columns: []string{"file_id", "type", "fingerprint"}},
+	"scenes_o_dates":     {name: "scenes_o_dates_unique", columns: []string{"scene_id", "o_date"}},
+	"scenes_view_dates":  {name: "scenes_view_dates_unique", columns: []string{"scene_id", "view_date"}},
+}
+
+func new_deduper(keys []uniqueKey) *deduper {
+	d := &deduper{keys: keys, seen: make([]map[keyHash]string, len(keys))}
+	for i := range d.seen {
+		d.seen[i] = map[keyHash]string{}
+	}
+	return d
+}
+
+// duplicate returns the key row collides on and the identity of the row it
+// collides with, or false when it's the first of its kind. NULLs never
+// collide, as in postgres.
+func (d *deduper) duplicate(row map[string]interface{}) (uniqueKey, string, bool) {
+	hashes := make([]*keyHash, len(d.keys))
+	for i, key := range d.keys {
+		nulls := false
+		parts := make([]string, len(key.columns))
+		for j, column := range key.columns {
+			if row[column] == nil {
+				nulls = true
+				break
+			}
+			parts[j] = canonical_value(row[column])
+		}
+		if nulls {
+			continue
+		}
+		h := key_hash(strings.Join(parts, "\x00"))
+		if first, ok := d.seen[i][h]; ok {
+			return key, first, true
+		}
+		hashes[i] = &h
+	}
+
+	var ident string
+	if !d.collapse {
+		ident = row_ident(row)
+	}
+	for i, h := range hashes {
+		if h != nil {
+			d.seen[i][*h] = ident
+		}
+	}
+	return uniqueKey{}, "", false
+}
+
+// dedupe_rows drops the rows of a batch that duplicate an earlier row,
+// recording each with the row it duplicates so that they can be merged by
+// hand. Returns the rows that are kept.
+func dedupe_rows(table string, d *deduper, rows []map[string]interface{}, opts Options, stats *tableStats) []map[string]interface{} {
+	log := opts.logger()
+	kept := rows[:0]
+	for _, row := range rows {
+		key, first, dup := d.duplicate(row)
+		if !dup {
+			kept = append(kept, row)
+			continue
+		}
+
+		stats.duplicates++
+		if d.collapse {
+			stats.collapsed = true
+			log.Debugf("%s (%s): dropped, exact duplicate", table, row_ident(row))
+			continue
+		}
+		stats.skipped++
+
+		values := make([]string, len(key.columns))
+		for i, column := range key.columns {
+			values[i] = fmt.Sprintf("%s=%v", column, row[column])
+		}
+		reason := fmt.Sprintf("duplicate of %s on %s (%s)", first, key.name, strings.Join(values, ", "))
+		log.Warnf("%s (%s): dropped, %s", table, row_ident(row), reason)
+		opts.rejects.add(rejectEntry{Table: table, Row: row_ident(row), Reason: reason})
+	}
+	return kept
+}
@@ -0,0 +1,64 @@
+package migrate
+
+import "testing"
+
+func fingerprint(fileID int64, fingerprint string) map[string]interface{} {
+	return map[string]interface{}{"file_id": fileID, "type": "oshash", "fingerprint": fingerprint}
+}
+
+func TestCollapseAcrossBatches(t *testing.T) {
+	rep := &Report{}
+	stats := rep.table("files_fingerprints")
+	d := new_deduper([]uniqueKey{collapsed_tables["files_fingerprints"]})
+	d.collapse = true
+
+	first := dedupe_rows("files_fingerprints", d, []map[string]interface{}{
+		fingerprint(1, "aa"),
+		fingerprint(2, "bb"),
+		fingerprint(1, "aa"),
+	}, Options{}, stats)
+	if len(first) != 2 {
+		t.Errorf("first batch kept %d rows, want 2", len(first))
+	}
+	// The duplicates of the second batch are of rows of the first
+	second := dedupe_rows("files_fingerprints", d, []map[string]interface{}{
+		fingerprint(2, "bb"),
+		fingerprint(3, "aa"),
+		fingerprint(1, "aa"),
+	}, Options{}, stats)
+	if len(second) != 1 || second[0]["file_id"] != int64(3) {
+		t.Errorf("second batch kept %v, want file 3 only", second)
+	}
+
+	if stats.duplicates != 3 {
+		t.Errorf("duplicates = %d, want 3", stats.duplicates)
+	}
+	// Exact duplicates lose nothing and don't fail a dry run
+	if stats.skipped != 0 || rep.Rejected() != 0 {
+		t.Errorf("skipped = %d, rejected = %d, want none", stats.skipped, rep.Rejected())
+	}
+	if stats.not_copied() != 3 {
+		t.Errorf("not copied = %d, want 3", stats.not_copied())
+	}
+}
+
+func TestDedupeRejects(t *testing.T) {
+	rep := &Report{}
+	stats := rep.table("tags")
+	d := new_deduper([]uniqueKey{{name: "tags_name_unique", columns: []string{"name"}}})
+
+	rows := []map[string]interface{}{
+		{"id": int64(1), "name": "a"},
+		{"id": int64(2), "name": nil},
+		{"id": int64(3), "name": nil},
+		{"id": int64(4), "name": "a"},
+	}
+	kept := dedupe_rows("tags", d, rows, Options{}, stats)
+	// NULLs never collide
+	if len(kept) != 3 {
+		t.Errorf("kept %d rows, want 3", len(kept))
+	}
+	if stats.duplicates != 1 || stats.skipped != 1 || rep.Rejected() != 1 {
+		t.Errorf("duplicates = %d, skipped = %d, rejected = %d, want 1 each", stats.duplicates, stats.skipped, rep.Rejected())
+	}
+}
@@ -0,0 +1,149 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Before loading, the migration estimates how much space the tables will
+// take in postgres and compares it with what the destination volume has
+// free, so that a full disk stops the run before it starts rather than
+// hours in. The estimate is the tables' size in sqlite, indexes included,
+// times postgresOverhead; the report prints it next to the actual size for
+// tuning the factor.
+
+const (
+	diskCheckError = "error"
+	diskCheckWarn  = "warn"
+	diskCheckOff   = "off"
+)
+
+// postgresOverhead is how much larger a table and its indexes get in
+// postgres than in sqlite: 24 bytes of header and a line pointer per row,
+// fixed-width integers and alignment padding.
+const postgresOverhead = 1.5
+
+// source_table_sizes returns the bytes each table takes in sqlite with its
+// indexes, from the dbstat virtual table. Builds of sqlite without dbstat
+// return an error.
+func source_table_sizes(ctx context.Context, sourceDB *sqlx.DB) (map[string]int64, error) {
+	rows, err := sourceDB.QueryContext(ctx, "SELECT s.tbl_name, SUM(d.pgsize) FROM dbstat d JOIN sqlite_schema s ON s.name = d.name GROUP BY s.tbl_name")
+	if err != nil {
+		return nil, fmt.Errorf("dbstat: %w", err)
+	}
+	defer rows.Close()
+
+	sizes := map[string]int64{}
+	for rows.Next() {
+		var table string
+		var size int64
+		if err := rows.Scan(&table, &size); err != nil {
+			return nil, fmt.Errorf("dbstat: %w", err)
+		}
+		sizes[table] = size
+	}
+	return sizes, rows.Err()
+}
+
+// source_used_size is the part of the sqlite file in use, for when the
+// per-table sizes aren't available.
+func source_used_size(ctx context.Context, sourceDB *sqlx.DB) (int64, error) {
+	var pages, free, pageSize int64
+	for pragma, dest := range map[string]*int64{"page_count": &pages, "freelist_count": &free, "page_size": &pageSize} {
+		if err := sourceDB.GetContext(ctx, dest, "PRAGMA "+pragma); err != nil {
+			return 0, fmt.Errorf("%s: %w", pragma, err)
+		}
+	}
+	return (pages - free) * pageSize, nil
+}
+
+// estimate_dest_size estimates the bytes the tables will take in postgres.
+// Blobs written to the filesystem leave their table next to empty.
+func estimate_dest_size(ctx context.Context, sourceDB *sqlx.DB, tables []string, opts Options) (int64, error) {
+	log := logger(ctx)
+	var size int64
+	sizes, err := source_table_sizes(ctx, sourceDB)
+	if err != nil {
+		log.Debugf("No per-table sizes, estimating from the whole source: %v", err)
+		if size, err = source_used_size(ctx, sourceDB); err != nil {
+			return 0, classify(ErrSource, err)
+		}
+	}
+	for _, table := range tables {
+		if table == "blobs" && opts.BlobsDir != "" {
+			continue
+		}
+		size += sizes[table]
+	}
+	return int64(float64(size) * postgresOverhead), nil
+}
+
+// dest_data_path returns the directory holding the destination database's
+// tablespace, when the server runs on this machine and may be looked at.
+// Reading data_directory takes superuser or pg_read_all_settings.
+func dest_data_path(ctx context.Context, destDB *sqlx.DB) (string, error) {
+	var addr *string
+	if err := destDB.GetContext(ctx, &addr, "SELECT host(inet_server_addr())"); err != nil {
+		return "", fmt.Errorf("server address: %w", err)
+	}
+	// No address is a unix socket connection
+	if addr != nil {
+		if ip := net.ParseIP(*addr); ip == nil || !ip.IsLoopback() {
+			return "", fmt.Errorf("the server at %s isn't on this machine, give its data volume with -disk-path", *addr)
+		}
+	}
+
+	var path string
+	err := destDB.GetContext(ctx, &path, `SELECT COALESCE(NULLIF(pg_tablespace_location(t.oid), ''), current_setting('data_directory'))
+		FROM pg_database d JOIN pg_tablespace t ON t.oid = d.dattablespace
+		WHERE d.datname = current_database()`)
+	if err != nil {
+		return "", fmt.Errorf("data directory: %w", err)
+	}
+	return path, nil
+}
+
+// check_disk_space compares the estimated size of the migration with the
+// free space of -disk-path or the destination's tablespace, failing with
+// -disk-check error when it won't fit. It returns the estimate.
+func check_disk_space(ctx context.Context, sourceDB *sqlx.DB, destDB *sqlx.DB, tables []string, opts Options) (int64, error) {
+	log := logger(ctx)
+	estimate, err := estimate_dest_size(ctx, sourceDB, tables, opts)
+	if err != nil {
+		return 0, err
+	}
+
+	path := opts.DiskPath
+	if path == "" {
+		if path, err = dest_data_path(ctx, destDB); err != nil {
+			log.Infof("Estimated destination size %d MB, not checked against free space: %v", estimate>>20, err)
+			return estimate, nil
+		}
+	}
+	free, err := free_space(path)
+	if errors.Is(err, errors.ErrUnsupported) {
+		log.Infof("Estimated destination size %d MB, free space can't be checked on this platform", estimate>>20)
+		return estimate, nil
+	} else if err != nil {
+		if opts.DiskPath != "" {
+			return 0, classify(ErrUsage, fmt.Errorf("-disk-path: %w", err))
+		}
+		log.Infof("Estimated destination size %d MB, not checked against free space: %v", estimate>>20, err)
+		return estimate, nil
+	}
+
+	if estimate <= free {
+		log.Infof("Estimated destination size %d MB, %d MB free in %s", estimate>>20, free>>20, path)
+		return estimate, nil
+	}
+	err = fmt.Errorf("the migration needs about %d MB but %s has only %d MB free", estimate>>20, path, free>>20)
+	if opts.DiskCheck == diskCheckError && !opts.DryRun {
+		return 0, fmt.Errorf("%w, free some space or use -disk-check warn", err)
+	}
+	log.Warnf("%v", err)
+	return estimate, nil
+}
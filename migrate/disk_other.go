@@ -0,0 +1,9 @@
+//go:build !(linux || darwin || freebsd)
+
+package migrate
+
+import "errors"
+
+func free_space(path string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,283 @@
+package migrate
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+// A dump writes the migration as a SQL script for psql -f instead of
+// loading a destination, for when the postgres server can't be reached from
+// where the sqlite file is. Without the destination the column types the
+// transforms go by come from the sqlite schema, and the steps that read the
+// destination's catalog, like deduplication or pruning orphans, are not
+// available. The sequences are reset by the script itself.
+
+// sqlite_column_type guesses the postgres type stash uses for a column
+// declared as declared in its sqlite schema.
+func sqlite_column_type(declared string) string {
+	t := strings.ToUpper(declared)
+	switch {
+	case strings.Contains(t, "BOOL"):
+		return "boolean"
+	case t == "DATE":
+		return "date"
+	case strings.Contains(t, "DATETIME"), strings.Contains(t, "TIMESTAMP"):
+		return "timestamp with time zone"
+	case strings.Contains(t, "BIGINT"):
+		return "bigint"
+	case strings.Contains(t, "INT"):
+		return "integer"
+	case strings.Contains(t, "BLOB"):
+		return "bytea"
+	case strings.Contains(t, "REAL"), strings.Contains(t, "FLOA"), strings.Contains(t, "DOUB"):
+		return "double precision"
+	case strings.Contains(t, "NUMERIC"), strings.Contains(t, "DECIMAL"):
+		return "numeric"
+	case strings.Contains(t, "JSON"):
+		return "jsonb"
+	}
+	return "text"
+}
+
+// load_source_columns describes the columns of a source table as
+// load_dest_columns would, from the sqlite schema. serial is set to the
+// integer primary key column, if any.
+func load_source_columns(ctx context.Context, sourceDB *sqlx.DB, table string) (columns tableColumns, serial string, err error) {
+	rows, err := sourceDB.QueryxContext(ctx, "SELECT name, type, \"notnull\", pk FROM pragma_table_info(?)", table)
+	if err != nil {
+		return nil, "", fmt.Errorf("source columns of %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	columns = tableColumns{}
+	for rows.Next() {
+		var name, declared string
+		var notNull, pk int
+		if err := rows.Scan(&name, &declared, &notNull, &pk); err != nil {
+			return nil, "", fmt.Errorf("source columns of %s: %w", table, err)
+		}
+		columns[name] = columnInfo{name: name, dataType: sqlite_column_type(declared), nullable: notNull == 0}
+		if pk == 1 && strings.EqualFold(declared, "integer") {
+			serial = name
+		}
+	}
+	return columns, serial, rows.Err()
+}
+
+// dump_rows reads table from the source and hands emit its transformed
+// rows batch by batch, with their columns in a stable order. It returns the
+// table's integer primary key column, if any, whose sequence to reset.
+func dump_rows(ctx context.Context, sourceDB *sqlx.DB, table string, opts Options, stats *tableStats, emit func(columns []string, rows []map[string]interface{}) error) (string, error) {
+	log := logger(ctx)
+	columns, serial, err := load_source_columns(ctx, sourceDB, table)
+	if err != nil {
+		return "", err
+	}
+
+	stxn, err := sourceDB.BeginTxx(ctx, nil)
+	if err != nil {
+		return "", fmt.Errorf("source begin tx: %w", err)
+	}
+	defer stxn.Rollback()
+
+	start := time.Now()
+	stats.batchSize, stats.smallestBatch = opts.BatchSize, opts.BatchSize
+	names := new_column_set(table, nil)
+	for offset := 0; ; {
+		fetchStart := time.Now()
+		rows, err := fetch_batch(ctx, stxn, table, nil, offset, opts.BatchSize)
+		if err != nil {
+			return "", err
+		}
+		stats.fetchTime += opts.phases.fetched(fetchStart)
+		if len(rows) == 0 {
+			break
+		}
+		fetched := len(rows)
+		stats.fetched += int64(fetched)
+		stats.bytesRead += rows_bytes(rows)
+		opts.progress.add_rows(int64(fetched))
+
+		transformStart := time.Now()
+		rows, err = transform_rows(table, offset, rows, columns, opts, stats)
+		if err != nil {
+			return "", err
+		}
+		opts.anonymizer.apply(table, rows, stats)
+		opts.phases.transformed(transformStart)
+		offset += fetched
+		if len(rows) == 0 {
+			continue
+		}
+
+		// Transforms may add keys the source table has no column for, which
+		// the destination may well have
+		if _, err := names.add(rows); err != nil {
+			return "", err
+		}
+		writeStart := time.Now()
+		if err := emit(names.names, rows); err != nil {
+			return "", err
+		}
+		stats.insertTime += opts.phases.inserted(writeStart)
+		stats.inserted += int64(len(rows))
+		stats.bytesWritten += rows_bytes(rows)
+	}
+	stats.elapsed = time.Since(start)
+	log.Infof("Wrote %s (%d rows in %s, %s)", table, stats.inserted, stats.elapsed.Round(time.Millisecond), stats.throughput())
+	return serial, nil
+}
+
+// setval_statement resets the sequence of table's serial column, if it has
+// one: setval ignores the NULL of a column without.
+func setval_statement(table string, serial string) string {
+	quotedTable := pgx.Identifier{table}.Sanitize()
+	return fmt.Sprintf("SELECT setval(pg_get_serial_sequence(%s, %s), COALESCE(max(%s) + 1, 1), false) FROM %s;\n",
+		sql_literal(quotedTable), sql_literal(serial), pgx.Identifier{serial}.Sanitize(), quotedTable)
+}
+
+func quote_columns(columns []string) string {
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = pgx.Identifier{column}.Sanitize()
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// dump_table writes the INSERT statements of table, one per batch.
+func dump_table(ctx context.Context, w *bufio.Writer, sourceDB *sqlx.DB, table string, opts Options, stats *tableStats) error {
+	fmt.Fprintf(w, "\n-- %s\n", table)
+	serial, err := dump_rows(ctx, sourceDB, table, opts, stats, func(columns []string, rows []map[string]interface{}) error {
+		fmt.Fprintf(w, "INSERT INTO %s (%s) VALUES\n", pgx.Identifier{table}.Sanitize(), quote_columns(columns))
+		for i, row := range rows {
+			values := make([]string, len(columns))
+			for j, column := range columns {
+				values[j] = sql_literal(row[column])
+			}
+			sep := ","
+			if i == len(rows)-1 {
+				sep = ";"
+			}
+			fmt.Fprintf(w, "(%s)%s\n", strings.Join(values, ", "), sep)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if serial != "" {
+		w.WriteString(setval_statement(table, serial))
+	}
+	return nil
+}
+
+// dump_source opens the source of a dump and plans its tables.
+func dump_source(ctx context.Context, opts Options) (*Report, *sqlx.DB, func() error, error) {
+	log := logger(ctx)
+	rep := new_report(opts)
+	selected, err := select_tables(opts.Only, opts.Skip)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	todo, _, err := start_from(selected, opts.StartFrom)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	sourceDB, closeSource, err := open_source(opts)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := check_stash_database(ctx, sourceDB, "source"); err != nil {
+		closeSource()
+		return nil, nil, nil, err
+	}
+	if err := check_source_integrity(ctx, sourceDB, opts.DeepCheck, opts.IgnoreIntegrity); err != nil {
+		closeSource()
+		return nil, nil, nil, err
+	}
+	missing, err := missing_source_tables(ctx, sourceDB, todo)
+	if err != nil {
+		closeSource()
+		return nil, nil, nil, err
+	}
+	if len(missing) > 0 {
+		log.Infof("Source has no %s, from before stash added them, skipping", strings.Join(missing, ", "))
+	}
+	for _, table := range todo {
+		if slices.Contains(missing, table) {
+			rep.excluded = append(rep.excluded, table)
+		} else {
+			rep.planned = append(rep.planned, table)
+		}
+	}
+	if opts.StatusAddr != "" {
+		totalRows, err := count_source_rows(ctx, sourceDB, rep.planned)
+		if err != nil {
+			closeSource()
+			return nil, nil, nil, err
+		}
+		opts.progress.set_total(totalRows)
+	}
+	return rep, sourceDB, closeSource, nil
+}
+
+// dump_header starts a restore script: one transaction loaded with the
+// foreign keys off, like a migration.
+func dump_header(w *bufio.Writer, opts Options) {
+	fmt.Fprintf(w, "SET standard_conforming_strings = on;\n")
+	fmt.Fprintf(w, "BEGIN;\n")
+	fmt.Fprintf(w, "SET LOCAL session_replication_role = replica;\n")
+	if opts.Pg.Schema != "" {
+		fmt.Fprintf(w, "SET LOCAL search_path = %s;\n", pgx.Identifier{opts.Pg.Schema}.Sanitize())
+	}
+}
+
+// dump writes the migration of the source to the script at opts.Output.
+func dump(ctx context.Context, opts Options) (*Report, error) {
+	log := logger(ctx)
+	if opts.SourceLabel == "" {
+		opts.SourceLabel = default_source_label(opts.SQLite)
+	}
+	rep, sourceDB, closeSource, err := dump_source(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer closeSource()
+
+	file, err := os.Create(opts.Output)
+	if err != nil {
+		return nil, fmt.Errorf("create dump: %w", err)
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	fmt.Fprintf(w, "-- Migration of %s, generated %s. Apply with psql -f.\n", opts.SourceLabel, format_time(wall_clock()))
+	dump_header(w, opts)
+
+	for i, table := range rep.planned {
+		log.Infof("Writing %s...", table)
+		opts.progress.start_table(table, i, len(rep.planned))
+		if err := dump_table(ctx, w, sourceDB, table, opts, rep.table(table)); err != nil {
+			return rep, err
+		}
+	}
+	fmt.Fprintf(w, "\nCOMMIT;\n")
+
+	if err := w.Flush(); err != nil {
+		return rep, fmt.Errorf("write dump: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return rep, fmt.Errorf("write dump: %w", err)
+	}
+	log.Infof("Wrote the migration to %s", opts.Output)
+	return rep, nil
+}
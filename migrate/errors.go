@@ -0,0 +1,92 @@
+package migrate
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// The errors a migration returns carry one of these classes, for callers to
+// tell a server that's down from bad data: check them with errors.Is. The
+// message of a classed error is the original one.
+var (
+	// ErrUsage is a problem with the options, like an unknown table.
+	ErrUsage = errors.New("invalid options")
+	// ErrSource is a failure to open or read the sqlite database.
+	ErrSource = errors.New("source database")
+	// ErrDestConnect is a failure to connect to postgres, or losing the
+	// connection.
+	ErrDestConnect = errors.New("destination connection")
+	// ErrSchema is a destination schema that doesn't match the source,
+	// usually one stash hasn't created or upgraded yet.
+	ErrSchema = errors.New("schema mismatch")
+	// ErrData is rows the destination refused, or that violate its
+	// constraints after loading.
+	ErrData = errors.New("data error")
+	// ErrVerify is a destination that doesn't match the source after the
+	// migration.
+	ErrVerify = errors.New("verification failed")
+)
+
+var error_classes = []error{ErrUsage, ErrSource, ErrDestConnect, ErrSchema, ErrData, ErrVerify}
+
+// classedError is an error with a class, keeping its message.
+type classedError struct {
+	class error
+	err   error
+}
+
+func (e *classedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classedError) Unwrap() []error {
+	return []error{e.err, e.class}
+}
+
+// classify marks err as of class, unless it already has a class.
+func classify(class error, err error) error {
+	if err == nil || has_class(err) {
+		return err
+	}
+	return &classedError{class: class, err: err}
+}
+
+func has_class(err error) bool {
+	for _, class := range error_classes {
+		if errors.Is(err, class) {
+			return true
+		}
+	}
+	return false
+}
+
+// classify_error classes an error without one by what postgres said, for
+// the errors that can come from anywhere.
+func classify_error(err error) error {
+	if err == nil || has_class(err) {
+		return err
+	}
+
+	var pgErr *pgconn.PgError
+	var connectErr *pgconn.ConnectError
+	switch {
+	case errors.As(err, &pgErr):
+		switch {
+		case pgErr.Code == "42P01", // undefined_table
+			pgErr.Code == "42703", // undefined_column
+			pgErr.Code == "3F000": // invalid_schema_name
+			return classify(ErrSchema, err)
+		case strings.HasPrefix(pgErr.Code, "22"), // data_exception
+			strings.HasPrefix(pgErr.Code, "23"): // integrity_constraint_violation
+			return classify(ErrData, err)
+		}
+	case errors.As(err, &connectErr):
+		return classify(ErrDestConnect, err)
+	}
+	if is_transient(err) {
+		return classify(ErrDestConnect, err)
+	}
+	return err
+}
@@ -0,0 +1,238 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// fakeDest stands in for the postgres destination: it keeps session
+// settings per connection the way postgres does, SET LOCAL until the end
+// of the transaction and SET until RESET, records every statement, and
+// fails the statements it is told to.
+type fakeDest struct {
+	mu sync.Mutex
+	// statements are the statements run, with BEGIN, COMMIT and ROLLBACK,
+	// and args the arguments of each.
+	statements []string
+	args       [][]driver.NamedValue
+	// failures fail the statements containing their key.
+	failures map[string]error
+	// commitErr fails every commit, which ends the transaction all the
+	// same.
+	commitErr error
+	// columns are the destination columns of each table.
+	columns map[string][]columnInfo
+	// answers answer the queries starting with their key.
+	answers map[string]*fakeRows
+	conns   []*fakeConn
+}
+
+func new_fake_dest(t *testing.T) (*fakeDest, *sqlx.DB) {
+	d := &fakeDest{failures: map[string]error{}, columns: map[string][]columnInfo{}, answers: map[string]*fakeRows{}}
+	db := sqlx.NewDb(sql.OpenDB(d), "pgx")
+	t.Cleanup(func() { db.Close() })
+	return d, db
+}
+
+func (d *fakeDest) fail(statement string, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.failures[statement] = err
+}
+
+// answer has the queries starting with prefix return values.
+func (d *fakeDest) answer(prefix string, columns []string, values ...[]driver.Value) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.answers[prefix] = &fakeRows{columns: columns, values: values}
+}
+
+func (d *fakeDest) record(statement string, args []driver.NamedValue) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.statements = append(d.statements, statement)
+	d.args = append(d.args, args)
+	for part, err := range d.failures {
+		if strings.Contains(statement, part) {
+			return err
+		}
+	}
+	return nil
+}
+
+// ran returns the statements run that start with prefix.
+func (d *fakeDest) ran(prefix string) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var ran []string
+	for _, s := range d.statements {
+		if strings.HasPrefix(s, prefix) {
+			ran = append(ran, s)
+		}
+	}
+	return ran
+}
+
+// open_transactions counts the connections in a transaction.
+func (d *fakeDest) open_transactions() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := 0
+	for _, c := range d.conns {
+		if c.inTx {
+			n++
+		}
+	}
+	return n
+}
+
+// session_settings returns the settings left on connections outside a
+// transaction, for what uses them next.
+func (d *fakeDest) session_settings() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var left []string
+	for _, c := range d.conns {
+		for name, value := range c.session {
+			left = append(left, name+" = "+value)
+		}
+	}
+	return left
+}
+
+func (d *fakeDest) Connect(context.Context) (driver.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c := &fakeConn{d: d, session: map[string]string{}, local: map[string]string{}}
+	d.conns = append(d.conns, c)
+	return c, nil
+}
+
+func (d *fakeDest) Driver() driver.Driver { return nil }
+
+type fakeConn struct {
+	d       *fakeDest
+	inTx    bool
+	session map[string]string
+	local   map[string]string
+}
+
+var set_re = regexp.MustCompile(`^SET (LOCAL )?(\w+) = '?([^']*)'?$`)
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if err := c.d.record(query, args); err != nil {
+		return nil, err
+	}
+	c.d.mu.Lock()
+	defer c.d.mu.Unlock()
+	if m := set_re.FindStringSubmatch(query); m != nil {
+		// Outside a transaction SET LOCAL only warns
+		if m[1] == "" {
+			c.session[m[2]] = m[3]
+		} else if c.inTx {
+			c.local[m[2]] = m[3]
+		}
+	} else if query == "RESET ALL" {
+		c.session = map[string]string{}
+	}
+	return driver.RowsAffected(0), nil
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if err := c.d.record(query, args); err != nil {
+		return nil, err
+	}
+	c.d.mu.Lock()
+	defer c.d.mu.Unlock()
+	for prefix, rows := range c.d.answers {
+		if strings.HasPrefix(query, prefix) {
+			return &fakeRows{columns: rows.columns, values: rows.values}, nil
+		}
+	}
+	switch {
+	case query == select_columns:
+		rows := &fakeRows{columns: []string{"column_name", "data_type", "is_nullable", "column_default", "character_maximum_length"}}
+		for _, col := range c.d.columns[args[0].Value.(string)] {
+			rows.values = append(rows.values, []driver.Value{col.name, col.dataType, col.nullable, col.defaultExpr, int64(col.maxLength)})
+		}
+		return rows, nil
+	case strings.HasPrefix(query, "SELECT current_setting("):
+		name := strings.Trim(strings.TrimPrefix(query, "SELECT current_setting("), "')")
+		value, ok := c.local[name]
+		if !ok {
+			value, ok = c.session[name]
+		}
+		if !ok {
+			value = "origin"
+		}
+		return &fakeRows{columns: []string{"current_setting"}, values: [][]driver.Value{{value}}}, nil
+	}
+	return nil, fmt.Errorf("fake destination: unexpected query %s", query)
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, fmt.Errorf("fake destination: prepare %s", query)
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *fakeConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if err := c.d.record("BEGIN", nil); err != nil {
+		return nil, err
+	}
+	c.d.mu.Lock()
+	defer c.d.mu.Unlock()
+	c.inTx = true
+	return c, nil
+}
+
+func (c *fakeConn) end() {
+	c.d.mu.Lock()
+	defer c.d.mu.Unlock()
+	c.inTx = false
+	c.local = map[string]string{}
+}
+
+func (c *fakeConn) Commit() error {
+	defer c.end()
+	if err := c.d.record("COMMIT", nil); err != nil {
+		return err
+	}
+	return c.d.commitErr
+}
+
+func (c *fakeConn) Rollback() error {
+	defer c.end()
+	return c.d.record("ROLLBACK", nil)
+}
+
+type fakeRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
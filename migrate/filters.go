@@ -0,0 +1,283 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/doug-martin/goqu/v9"
+	"github.com/jackc/pgx/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+// Row filters leave source rows out of the migration, like -where "scenes:
+// organized = 1", and with them the rows depending on them: rows of other
+// tables referencing a filtered row in a NOT NULL column are left out as
+// well, and so on down, while references in nullable columns become NULL.
+// The dependents are found before migrating by following the destination's
+// foreign keys to the ids of the filtered rows, and left out like orphans.
+
+// RowFilter decides whether a source row of table is migrated.
+type RowFilter func(table string, row map[string]interface{}) (bool, error)
+
+// parse_where reads -where: "table: condition" clauses separated by ";",
+// with conditions in sqlite's SQL.
+func parse_where(where string) (map[string]string, error) {
+	conditions := map[string]string{}
+	for _, clause := range strings.Split(where, ";") {
+		if strings.TrimSpace(clause) == "" {
+			continue
+		}
+		table, condition, ok := strings.Cut(clause, ":")
+		table, condition = strings.TrimSpace(table), strings.TrimSpace(condition)
+		if !ok || condition == "" {
+			return nil, classify(ErrUsage, fmt.Errorf("-where: expected table: condition, got %q", clause))
+		}
+		if !slices.Contains(tables, table) {
+			return nil, classify(ErrUsage, fmt.Errorf("-where: unknown table %q", table))
+		}
+		if _, ok := conditions[table]; ok {
+			return nil, classify(ErrUsage, fmt.Errorf("-where: %s given twice, combine the conditions with AND", table))
+		}
+		conditions[table] = condition
+	}
+	return conditions, nil
+}
+
+// rowFilters are the -where conditions and RowFilters of a migration.
+type rowFilters struct {
+	where map[string]string
+	funcs map[string]RowFilter
+	// filtered counts the rows each -where condition leaves out.
+	filtered map[string]int64
+}
+
+// new_row_filters returns the filters of opts on the selected tables, nil
+// when there are none.
+func new_row_filters(opts Options, selected []string) (*rowFilters, error) {
+	where, err := parse_where(opts.Where)
+	if err != nil {
+		return nil, err
+	}
+	f := &rowFilters{where: map[string]string{}, funcs: map[string]RowFilter{}, filtered: map[string]int64{}}
+	for table, condition := range where {
+		if slices.Contains(selected, table) {
+			f.where[table] = condition
+		}
+	}
+	for table, fn := range opts.Filters {
+		if slices.Contains(selected, table) {
+			f.funcs[table] = fn
+		}
+	}
+	if len(f.where) == 0 && len(f.funcs) == 0 {
+		return nil, nil
+	}
+	return f, nil
+}
+
+// tables lists the filtered tables, sorted.
+func (f *rowFilters) tables() []string {
+	var names []string
+	for table := range f.where {
+		names = append(names, table)
+	}
+	for table := range f.funcs {
+		if _, ok := f.where[table]; !ok {
+			names = append(names, table)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// condition is the fetch condition of table, nil when it has none.
+func (f *rowFilters) condition(table string) goqu.Expression {
+	if f == nil || f.where[table] == "" {
+		return nil
+	}
+	return goqu.L("(" + f.where[table] + ")")
+}
+
+// apply runs the RowFilter of table on rows, returning the rows it keeps.
+func (f *rowFilters) apply(table string, offset int, rows []map[string]interface{}, stats *tableStats) ([]map[string]interface{}, error) {
+	if f == nil || f.funcs[table] == nil {
+		return rows, nil
+	}
+
+	kept := rows[:0]
+	for i, row := range rows {
+		keep, err := f.funcs[table](table, row)
+		if err != nil {
+			return nil, fmt.Errorf("%s (%s, row %d): filter: %w", table, row_ident(row), offset+i, err)
+		}
+		if !keep {
+			stats.filtered++
+			continue
+		}
+		kept = append(kept, row)
+	}
+	return kept, nil
+}
+
+// excluded_ids returns the ids of the rows of table the filters leave out.
+// Tables without an id, which nothing can reference, only have the rows
+// their condition leaves out counted.
+func (f *rowFilters) excluded_ids(ctx context.Context, sourceDB *sqlx.DB, table string, hasID bool) (map[string]bool, error) {
+	ids := map[string]bool{}
+	quotedTable := pgx.Identifier{table}.Sanitize()
+
+	// Rows the condition doesn't select are out, NULL included
+	passing := "1"
+	if condition := f.where[table]; condition != "" {
+		excluded := fmt.Sprintf("FROM %s WHERE NOT ifnull((%s), 0)", quotedTable, condition)
+		if hasID {
+			if err := collect_ids(ctx, sourceDB, "SELECT id "+excluded, ids); err != nil {
+				return nil, err
+			}
+			f.filtered[table] = int64(len(ids))
+		} else {
+			var count int64
+			if err := sourceDB.GetContext(ctx, &count, "SELECT count(*) "+excluded); err != nil {
+				return nil, fmt.Errorf("source %s: %w", table, err)
+			}
+			f.filtered[table] = count
+		}
+		passing = fmt.Sprintf("ifnull((%s), 0)", condition)
+	}
+
+	fn := f.funcs[table]
+	if fn == nil || !hasID {
+		return ids, nil
+	}
+	query := fmt.Sprintf("SELECT * FROM %s WHERE %s", quotedTable, passing)
+	rows, err := sourceDB.QueryxContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("query `%s`: %w", query, err)
+	}
+	defer rows.Close()
+	scanner, err := new_row_scanner(rows)
+	if err != nil {
+		return nil, fmt.Errorf("source %s: %w", table, err)
+	}
+	for rows.Next() {
+		row, err := scanner.scan(rows)
+		if err != nil {
+			return nil, fmt.Errorf("source %s: %w", table, err)
+		}
+		keep, err := fn(table, row)
+		if err != nil {
+			return nil, fmt.Errorf("%s (%s): filter: %w", table, row_ident(row), err)
+		}
+		if !keep {
+			ids[canonical_value(row["id"])] = true
+		}
+	}
+	return ids, rows.Err()
+}
+
+// collect_ids adds the values of the single column query returns to ids.
+func collect_ids(ctx context.Context, sourceDB *sqlx.DB, query string, ids map[string]bool) error {
+	rows, err := sourceDB.QueryxContext(ctx, query)
+	if err != nil {
+		return fmt.Errorf("query `%s`: %w", query, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id interface{}
+		if err := rows.Scan(&id); err != nil {
+			return fmt.Errorf("source: %w", err)
+		}
+		ids[canonical_value(id)] = true
+	}
+	return rows.Err()
+}
+
+// find_filtered follows the destination's foreign keys from the filtered
+// tables, returning the references to the rows left out, to be pruned like
+// orphans.
+func find_filtered(ctx context.Context, sourceDB *sqlx.DB, destDB *sqlx.DB, selected []string, f *rowFilters) (orphans, error) {
+	log := logger(ctx)
+	fks, err := load_foreign_keys(ctx, destDB)
+	if err != nil {
+		return nil, err
+	}
+
+	columns := map[string]tableColumns{}
+	excluded := map[string]map[string]bool{}
+	queue := f.tables()
+	for _, table := range queue {
+		if columns[table], err = load_dest_columns(ctx, destDB, table); err != nil {
+			return nil, err
+		}
+		_, hasID := columns[table]["id"]
+		ids, err := f.excluded_ids(ctx, sourceDB, table, hasID)
+		if err != nil {
+			return nil, err
+		}
+		excluded[table] = ids
+	}
+
+	found := orphans{}
+	linked := map[string]bool{}
+	for len(queue) > 0 {
+		parent := queue[0]
+		queue = queue[1:]
+
+		for _, fk := range fks {
+			if fk.refTable != parent || len(fk.columns) != 1 || fk.refColumns[0] != "id" || !slices.Contains(selected, fk.table) {
+				continue
+			}
+			if !linked[fk.name] {
+				linked[fk.name] = true
+				found[fk.table] = append(found[fk.table], orphanRef{fk: fk, missing: excluded[parent], filtered: true})
+			}
+
+			if columns[fk.table] == nil {
+				if columns[fk.table], err = load_dest_columns(ctx, destDB, fk.table); err != nil {
+					return nil, err
+				}
+			}
+			// Nullable references are cleared, the rows stay
+			if _, ok := columns[fk.table]["id"]; !ok || columns[fk.table][fk.columns[0]].nullable {
+				continue
+			}
+
+			if excluded[fk.table] == nil {
+				excluded[fk.table] = map[string]bool{}
+			}
+			before := len(excluded[fk.table])
+			query := fmt.Sprintf("SELECT id, %s FROM %s WHERE %[1]s IS NOT NULL",
+				pgx.Identifier{fk.columns[0]}.Sanitize(), pgx.Identifier{fk.table}.Sanitize())
+			if err := collect_referencing_ids(ctx, sourceDB, query, excluded[parent], excluded[fk.table]); err != nil {
+				return nil, err
+			}
+			if len(excluded[fk.table]) > before {
+				log.Infof("%s: %d rows depend on filtered %s rows", fk.table, len(excluded[fk.table])-before, parent)
+				queue = append(queue, fk.table)
+			}
+		}
+	}
+	return found, nil
+}
+
+// collect_referencing_ids adds to ids the ids of the rows query returns, as
+// id and reference, whose reference is in refs.
+func collect_referencing_ids(ctx context.Context, sourceDB *sqlx.DB, query string, refs map[string]bool, ids map[string]bool) error {
+	rows, err := sourceDB.QueryxContext(ctx, query)
+	if err != nil {
+		return fmt.Errorf("query `%s`: %w", query, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, ref interface{}
+		if err := rows.Scan(&id, &ref); err != nil {
+			return fmt.Errorf("source: %w", err)
+		}
+		if refs[canonical_value(ref)] {
+			ids[canonical_value(id)] = true
+		}
+	}
+	return rows.Err()
+}
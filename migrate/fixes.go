@@ -0,0 +1,239 @@
+package migrate
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/doug-martin/goqu/v9"
+	"github.com/jackc/pgx/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+// Fix-up SQL turns checksum mismatches into a reviewable patch: an UPDATE
+// for every destination row that differs from its source row, with the
+// migration's transforms applied to the source row first. Rows missing on
+// either side are listed as comments only.
+
+// sql_literal formats a scanned value as a quoted postgres literal, which
+// postgres casts to the column's type.
+func sql_literal(value interface{}) string {
+	if value == nil {
+		return "NULL"
+	}
+	return "'" + strings.ReplaceAll(literal_text(value), "'", "''") + "'"
+}
+
+// literal_text formats a non-NULL scanned value as postgres' text input for
+// it.
+func literal_text(value interface{}) string {
+	var s string
+	switch v := value.(type) {
+	case bool:
+		s = strconv.FormatBool(v)
+	case int64:
+		s = strconv.FormatInt(v, 10)
+	case int32:
+		s = strconv.FormatInt(int64(v), 10)
+	case float64:
+		switch {
+		case math.IsInf(v, 1):
+			s = "Infinity"
+		case math.IsInf(v, -1):
+			s = "-Infinity"
+		default:
+			s = strconv.FormatFloat(v, 'g', -1, 64)
+		}
+	case []byte:
+		s = `\x` + fmt.Sprintf("%x", v)
+	case time.Time:
+		s = format_time(v)
+	case string:
+		s = v
+	default:
+		s = fmt.Sprintf("%v", v)
+	}
+	return s
+}
+
+// row_key identifies a row by the canonical values of its key columns.
+func row_key(key []string, row map[string]interface{}) string {
+	values := make([]string, len(key))
+	for i, column := range key {
+		values[i] = canonical_value(row[column])
+	}
+	return strings.Join(values, "\x00")
+}
+
+func key_condition(key []string, row map[string]interface{}) string {
+	conds := make([]string, len(key))
+	for i, column := range key {
+		conds[i] = pgx.Identifier{column}.Sanitize() + " = " + sql_literal(row[column])
+	}
+	return strings.Join(conds, " AND ")
+}
+
+func load_dest_rows(ctx context.Context, destDB *sqlx.DB, table string, key []string) (map[string]map[string]interface{}, error) {
+	sql, _, err := dialect.From(table).Select(goqu.Star()).ToSQL()
+	if err != nil {
+		return nil, fmt.Errorf("failed tosql: %w", err)
+	}
+	rows, err := destDB.QueryxContext(ctx, sql)
+	if err != nil {
+		return nil, fmt.Errorf("query `%s`: %w", sql, err)
+	}
+	defer rows.Close()
+
+	scanner, err := new_row_scanner(rows)
+	if err != nil {
+		return nil, fmt.Errorf("columns: %w", err)
+	}
+	byKey := map[string]map[string]interface{}{}
+	for rows.Next() {
+		row, err := scanner.scan(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed mapscan: %w", err)
+		}
+		byKey[row_key(key, row)] = row
+	}
+	return byKey, rows.Err()
+}
+
+// table_fixes writes the fix-up statements for one table and returns how
+// many rows need an UPDATE.
+func (m *migration) table_fixes(ctx context.Context, w *bufio.Writer, table string) (int, error) {
+	fmt.Fprintf(w, "\n-- %s\n", table)
+	if table == "blobs" && m.opts.BlobsDir != "" {
+		fmt.Fprintf(w, "-- skipped, blob contents were written to %s\n", m.opts.BlobsDir)
+		return 0, nil
+	}
+
+	key, err := load_conflict_key(ctx, m.destDB, table)
+	if err != nil {
+		return 0, err
+	}
+	if key == nil {
+		fmt.Fprintf(w, "-- skipped, the table has no primary key or unique index to update by\n")
+		return 0, nil
+	}
+	columns, err := load_dest_columns(ctx, m.destDB, table)
+	if err != nil {
+		return 0, err
+	}
+	dest, err := load_dest_rows(ctx, m.destDB, table, key)
+	if err != nil {
+		return 0, err
+	}
+
+	stxn, err := m.sourceDB.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("source begin tx: %w", err)
+	}
+	defer stxn.Rollback()
+
+	// Transforms count and log as during the migration, which is not wanted
+	// a second time
+	opts := m.opts
+	opts.rejects = nil
+	var scratch tableStats
+
+	updates := 0
+	quotedTable := pgx.Identifier{table}.Sanitize()
+	for offset := 0; ; offset += m.opts.BatchSize {
+		rows, err := fetch_batch(ctx, stxn, table, nil, offset, m.opts.BatchSize)
+		if err != nil {
+			return 0, err
+		}
+		if len(rows) == 0 {
+			break
+		}
+		rows, err = transform_rows(table, offset, rows, columns, opts, &scratch)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, row := range rows {
+			k := row_key(key, row)
+			destRow, ok := dest[k]
+			if !ok {
+				fmt.Fprintf(w, "-- missing in destination: %s\n", key_condition(key, row))
+				continue
+			}
+			delete(dest, k)
+
+			var set []string
+			for column, value := range row {
+				if _, ok := columns[column]; !ok {
+					continue
+				}
+				// Whatever the default gave is right
+				if _, ok := value.(destDefault); ok {
+					continue
+				}
+				if canonical_value(value) != canonical_value(destRow[column]) {
+					set = append(set, pgx.Identifier{column}.Sanitize()+" = "+sql_literal(value))
+				}
+			}
+			if len(set) == 0 {
+				continue
+			}
+			sort.Strings(set)
+			fmt.Fprintf(w, "UPDATE %s SET %s WHERE %s;\n", quotedTable, strings.Join(set, ", "), key_condition(key, row))
+			updates++
+		}
+	}
+
+	extra := make([]string, 0, len(dest))
+	for _, row := range dest {
+		extra = append(extra, key_condition(key, row))
+	}
+	sort.Strings(extra)
+	for _, cond := range extra {
+		fmt.Fprintf(w, "-- not in source: %s\n", cond)
+	}
+	return updates, nil
+}
+
+// write_fixes writes fix-up SQL for the given tables to path, as a single
+// transaction to review and then apply with psql.
+func (m *migration) write_fixes(ctx context.Context, path string, tables []string) error {
+	log := logger(ctx)
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("create fixes: %w", err)
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	fmt.Fprintf(w, "-- Fix-up statements for rows whose destination values differ from the\n")
+	fmt.Fprintf(w, "-- migrated source values, generated %s. Review before applying.\n", format_time(wall_clock()))
+	fmt.Fprintf(w, "BEGIN;\n")
+	if m.opts.Pg.Schema != "" {
+		fmt.Fprintf(w, "SET LOCAL search_path = %s;\n", pgx.Identifier{m.opts.Pg.Schema}.Sanitize())
+	}
+
+	total := 0
+	for _, table := range tables {
+		updates, err := m.table_fixes(ctx, w, table)
+		if err != nil {
+			return err
+		}
+		total += updates
+	}
+	fmt.Fprintf(w, "\nCOMMIT;\n")
+
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("write fixes: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("write fixes: %w", err)
+	}
+	log.Infof("Wrote %d fix-up statements for %s to %s", total, strings.Join(tables, ", "), path)
+	return nil
+}
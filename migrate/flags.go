@@ -0,0 +1,172 @@
+package migrate
+
+import (
+	"flag"
+	"slices"
+	"time"
+)
+
+// setting declares a command line flag once, together with the options field
+// it sets. The flag set and the keys accepted in config files are both
+// generated from settings, and TestSettings makes sure the two can't drift
+// apart from the options struct.
+type setting struct {
+	name  string
+	field string // dotted path into options, e.g. "Pg.Port"
+	usage string
+	// aliases are further flag names for the same setting.
+	aliases []string
+	// path is set for file and directory settings, which are resolved
+	// against the config file's directory when they come from one.
+	path bool
+
+	def  interface{}
+	bind func(fs *flag.FlagSet, o *Options, name string, usage string)
+	// ptr returns the address of the field bind writes to, for
+	// TestSettings.
+	ptr func(o *Options) interface{}
+}
+
+// option builds a setting of type T stored at *ptr(o).
+func option[T bool | int | string | time.Duration](name string, field string, def T, usage string, ptr func(o *Options) *T) setting {
+	return setting{
+		name:  name,
+		field: field,
+		usage: usage,
+		def:   def,
+		bind: func(fs *flag.FlagSet, o *Options, name string, usage string) {
+			switch p := any(ptr(o)).(type) {
+			case *bool:
+				fs.BoolVar(p, name, any(def).(bool), usage)
+			case *int:
+				fs.IntVar(p, name, any(def).(int), usage)
+			case *string:
+				fs.StringVar(p, name, any(def).(string), usage)
+			case *time.Duration:
+				fs.DurationVar(p, name, any(def).(time.Duration), usage)
+			}
+		},
+		ptr: func(o *Options) interface{} { return ptr(o) },
+	}
+}
+
+func path_option(name string, field string, def string, usage string, ptr func(o *Options) *string) setting {
+	s := option(name, field, def, usage, ptr)
+	s.path = true
+	return s
+}
+
+func (s setting) alias(names ...string) setting {
+	s.aliases = append(s.aliases, names...)
+	return s
+}
+
+var settings = []setting{
+	path_option("log-file", "LogFile", "", "also write the full (verbose) log with timestamps to this file", func(o *Options) *string { return &o.LogFile }),
+	option("verbose", "Verbose", false, "show debug messages on the terminal", func(o *Options) *bool { return &o.Verbose }),
+	option("pprof", "Pprof", "", "serve net/http/pprof on this address, like localhost:6060", func(o *Options) *string { return &o.Pprof }),
+	option("stats-interval", "StatsInterval", time.Duration(0), "log the heap, goroutines and time spent on source, transforms and destination this often (0 for never)", func(o *Options) *time.Duration { return &o.StatsInterval }),
+	option("status-addr", "StatusAddr", "", "serve the progress of the migration as JSON at /status on this address, like :8080", func(o *Options) *string { return &o.StatusAddr }),
+	option("preset", "Preset", "", "start from a bundle of settings: safe (verify everything) or fast", func(o *Options) *string { return &o.Preset }),
+	path_option("config", "ConfigFile", "", "read settings from a file of flag-name = value lines", func(o *Options) *string { return &o.ConfigFile }),
+	option("provenance", "Provenance", false, "record the source of every migrated row in "+provenance_table, func(o *Options) *bool { return &o.Provenance }),
+	option("source-label", "SourceLabel", "", "label recorded as the row source (default: source file name)", func(o *Options) *string { return &o.SourceLabel }),
+	option("dry-run", "DryRun", false, "fetch and transform everything but write nothing to postgres", func(o *Options) *bool { return &o.DryRun }),
+	option("oversize", "Oversize", oversizeFail, "what to do with values above postgres' 1GB field limit: fail, skip or truncate", func(o *Options) *string { return &o.Oversize }),
+	option("warn-value-mb", "WarnValueMB", 64, "warn about individual values larger than this many megabytes", func(o *Options) *int { return &o.WarnValueMB }),
+	option("invalid-utf8", "InvalidUTF8", utf8Replace, "how to repair text that isn't valid UTF-8: replace (bad bytes with U+FFFD) or latin1 (decode it as latin-1)", func(o *Options) *string { return &o.InvalidUTF8 }),
+	option("non-finite", "NonFinite", nonFiniteNull, "what to store for NaN and infinite numbers: null or zero (NOT NULL columns always get zero)", func(o *Options) *string { return &o.NonFinite }),
+	option("int-overflow", "IntOverflow", intOverflowClamp, "what to do with integers too large for their destination column: clamp or null (NOT NULL columns are always clamped)", func(o *Options) *string { return &o.IntOverflow }),
+	path_option("reject-file", "RejectFile", "", "append a JSON line for every skipped row to this file", func(o *Options) *string { return &o.RejectFile }),
+	path_option("report-json", "ReportJSON", "", "write the report of the run, with its resource usage, as JSON to this file", func(o *Options) *string { return &o.ReportJSON }),
+	option("verify", "Verify", verifyCount, "post-migration verification: count or checksum", func(o *Options) *string { return &o.Verify }),
+	path_option("emit-fixes", "EmitFixes", "", "with -verify checksum, write UPDATE statements for rows that differ to this file", func(o *Options) *string { return &o.EmitFixes }),
+	option("resume", "Resume", false, "skip tables whose destination row count already matches the source", func(o *Options) *bool { return &o.Resume }),
+	option("grace-period", "GracePeriod", 5*time.Second, "how long to wait for cleanup after SIGTERM before exiting", func(o *Options) *time.Duration { return &o.GracePeriod }),
+	option("pg-host", "Pg.Host", "", "postgres host or Unix socket directory, overriding the connector; with -pg-host or -pg-db no connector is asked for", func(o *Options) *string { return &o.Pg.Host }),
+	option("pg-port", "Pg.Port", 0, "postgres port, overriding the connector", func(o *Options) *int { return &o.Pg.Port }),
+	option("pg-db", "Pg.Database", "", "postgres database, overriding the connector", func(o *Options) *string { return &o.Pg.Database }),
+	option("pg-user", "Pg.User", "", "postgres user, overriding the connector; the password comes from PGPASSWORD or ~/.pgpass (PGPASSFILE)", func(o *Options) *string { return &o.Pg.User }),
+	option("pg-sslmode", "Pg.SSLMode", "", "postgres sslmode, overriding the connector", func(o *Options) *string { return &o.Pg.SSLMode }),
+	path_option("pg-sslcert", "Pg.SSLCert", "", "client certificate for postgres TLS", func(o *Options) *string { return &o.Pg.SSLCert }),
+	path_option("pg-sslkey", "Pg.SSLKey", "", "client certificate key for postgres TLS", func(o *Options) *string { return &o.Pg.SSLKey }),
+	path_option("pg-sslrootcert", "Pg.SSLRootCert", "", "CA certificate to verify the postgres server with", func(o *Options) *string { return &o.Pg.SSLRootCert }),
+	option("pg-schema", "Pg.Schema", "", "schema holding stash's tables, if not public", func(o *Options) *string { return &o.Pg.Schema }),
+	option("pgbouncer", "Pg.PgBouncer", false, "the connector goes through PgBouncer in transaction pooling mode: use no prepared statements or session state (on by itself for port 6432); with -pg-schema, add search_path to PgBouncer's track_extra_parameters", func(o *Options) *bool { return &o.Pg.PgBouncer }),
+	option("create-db", "CreateDB", false, "create the destination database if it doesn't exist, connecting to the postgres database", func(o *Options) *bool { return &o.CreateDB }),
+	option("create-db-owner", "CreateDBOwner", "", "with -create-db, the owner of the new database", func(o *Options) *string { return &o.CreateDBOwner }),
+	option("create-db-encoding", "CreateDBEncoding", "UTF8", "with -create-db, the encoding of the new database", func(o *Options) *string { return &o.CreateDBEncoding }),
+	option("create-db-locale", "CreateDBLocale", "", "with -create-db, the collation and character type locale of the new database", func(o *Options) *string { return &o.CreateDBLocale }),
+	option("retries", "Retries", 3, "how often to retry a batch or table after a transient postgres error", func(o *Options) *int { return &o.Retries }),
+	option("retry-backoff", "RetryBackoff", time.Second, "wait before the first retry, doubled for every further one", func(o *Options) *time.Duration { return &o.RetryBackoff }),
+	option("batch-size", "BatchSize", 1000, "largest number of rows inserted per statement", func(o *Options) *int { return &o.BatchSize }),
+	option("batch-timeout", "BatchTimeout", time.Minute, "time a batch may take before it is split and later batches made smaller (0 for fixed batches)", func(o *Options) *time.Duration { return &o.BatchTimeout }),
+	option("statement-timeout", "StatementTimeout", time.Duration(0), "fail when fetching or inserting a batch takes longer than this, naming the batch (0 for no limit)", func(o *Options) *time.Duration { return &o.StatementTimeout }),
+	option("timeout", "Timeout", time.Duration(0), "fail when the whole run takes longer than this (0 for no limit)", func(o *Options) *time.Duration { return &o.Timeout }),
+	option("max-conns", "MaxConns", 0, "most open connections to each database (0 for no limit)", func(o *Options) *int { return &o.MaxConns }),
+	option("max-idle-conns", "MaxIdleConns", 2, "most idle connections kept open to each database", func(o *Options) *int { return &o.MaxIdleConns }),
+	path_option("blobs-to-filesystem", "BlobsDir", "", "write blob contents to this stash blobs directory instead of the database", func(o *Options) *string { return &o.BlobsDir }).alias("blobs-to-dir"),
+	option("blob-fsync", "BlobFsync", fsyncFile, "when to fsync blob files: file, dir (directories at the end) or none", func(o *Options) *string { return &o.BlobFsync }),
+	option("blob-workers", "BlobWorkers", 4, "number of concurrent blob file writers", func(o *Options) *int { return &o.BlobWorkers }),
+	option("continue-on-error", "ContinueOnError", false, "skip rows that fail to insert and report them at the end instead of aborting", func(o *Options) *bool { return &o.ContinueOnError }),
+	option("max-errors", "MaxErrors", 100, "with -continue-on-error, abort once this many rows failed (0 for no limit)", func(o *Options) *int { return &o.MaxErrors }),
+	path_option("generated-dir", "GeneratedDir", "", "stash generated directory to check for content of files that no longer exist", func(o *Options) *string { return &o.GeneratedDir }),
+	path_option("generated-cleanup-list", "GeneratedList", "generated-cleanup.txt", "where to write the paths of orphaned generated files", func(o *Options) *string { return &o.GeneratedList }),
+	option("force", "Force", false, "migrate even if destination tables already contain data, or the source looks in use by a running stash", func(o *Options) *bool { return &o.Force }),
+	option("on-conflict", "OnConflict", onConflictError, "what to do with rows whose key already exists in the destination: error, skip or update", func(o *Options) *string { return &o.OnConflict }),
+	option("dedupe", "Dedupe", false, "drop rows that duplicate an earlier row on a destination unique key, keeping the first", func(o *Options) *bool { return &o.Dedupe }),
+	option("case-duplicates", "CaseDuplicates", "", "what to do with tag, performer and studio names differing only in case: merge (into the lowest id) or rename", func(o *Options) *string { return &o.CaseDuplicates }),
+	option("anonymize", "Anonymize", false, "replace titles, paths, URLs, names and descriptions with pseudonyms and empty the blobs, for sharing a copy of the database", func(o *Options) *bool { return &o.Anonymize }),
+	option("caption-language", "CaptionLanguage", captionLanguageUnknown, "language code for video captions whose stored language isn't recognized", func(o *Options) *string { return &o.CaptionLanguage }),
+	option("path-style", "PathStyle", "", "rewrite folder paths with unix or windows separators and no trailing one, merging folders that become the same", func(o *Options) *string { return &o.PathStyle }),
+	option("deep-check", "DeepCheck", false, "check the source with the full, slower, PRAGMA integrity_check instead of quick_check", func(o *Options) *bool { return &o.DeepCheck }),
+	option("ignore-integrity", "IgnoreIntegrity", false, "migrate even if the source fails its integrity check", func(o *Options) *bool { return &o.IgnoreIntegrity }),
+	option("prune-orphans", "PruneOrphans", false, "leave out references to rows missing in the source: NULL where allowed, otherwise drop the row", func(o *Options) *bool { return &o.PruneOrphans }),
+	option("fk-violations", "FKViolations", fkViolationsError, "what foreign key violations found after loading do: error (fail the migration) or warn", func(o *Options) *string { return &o.FKViolations }),
+	option("validate-constraints", "ValidateConstraints", false, "after loading, have postgres validate the constraints created NOT VALID", func(o *Options) *bool { return &o.ValidateConstraints }),
+	option("disk-check", "DiskCheck", diskCheckError, "what an estimated destination size larger than its free space does: error (don't start), warn or off", func(o *Options) *string { return &o.DiskCheck }),
+	path_option("disk-path", "DiskPath", "", "a directory on the postgres data volume to check the free space of, when the server is on another machine but the volume is mounted here", func(o *Options) *string { return &o.DiskPath }),
+	path_option("output", "Output", "", "write the migration as a SQL script for psql -f to this file instead of connecting to postgres", func(o *Options) *string { return &o.Output }),
+	path_option("output-dir", "OutputDir", "", "write the migration to this directory as COPY files and a restore.sql for psql instead of connecting to postgres", func(o *Options) *string { return &o.OutputDir }),
+	option("reverse", "Reverse", false, "copy the postgres database back into a sqlite database created by stash, to go back to sqlite", func(o *Options) *bool { return &o.Reverse }),
+	option("fix-sequences", "FixSequences", false, "only reset the sequences of an already migrated destination, without the sqlite source", func(o *Options) *bool { return &o.FixSequences }),
+	option("no-analyze", "NoAnalyze", false, "don't ANALYZE the migrated tables afterwards", func(o *Options) *bool { return &o.NoAnalyze }),
+	option("rebuild-indexes", "RebuildIndexes", false, "drop the secondary indexes of each table while loading it and create them again afterwards", func(o *Options) *bool { return &o.RebuildIndexes }),
+	option("fast", "Fast", false, "load with synchronous_commit off and more memory for index builds, where the server allows it", func(o *Options) *bool { return &o.Fast }),
+	option("grant-to", "GrantTo", "", "after migrating, grant the role stash connects as access to the tables and sequences", func(o *Options) *string { return &o.GrantTo }),
+	option("set-schema-version", "SetSchemaVersion", false, "after migrating, record the source's stash schema version in the destination, only right if its tables were created at that version", func(o *Options) *bool { return &o.SetSchemaVersion }),
+	option("only", "Only", "", "migrate only these comma separated tables (tables=a,b,c)", func(o *Options) *string { return &o.Only }),
+	option("skip", "Skip", "", "don't migrate these comma separated tables (tables=x,y)", func(o *Options) *string { return &o.Skip }),
+	option("where", "Where", "", "only migrate the rows matching a sqlite condition, and what depends on them (\"scenes: organized = 1; images: rating > 2\")", func(o *Options) *string { return &o.Where }),
+	option("skip-blobs", "SkipBlobs", false, "don't migrate the blobs table, for stashes storing blobs on the filesystem", func(o *Options) *bool { return &o.SkipBlobs }),
+	option("start-from", "StartFrom", "", "skip the tables migrated before this one, e.g. after a failed run", func(o *Options) *string { return &o.StartFrom }),
+	option("since", "Since", "", "only copy rows changed since this time, or since the last run with \"last\"", func(o *Options) *string { return &o.Since }),
+	option("clean", "Clean", false, "truncate all destination tables before migrating", func(o *Options) *bool { return &o.Clean }),
+	option("yes", "Yes", false, "don't ask for confirmation of the migration or -clean", func(o *Options) *bool { return &o.Yes }),
+}
+
+func find_setting(name string) *setting {
+	for i := range settings {
+		if settings[i].name == name || slices.Contains(settings[i].aliases, name) {
+			return &settings[i]
+		}
+	}
+	return nil
+}
+
+// BindFlags defines a flag in fs for every setting, writing to o.
+func BindFlags(fs *flag.FlagSet, o *Options) {
+	for _, s := range settings {
+		s.bind(fs, o, s.name, s.usage)
+		for _, alias := range s.aliases {
+			s.bind(fs, o, alias, "alias for -"+s.name)
+		}
+	}
+}
+
+// DefaultOptions returns Options with every setting at its flag's default.
+func DefaultOptions() Options {
+	var o Options
+	BindFlags(flag.NewFlagSet("defaults", flag.ContinueOnError), &o)
+	return o
+}
@@ -0,0 +1,102 @@
+package migrate
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// runtime_fields are Options fields that hold connections and state set up
+// by the caller rather than user settings, so no flag maps to them.
+var runtime_fields = map[string]bool{
+	"Postgres":   true,
+	"SQLite":     true,
+	"SourceDB":   true,
+	"DestDB":     true,
+	"Logger":     true,
+	"log":        true,
+	"Transforms": true,
+	"Filters":    true,
+	"rejects":    true,
+	"phases":     true,
+	"progress":   true,
+	"stopping":   true,
+	"anonymizer": true,
+	"Confirm":    true,
+}
+
+// option_fields lists the dotted paths of the leaf fields of t, descending
+// into nested option structs like PgOptions.
+func option_fields(t reflect.Type, prefix string) []string {
+	var fields []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Type.Kind() == reflect.Struct && strings.HasSuffix(f.Type.Name(), "Options") {
+			fields = append(fields, option_fields(f.Type, prefix+f.Name+".")...)
+			continue
+		}
+		fields = append(fields, prefix+f.Name)
+	}
+	return fields
+}
+
+// field_by_path resolves a dotted field path of t, returning the field and
+// its offset from the start of t.
+func field_by_path(t reflect.Type, path string) (reflect.StructField, uintptr, bool) {
+	var offset uintptr
+	var field reflect.StructField
+	for _, name := range strings.Split(path, ".") {
+		if t.Kind() != reflect.Struct {
+			return field, 0, false
+		}
+		f, ok := t.FieldByName(name)
+		if !ok {
+			return field, 0, false
+		}
+		field, offset, t = f, offset+f.Offset, f.Type
+	}
+	return field, offset, true
+}
+
+// TestSettings checks that every setting writes to the options field it
+// names, with a matching type, and that every options field other than the
+// runtime_fields is reachable from a setting.
+func TestSettings(t *testing.T) {
+	var o Options
+	base := reflect.ValueOf(&o).Pointer()
+	optionsType := reflect.TypeOf(o)
+
+	names := map[string]bool{}
+	bound := map[string]string{}
+	for _, s := range settings {
+		for _, name := range append([]string{s.name}, s.aliases...) {
+			if names[name] {
+				t.Errorf("flag %s is declared twice", name)
+			}
+			names[name] = true
+		}
+
+		field, offset, ok := field_by_path(optionsType, s.field)
+		if !ok {
+			t.Errorf("setting %s: Options has no field %s", s.name, s.field)
+			continue
+		}
+		if other, ok := bound[s.field]; ok {
+			t.Errorf("settings %s and %s both set Options.%s", other, s.name, s.field)
+		}
+		bound[s.field] = s.name
+
+		if reflect.TypeOf(s.def) != field.Type {
+			t.Errorf("setting %s: default is %T but Options.%s is %s", s.name, s.def, s.field, field.Type)
+		}
+		if reflect.ValueOf(s.ptr(&o)).Pointer()-base != offset {
+			t.Errorf("setting %s does not write to Options.%s", s.name, s.field)
+		}
+	}
+
+	for _, field := range option_fields(optionsType, "") {
+		if _, ok := bound[field]; !ok && !runtime_fields[field] {
+			t.Errorf("Options.%s cannot be set by any flag", field)
+		}
+	}
+}
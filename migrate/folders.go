@@ -0,0 +1,78 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Libraries moved between operating systems leave folders whose paths
+// differ only in separators or a trailing separator. With -path-style their
+// paths are rewritten with one kind of separator, and folders that then have
+// the same path are merged into the one with the lowest id.
+
+const (
+	pathStyleUnix    = "unix"
+	pathStyleWindows = "windows"
+)
+
+// normalize_path rewrites path with the separators of style, without a
+// trailing separator unless it is a root like / or C:\.
+func normalize_path(path string, style string) string {
+	sep, other := "/", "\\"
+	if style == pathStyleWindows {
+		sep, other = other, sep
+	}
+	path = strings.ReplaceAll(path, other, sep)
+
+	for strings.HasSuffix(path, sep) && len(path) > len(sep) {
+		trimmed := strings.TrimSuffix(path, sep)
+		if len(trimmed) == 2 && trimmed[1] == ':' {
+			break
+		}
+		path = trimmed
+	}
+	return path
+}
+
+// find_folder_duplicates records the new path of every folder whose path
+// changes, and merges folders whose paths become the same.
+func find_folder_duplicates(ctx context.Context, sourceDB *sqlx.DB, style string, merges *rowMerges) error {
+	log := logger(ctx)
+	sql := "SELECT id, path FROM folders ORDER BY id"
+	rows, err := sourceDB.QueryxContext(ctx, sql)
+	if err != nil {
+		return fmt.Errorf("query `%s`: %w", sql, err)
+	}
+	defer rows.Close()
+
+	first := map[string]int64{}
+	changed, dups := 0, 0
+	for rows.Next() {
+		var id int64
+		var path string
+		if err := rows.Scan(&id, &path); err != nil {
+			return fmt.Errorf("folders: %w", err)
+		}
+
+		normalized := normalize_path(path, style)
+		if winner, ok := first[normalized]; ok {
+			log.Warnf("folders: %q (id=%d) is the same folder as id=%d, merging", path, id, winner)
+			merges.merge("folders", id, winner)
+			dups++
+			continue
+		}
+		first[normalized] = id
+		if normalized != path {
+			merges.set("folders", id, "path", normalized)
+			changed++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	log.Infof("Normalizing folder paths: %d to rewrite, %d duplicates to merge", changed, dups)
+	return nil
+}
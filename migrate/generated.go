@@ -0,0 +1,118 @@
+package migrate
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Stash names generated content (screenshots, previews, sprites, marker
+// media, image thumbnails, transcodes) after the oshash or MD5 of the file it
+// was generated from, either as the file name prefix or as a directory name.
+// Comparing those names against the fingerprints of the migrated files finds
+// generated content nothing refers to anymore.
+
+var generated_hash = regexp.MustCompile(`^([0-9a-f]{32}|[0-9a-f]{16})([_.]|$)`)
+
+// load_file_hashes returns the oshash and MD5 fingerprints of all files.
+func load_file_hashes(ctx context.Context, db *sqlx.DB) (map[string]bool, error) {
+	rows, err := db.QueryxContext(ctx, "SELECT fingerprint FROM files_fingerprints WHERE type IN ('oshash', 'md5')")
+	if err != nil {
+		return nil, fmt.Errorf("load fingerprints: %w", err)
+	}
+	defer rows.Close()
+
+	hashes := map[string]bool{}
+	for rows.Next() {
+		var value interface{}
+		if err := rows.Scan(&value); err != nil {
+			return nil, fmt.Errorf("load fingerprints: %w", err)
+		}
+		switch v := value.(type) {
+		case string:
+			hashes[strings.ToLower(v)] = true
+		case []byte:
+			hashes[strings.ToLower(string(v))] = true
+		}
+	}
+	return hashes, rows.Err()
+}
+
+// generated_file_hash returns the hash a generated file is keyed by, or ""
+// for files that aren't keyed by one.
+func generated_file_hash(rel string) string {
+	for _, part := range strings.Split(filepath.ToSlash(rel), "/") {
+		if m := generated_hash.FindStringSubmatch(strings.ToLower(part)); m != nil {
+			return m[1]
+		}
+	}
+	return ""
+}
+
+// find_orphaned_generated lists the generated files whose hash belongs to no
+// migrated file into listPath. Nothing is ever deleted.
+func find_orphaned_generated(ctx context.Context, db *sqlx.DB, dir string, listPath string) error {
+	log := logger(ctx)
+	hashes, err := load_file_hashes(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	list, err := os.Create(listPath)
+	if err != nil {
+		return fmt.Errorf("cleanup list: %w", err)
+	}
+	defer list.Close()
+	out := bufio.NewWriter(list)
+
+	var files, orphans, orphanBytes int64
+	orphanHashes := map[string]bool{}
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		hash := generated_file_hash(rel)
+		if hash == "" {
+			return nil
+		}
+		files++
+		if hashes[hash] {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		orphans++
+		orphanBytes += info.Size()
+		orphanHashes[hash] = true
+		_, err = fmt.Fprintln(out, path)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("scan %s: %w", dir, err)
+	}
+	if err := out.Flush(); err != nil {
+		return fmt.Errorf("cleanup list: %w", err)
+	}
+
+	log.Infof("Generated content: %d files checked, %d files (%d bytes) of %d missing source files listed in %s",
+		files, orphans, orphanBytes, len(orphanHashes), listPath)
+	return nil
+}
@@ -0,0 +1,114 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+// Stash usually connects as a role of its own, not as whoever ran the
+// migration. grant_privileges gives that role what stash needs on the
+// tables and sequences the migration filled, and on anything created in
+// the schema later.
+
+// table_privileges and sequence_privileges are what stash needs on each
+// table and sequence. has_table_privilege is true when any one of a list is
+// held, so they are checked one by one.
+var (
+	table_privileges    = []string{"SELECT", "INSERT", "UPDATE", "DELETE"}
+	sequence_privileges = []string{"USAGE", "SELECT", "UPDATE"}
+)
+
+func grant_statements(schema string, role string) []string {
+	s := pgx.Identifier{schema}.Sanitize()
+	r := pgx.Identifier{role}.Sanitize()
+	t := strings.Join(table_privileges, ", ")
+	q := strings.Join(sequence_privileges, ", ")
+	return []string{
+		"GRANT USAGE ON SCHEMA " + s + " TO " + r,
+		"GRANT " + t + " ON ALL TABLES IN SCHEMA " + s + " TO " + r,
+		"GRANT " + q + " ON ALL SEQUENCES IN SCHEMA " + s + " TO " + r,
+		"ALTER DEFAULT PRIVILEGES IN SCHEMA " + s + " GRANT " + t + " ON TABLES TO " + r,
+		"ALTER DEFAULT PRIVILEGES IN SCHEMA " + s + " GRANT " + q + " ON SEQUENCES TO " + r,
+	}
+}
+
+// grant_privileges grants role access to the schema and checks it on
+// tables, the tables of the run.
+func grant_privileges(ctx context.Context, destDB *sqlx.DB, role string, tables []string) error {
+	log := logger(ctx)
+	var schema string
+	if err := destDB.GetContext(ctx, &schema, "SELECT current_schema()"); err != nil {
+		return fmt.Errorf("current schema: %w", err)
+	}
+
+	txn, err := destDB.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("dest begin tx: %w", err)
+	}
+	defer txn.Rollback()
+
+	for _, sql := range grant_statements(schema, role) {
+		log.Infof("%s", sql)
+		if _, err := txn.ExecContext(ctx, sql); err != nil {
+			return fmt.Errorf("exec `%s`: %w", sql, err)
+		}
+	}
+	if err := txn.Commit(); err != nil {
+		return fmt.Errorf("commit grants: %w", err)
+	}
+
+	return check_privileges(ctx, destDB, role, tables)
+}
+
+// check_privileges confirms that role can use tables and their sequences.
+// Tables a destination lacks can't be asked about, so only the tables of
+// the run are.
+func check_privileges(ctx context.Context, destDB *sqlx.DB, role string, tables []string) error {
+	log := logger(ctx)
+	var missing []string
+	for _, table := range tables {
+		for _, privilege := range table_privileges {
+			var ok bool
+			err := destDB.GetContext(ctx, &ok, "SELECT has_table_privilege($1, $2, $3)",
+				role, pgx.Identifier{table}.Sanitize(), privilege)
+			if err != nil {
+				return fmt.Errorf("check privileges on %s: %w", table, err)
+			}
+			if !ok {
+				missing = append(missing, fmt.Sprintf("%s on %s", privilege, table))
+			}
+		}
+	}
+
+	sequences, err := discover_sequences(ctx, destDB)
+	if err != nil {
+		return err
+	}
+	checked := 0
+	for _, s := range sequences {
+		if !slices.Contains(tables, s.table) {
+			continue
+		}
+		checked++
+		for _, privilege := range sequence_privileges {
+			var ok bool
+			if err := destDB.GetContext(ctx, &ok, "SELECT has_sequence_privilege($1, $2, $3)", role, s.sequence, privilege); err != nil {
+				return fmt.Errorf("check privileges on %s: %w", s.sequence, err)
+			}
+			if !ok {
+				missing = append(missing, fmt.Sprintf("%s on %s", privilege, s.sequence))
+			}
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("%s still lacks privileges:\n  %s", role, strings.Join(missing, "\n  "))
+	}
+	log.Infof("Granted %s access to %d tables and %d sequences", role, len(tables), checked)
+	return nil
+}
@@ -0,0 +1,45 @@
+package migrate
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"testing"
+)
+
+// TestCheckPrivilegesOfRun checks that only the tables of the run, and
+// their sequences, are asked about: a destination may lack newer tables
+// like performer_custom_fields.
+func TestCheckPrivilegesOfRun(t *testing.T) {
+	fake, dest := new_fake_dest(t)
+	fake.answer("SELECT current_schema()", []string{"current_schema"}, []driver.Value{"public"})
+	fake.answer("SELECT has_table_privilege(", []string{"has_table_privilege"}, []driver.Value{true})
+	fake.answer("SELECT has_sequence_privilege(", []string{"has_sequence_privilege"}, []driver.Value{true})
+	fake.answer(select_sequences, sequence_columns,
+		[]driver.Value{"public", "tags", "id", "public.tags_id_seq"},
+		[]driver.Value{"public", "scenes", "id", "public.scenes_id_seq"},
+	)
+
+	if err := grant_privileges(context.Background(), dest, "stash", []string{"tags"}); err != nil {
+		t.Fatal(err)
+	}
+	if grants := fake.ran("GRANT"); len(grants) != 3 || len(fake.ran("COMMIT")) != 1 {
+		t.Errorf("ran %v, want the grants committed", fake.statements)
+	}
+
+	var asked []string
+	for i, s := range fake.statements {
+		if strings.HasPrefix(s, "SELECT has_") {
+			asked = append(asked, fake.args[i][1].Value.(string))
+		}
+	}
+	want := len(table_privileges) + len(sequence_privileges)
+	if len(asked) != want {
+		t.Errorf("asked about %v, want %d privileges", asked, want)
+	}
+	for _, name := range asked {
+		if name != `"tags"` && name != "public.tags_id_seq" {
+			t.Errorf("asked about %s, which isn't of the run", name)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package migrate
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// new_sqlite creates a sqlite database in a temporary directory, runs
+// statements on it and returns its path.
+func new_sqlite(t *testing.T, statements ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "stash-go.sqlite")
+	db, err := sqlx.Open(sqlite_driver, "file:"+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// In one transaction, which sqlite syncs once
+	txn, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sql := range statements {
+		if _, err := txn.Exec(sql); err != nil {
+			t.Fatalf("%s: %v", sql, err)
+		}
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// open_test_source opens a sqlite database created by new_sqlite the way
+// the migration opens its source.
+func open_test_source(t *testing.T, statements ...string) *sqlx.DB {
+	t.Helper()
+	db, err := open_sqlite(new_sqlite(t, statements...), log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
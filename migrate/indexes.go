@@ -0,0 +1,89 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+// With -rebuild-indexes the secondary indexes of a table are dropped before
+// loading it and created again afterwards, which is much faster for large
+// tables than updating them row by row. Both happen in the table's
+// transaction, so a failed table gets its indexes back with the rollback.
+// Indexes backing a constraint, and unique indexes, which ON CONFLICT may
+// need, are kept.
+
+type indexDef struct {
+	name string
+	def  string
+}
+
+const select_secondary_indexes = `
+SELECT ix.relname, pg_get_indexdef(ix.oid)
+FROM pg_index i
+JOIN pg_class cl ON cl.oid = i.indrelid
+JOIN pg_class ix ON ix.oid = i.indexrelid
+JOIN pg_namespace ns ON ns.oid = cl.relnamespace
+WHERE ns.nspname = current_schema() AND cl.relname = $1
+	AND NOT i.indisunique AND NOT i.indisprimary
+	AND NOT EXISTS (SELECT 1 FROM pg_constraint con WHERE con.conindid = i.indexrelid)
+ORDER BY ix.relname
+`
+
+// drop_indexes drops the secondary indexes of table and returns their
+// definitions, which are also logged so that they can be recreated by hand
+// if everything else fails.
+func drop_indexes(ctx context.Context, txn *sqlx.Tx, table string) ([]indexDef, error) {
+	log := logger(ctx)
+	rows, err := txn.QueryxContext(ctx, select_secondary_indexes, table)
+	if err != nil {
+		return nil, fmt.Errorf("load indexes of %s: %w", table, err)
+	}
+	var indexes []indexDef
+	for rows.Next() {
+		var ix indexDef
+		if err := rows.Scan(&ix.name, &ix.def); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("load indexes of %s: %w", table, err)
+		}
+		indexes = append(indexes, ix)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("load indexes of %s: %w", table, err)
+	}
+
+	for _, ix := range indexes {
+		log.Infof("%s: dropping index until loaded: %s", table, ix.def)
+		sql := "DROP INDEX " + pgx.Identifier{ix.name}.Sanitize()
+		if _, err := txn.ExecContext(ctx, sql); err != nil {
+			return nil, fmt.Errorf("exec `%s`: %w", sql, err)
+		}
+	}
+	return indexes, nil
+}
+
+// recreate_indexes creates the indexes drop_indexes dropped again.
+func recreate_indexes(ctx context.Context, txn *sqlx.Tx, table string, indexes []indexDef) error {
+	log := logger(ctx)
+	if len(indexes) == 0 {
+		return nil
+	}
+
+	// The batch timeout is no measure for building an index
+	if _, err := txn.ExecContext(ctx, "SET LOCAL statement_timeout = 0"); err != nil {
+		return fmt.Errorf("exec `SET LOCAL statement_timeout = 0`: %w", err)
+	}
+
+	start := time.Now()
+	for _, ix := range indexes {
+		if _, err := txn.ExecContext(ctx, ix.def); err != nil {
+			return fmt.Errorf("%s: recreate index %s, defined as `%s`: %w", table, ix.name, ix.def, err)
+		}
+	}
+	log.Infof("%s: recreated %d indexes in %s", table, len(indexes), time.Since(start).Round(time.Millisecond))
+	return nil
+}
@@ -0,0 +1,181 @@
+package migrate
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/doug-martin/goqu/v9"
+	"github.com/doug-martin/goqu/v9/exp"
+	"github.com/jackc/pgx/v5"
+)
+
+// insertBuilder generates the multi-row INSERT statements of the batch loop.
+// goqu reflects over every row map to build its SQL, which dominates CPU on
+// narrow tables with many rows. This builder joins the column list once per
+// table, and again only when a batch brings new columns. It numbers the
+// placeholders arithmetically and reuses its buffers between batches. The
+// ON CONFLICT clause is only generated with the column list, by goqu.
+type insertBuilder struct {
+	columns *columnSet
+	prefix  string
+	suffix  string
+
+	// conflictMode and conflictKey are kept from on_conflict, for
+	// regenerating the suffix when columns are added.
+	conflictMode string
+	conflictKey  []string
+
+	sql  strings.Builder
+	args []interface{}
+}
+
+// columnSet is the column list of the statements of a table: the columns
+// of the destination that any of its rows so far has, in a stable order.
+// Transforms may set a key on some rows only, and a column on every row in
+// the statement keeps the VALUES lists aligned: rows without it get NULL.
+type columnSet struct {
+	table string
+	// dest are the destination's columns, nil when there's no destination
+	// to go by and any key is a column.
+	dest  tableColumns
+	names []string
+	known map[string]bool
+}
+
+func new_column_set(table string, dest tableColumns) *columnSet {
+	return &columnSet{table: table, dest: dest, known: map[string]bool{}}
+}
+
+// add adds the keys of rows the set doesn't have yet, reporting whether
+// there were any. A key the destination has no column for is an error.
+func (c *columnSet) add(rows []map[string]interface{}) (bool, error) {
+	added := false
+	for _, row := range rows {
+		for column := range row {
+			if c.known[column] {
+				continue
+			}
+			if _, ok := c.dest[column]; !ok && c.dest != nil {
+				return false, fmt.Errorf("%s: the destination table has no column %s", c.table, column)
+			}
+			c.known[column] = true
+			added = true
+		}
+	}
+	if !added {
+		return false, nil
+	}
+
+	// A new slice, the caller may still hold the old one
+	names := make([]string, 0, len(c.known))
+	if c.dest == nil {
+		for column := range c.known {
+			names = append(names, column)
+		}
+	} else {
+		for column := range c.dest {
+			if c.known[column] {
+				names = append(names, column)
+			}
+		}
+	}
+	sort.Strings(names)
+	c.names = names
+	return true, nil
+}
+
+// new_insert_builder prepares a builder for table, whose destination
+// columns are dest.
+func new_insert_builder(table string, dest tableColumns) *insertBuilder {
+	return &insertBuilder{columns: new_column_set(table, dest)}
+}
+
+// on_conflict makes the statements skip rows conflicting with existing
+// ones, or with update, overwrite the other columns of the row with the
+// same key. Without a key, or without other columns, every conflict is
+// skipped, as there is nothing to update by.
+func (b *insertBuilder) on_conflict(mode string, key []string) {
+	b.conflictMode, b.conflictKey = mode, key
+	b.prefix = ""
+}
+
+// conflict_clause generates the ON CONFLICT clause for the current columns
+// with goqu, as what a statement with it adds to one without.
+func (b *insertBuilder) conflict_clause() (string, error) {
+	var conflict exp.ConflictExpression = goqu.DoNothing()
+	if b.conflictMode == onConflictUpdate && len(b.conflictKey) > 0 {
+		isKey := map[string]bool{}
+		quoted := make([]string, len(b.conflictKey))
+		for i, column := range b.conflictKey {
+			quoted[i] = pgx.Identifier{column}.Sanitize()
+			isKey[column] = true
+		}
+		set := goqu.Record{}
+		for _, column := range b.columns.names {
+			if !isKey[column] {
+				set[column] = goqu.T("excluded").Col(column)
+			}
+		}
+		if len(set) > 0 {
+			conflict = goqu.DoUpdate(strings.Join(quoted, ", "), set)
+		}
+	}
+
+	insert := dialect.Insert(b.columns.table)
+	without, _, err := insert.ToSQL()
+	if err != nil {
+		return "", fmt.Errorf("%s: on conflict: %w", b.columns.table, err)
+	}
+	with, _, err := insert.OnConflict(conflict).ToSQL()
+	if err != nil {
+		return "", fmt.Errorf("%s: on conflict: %w", b.columns.table, err)
+	}
+	return strings.TrimPrefix(with, without), nil
+}
+
+// build returns the statement and its arguments for rows. Both are only
+// valid until the next call.
+func (b *insertBuilder) build(rows []map[string]interface{}) (string, []interface{}, error) {
+	added, err := b.columns.add(rows)
+	if err != nil {
+		return "", nil, err
+	}
+	if added || b.prefix == "" {
+		b.prefix = "INSERT INTO " + pgx.Identifier{b.columns.table}.Sanitize() + " (" + quote_columns(b.columns.names) + ") VALUES "
+		if b.conflictMode != "" {
+			if b.suffix, err = b.conflict_clause(); err != nil {
+				return "", nil, err
+			}
+		}
+	}
+	b.sql.Reset()
+	b.args = b.args[:0]
+
+	b.sql.WriteString(b.prefix)
+	n := 1
+	for i, row := range rows {
+		if i > 0 {
+			b.sql.WriteString(", ")
+		}
+		b.sql.WriteByte('(')
+		for j, column := range b.columns.names {
+			if j > 0 {
+				b.sql.WriteString(", ")
+			}
+			if _, ok := row[column].(destDefault); ok {
+				b.sql.WriteString("DEFAULT")
+				continue
+			}
+			b.sql.WriteByte('$')
+			b.sql.WriteString(strconv.Itoa(n))
+			n++
+			b.args = append(b.args, row[column])
+		}
+		b.sql.WriteByte(')')
+	}
+	b.sql.WriteString(b.suffix)
+
+	return b.sql.String(), b.args, nil
+}
@@ -0,0 +1,150 @@
+package migrate
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/doug-martin/goqu/v9"
+)
+
+var tags_dest = tableColumns{
+	"id":          {name: "id", dataType: "integer"},
+	"name":        {name: "name", dataType: "character varying"},
+	"description": {name: "description", dataType: "text", nullable: true},
+	"created_at":  {name: "created_at", dataType: "timestamp with time zone", defaultExpr: "now()"},
+}
+
+func TestInsertBuilderColumns(t *testing.T) {
+	b := new_insert_builder("tags", tags_dest)
+
+	// A transform set description on half the rows
+	sql, args, err := b.build([]map[string]interface{}{
+		{"id": int64(1), "name": "a", "description": "first"},
+		{"id": int64(2), "name": "b"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `INSERT INTO "tags" ("description", "id", "name") VALUES ($1, $2, $3), ($4, $5, $6)`
+	if sql != want {
+		t.Errorf("sql = %s, want %s", sql, want)
+	}
+	if !slices.Equal(args, []interface{}{"first", int64(1), "a", nil, int64(2), "b"}) {
+		t.Errorf("args = %v", args)
+	}
+
+	// A later batch brings another column
+	sql, args, err = b.build([]map[string]interface{}{
+		{"id": int64(3), "name": "c", "created_at": destDefault{}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `INSERT INTO "tags" ("created_at", "description", "id", "name") VALUES (DEFAULT, $1, $2, $3)`
+	if sql != want {
+		t.Errorf("sql = %s, want %s", sql, want)
+	}
+	if !slices.Equal(args, []interface{}{nil, int64(3), "c"}) {
+		t.Errorf("args = %v", args)
+	}
+}
+
+func TestInsertBuilderUnknownColumn(t *testing.T) {
+	b := new_insert_builder("tags", tags_dest)
+	if _, _, err := b.build([]map[string]interface{}{{"id": int64(1), "colour": "red"}}); err == nil {
+		t.Errorf("built an insert of a column the destination lacks")
+	}
+}
+
+func TestInsertBuilderOnConflict(t *testing.T) {
+	b := new_insert_builder("tags", tags_dest)
+	b.on_conflict(onConflictUpdate, []string{"id"})
+	sql, _, err := b.build([]map[string]interface{}{{"id": int64(1), "name": "a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `INSERT INTO "tags" ("id", "name") VALUES ($1, $2) ON CONFLICT ("id") DO UPDATE SET "name"="excluded"."name"`
+	if sql != want {
+		t.Errorf("sql = %s, want %s", sql, want)
+	}
+
+	// Columns added later are updated too
+	sql, _, err = b.build([]map[string]interface{}{{"id": int64(2), "name": "b", "description": "x"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `INSERT INTO "tags" ("description", "id", "name") VALUES ($1, $2, $3) ON CONFLICT ("id") DO UPDATE SET "description"="excluded"."description","name"="excluded"."name"`
+	if sql != want {
+		t.Errorf("sql = %s, want %s", sql, want)
+	}
+
+	// Skipping, or updating without a key or other columns
+	for _, test := range []struct {
+		mode string
+		key  []string
+		row  map[string]interface{}
+	}{
+		{onConflictSkip, []string{"id"}, map[string]interface{}{"id": int64(1), "name": "a"}},
+		{onConflictUpdate, nil, map[string]interface{}{"id": int64(1), "name": "a"}},
+		{onConflictUpdate, []string{"id"}, map[string]interface{}{"id": int64(1)}},
+	} {
+		b := new_insert_builder("tags", tags_dest)
+		b.on_conflict(test.mode, test.key)
+		sql, _, err := b.build([]map[string]interface{}{test.row})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(sql, ") ON CONFLICT DO NOTHING") {
+			t.Errorf("%s on %v: sql = %s, want the conflicts skipped", test.mode, test.key, sql)
+		}
+	}
+}
+
+func TestColumnSetWithoutDest(t *testing.T) {
+	c := new_column_set("tags", nil)
+	if _, err := c.add([]map[string]interface{}{{"id": 1}, {"id": 2, "extra": 3}}); err != nil {
+		t.Fatal(err)
+	}
+	first := c.names
+	if added, err := c.add([]map[string]interface{}{{"another": 1}}); err != nil || !added {
+		t.Fatalf("add = %v, %v", added, err)
+	}
+	if !slices.Equal(first, []string{"extra", "id"}) || !slices.Equal(c.names, []string{"another", "extra", "id"}) {
+		t.Errorf("names %v then %v", first, c.names)
+	}
+}
+
+// BenchmarkInsertBuilder compares the builder with goqu on batches of a
+// synthetic join table, the narrow tables with many rows where building the
+// statements costs the most.
+func BenchmarkInsertBuilder(b *testing.B) {
+	dest := tableColumns{
+		"scene_id": {name: "scene_id", dataType: "integer"},
+		"tag_id":   {name: "tag_id", dataType: "integer"},
+	}
+	rows := make([]map[string]interface{}, 1000)
+	records := make([]interface{}, len(rows))
+	for i := range rows {
+		rows[i] = map[string]interface{}{"scene_id": int64(i / 10), "tag_id": int64(i % 10)}
+		records[i] = goqu.Record(rows[i])
+	}
+
+	b.Run("builder", func(b *testing.B) {
+		insert := new_insert_builder("scenes_tags", dest)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, _, err := insert.build(rows); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("goqu", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, _, err := dialect.Insert("scenes_tags").Prepared(true).Rows(records...).ToSQL(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,134 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// walActivityWindow is how recently the -wal file must have been written to
+// for the database to count as in use.
+const walActivityWindow = 5 * time.Minute
+
+// source_in_use looks for signs that stash, or anything else, is still
+// writing to the sqlite file: a recently modified -wal file, a write lock
+// that can't be had, or another process holding it open. It returns a
+// description of each sign found.
+func source_in_use(ctx context.Context, path string) []string {
+	log := logger(ctx)
+	var signs []string
+
+	if info, err := os.Stat(path + "-wal"); err == nil && info.Size() > 0 {
+		if age := time.Since(info.ModTime()); age < walActivityWindow {
+			signs = append(signs, fmt.Sprintf("its -wal file was written %s ago", age.Round(time.Second)))
+		}
+	}
+
+	if locked, err := source_write_locked(ctx, path); err != nil {
+		log.Debugf("Could not test the source for a write lock: %v", err)
+	} else if locked {
+		signs = append(signs, "another connection holds its write lock")
+	}
+
+	for _, process := range processes_holding(path) {
+		signs = append(signs, "it is open in "+process)
+	}
+	return signs
+}
+
+// source_write_locked tries to take the write lock of the database for an
+// instant, without writing anything. A read-only file can't be tested and
+// returns an error.
+func source_write_locked(ctx context.Context, path string) (bool, error) {
+	// Not sqlite_params(.., true), that would switch the file to WAL
+	params := strings.Replace(sqlite_params(false, false), "mode=ro", "mode=rw", 1)
+	db, err := sqlx.Open(sqlite_driver, "file:"+path+"?"+params)
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "BEGIN IMMEDIATE"); err != nil {
+		if strings.Contains(err.Error(), "locked") || strings.Contains(err.Error(), "busy") {
+			return true, nil
+		}
+		return false, err
+	}
+	_, err = conn.ExecContext(ctx, "ROLLBACK")
+	return false, err
+}
+
+// processes_holding lists the other processes with path, or its -wal file,
+// open, as "name (pid n)". Only linux's /proc is looked at; elsewhere it
+// finds nothing.
+func processes_holding(path string) []string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil
+	}
+	targets := map[string]bool{abs: true, abs + "-wal": true}
+
+	pids, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+	self := os.Getpid()
+
+	var found []string
+	for _, entry := range pids {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || pid == self {
+			continue
+		}
+		fds, err := os.ReadDir(filepath.Join("/proc", entry.Name(), "fd"))
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			target, err := os.Readlink(filepath.Join("/proc", entry.Name(), "fd", fd.Name()))
+			if err != nil || !targets[target] {
+				continue
+			}
+			name := "unknown"
+			if comm, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "comm")); err == nil {
+				name = strings.TrimSpace(string(comm))
+			}
+			found = append(found, fmt.Sprintf("%s (pid %d)", name, pid))
+			break
+		}
+	}
+	return found
+}
+
+// check_source_not_in_use warns when the source looks in use, and unless
+// forced or confirmed refuses to migrate it: a scan running during the
+// migration leaves the copy inconsistent.
+func check_source_not_in_use(ctx context.Context, path string, opts Options) error {
+	log := logger(ctx)
+	signs := source_in_use(ctx, path)
+	if len(signs) == 0 {
+		return nil
+	}
+
+	log.Warnf("The source database looks in use, is stash still running? %s", strings.Join(signs, "; "))
+	log.Warnf("Changes made during the migration can leave the copy inconsistent, stop stash first")
+	if opts.Force || opts.DryRun {
+		return nil
+	}
+	if opts.Confirm != nil && opts.Confirm("Migrate it anyway?") {
+		return nil
+	}
+	return classify(ErrSource, fmt.Errorf("source database is in use, stop stash or use -force"))
+}
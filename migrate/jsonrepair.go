@@ -0,0 +1,88 @@
+package migrate
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// repair_json fixes the usual damage to a serialized document: surrounding
+// whitespace and control characters, an empty string for an empty object,
+// and documents encoded twice, as a JSON string holding the JSON. Returns
+// false if the result still isn't valid JSON.
+func repair_json(s string) (string, bool) {
+	s = strings.TrimFunc(s, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsControl(r) })
+	if s == "" {
+		return "{}", true
+	}
+
+	if !json.Valid([]byte(s)) {
+		return s, false
+	}
+	for {
+		var inner string
+		if json.Unmarshal([]byte(s), &inner) != nil {
+			return s, true
+		}
+		inner = strings.TrimSpace(inner)
+		if inner == "" {
+			return "{}", true
+		}
+		if !json.Valid([]byte(inner)) {
+			return s, true
+		}
+		s = inner
+	}
+}
+
+// repair_json_columns repairs the json_columns of table, rejecting rows
+// whose documents can't be repaired. Rejected rows are recorded with their
+// name, so that saved filters can be recreated by hand. Returns the rows
+// that are kept.
+func repair_json_columns(table string, rows []map[string]interface{}, opts Options, stats *tableStats) []map[string]interface{} {
+	log := opts.logger()
+	columns := json_columns[table]
+	if len(columns) == 0 {
+		return rows
+	}
+
+	kept := rows[:0]
+	for _, row := range rows {
+		keep := true
+		for _, column := range columns {
+			var s string
+			switch v := row[column].(type) {
+			case string:
+				s = v
+			case []byte:
+				s = string(v)
+			default:
+				continue
+			}
+
+			repaired, ok := repair_json(s)
+			if !ok {
+				reason := fmt.Sprintf("column %s is not valid JSON", column)
+				name, _ := row["name"].(string)
+				log.Errorf("%s (%s, %q): %s", table, row_ident(row), name, reason)
+				opts.rejects.add(rejectEntry{Table: table, Row: row_ident(row), Name: name, Column: column, Reason: reason})
+				keep = false
+				break
+			}
+			if repaired != s {
+				log.Warnf("%s (%s): repaired %s", table, row_ident(row), column)
+				row[column] = repaired
+				stats.modified++
+				stats.jsonRepaired++
+			}
+		}
+
+		if !keep {
+			stats.skipped++
+			continue
+		}
+		kept = append(kept, row)
+	}
+	return kept
+}
@@ -0,0 +1,119 @@
+package migrate
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// PostgreSQL rejects any single field larger than 1GB.
+const maxFieldSize = 1<<30 - 1
+
+const (
+	oversizeFail     = "fail"
+	oversizeSkip     = "skip"
+	oversizeTruncate = "truncate"
+)
+
+// json_columns hold serialized documents that become invalid when cut short,
+// so they are never truncated.
+var json_columns = map[string][]string{
+	"saved_filters": {"find_filter", "object_filter", "ui_options"},
+}
+
+func is_json_column(table string, column string) bool {
+	for _, c := range json_columns[table] {
+		if c == column {
+			return true
+		}
+	}
+	return false
+}
+
+// row_ident describes a row by its primary key (or its foreign keys for join
+// tables) so that it can be found in the source database.
+func row_ident(row map[string]interface{}) string {
+	if id, ok := row["id"]; ok {
+		return fmt.Sprintf("id=%v", id)
+	}
+
+	var keys []string
+	for column, value := range row {
+		if strings.HasSuffix(column, "_id") {
+			keys = append(keys, fmt.Sprintf("%s=%v", column, value))
+		}
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ", ")
+}
+
+func value_size(value interface{}) int {
+	switch v := value.(type) {
+	case string:
+		return len(v)
+	case []byte:
+		return len(v)
+	}
+	return 0
+}
+
+// truncate_string cuts s to at most n bytes without splitting a UTF-8 sequence.
+func truncate_string(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// check_value_sizes warns about values above the soft limit and applies the
+// oversize policy to values Postgres would refuse. Skipped rows are removed
+// from the returned slice.
+func check_value_sizes(table string, offset int, rows []map[string]interface{}, opts Options, stats *tableStats) ([]map[string]interface{}, error) {
+	log := opts.logger()
+	kept := rows[:0]
+	for idx, row := range rows {
+		skip := false
+		for column, value := range row {
+			size := value_size(value)
+			if size <= opts.WarnValueMB<<20 && size <= maxFieldSize {
+				continue
+			}
+
+			ident := row_ident(row)
+			if size <= maxFieldSize {
+				log.Warnf("%s (%s, row %d): column %s is %d bytes", table, ident, offset+idx, column, size)
+				continue
+			}
+
+			reason := fmt.Sprintf("column %s is %d bytes, above the 1GB field limit", column, size)
+			policy := opts.Oversize
+			if s, ok := value.(string); ok && policy == oversizeTruncate && !is_json_column(table, column) {
+				row[column] = truncate_string(s, maxFieldSize)
+				stats.modified++
+				log.Warnf("%s (%s): truncated %s", table, ident, reason)
+				continue
+			} else if policy == oversizeTruncate {
+				policy = oversizeSkip
+			}
+
+			if policy == oversizeSkip {
+				log.Warnf("%s (%s): skipping row, %s", table, ident, reason)
+				opts.rejects.add(rejectEntry{Table: table, Row: ident, Column: column, Reason: reason})
+				skip = true
+				break
+			}
+			return nil, fmt.Errorf("%s (%s, row %d): %s", table, ident, offset+idx, reason)
+		}
+
+		if skip {
+			stats.skipped++
+			continue
+		}
+		kept = append(kept, row)
+	}
+	return kept, nil
+}
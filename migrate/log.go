@@ -0,0 +1,163 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// wall_clock returns the current time for timestamps that are stored or
+// shown, in UTC and without the monotonic clock reading, which only matters
+// for measuring durations and otherwise shows up in formatted values.
+func wall_clock() time.Time {
+	return time.Now().Round(0).UTC()
+}
+
+// format_time is how the tool writes every timestamp it stores or reports.
+func format_time(t time.Time) string {
+	return t.Round(0).UTC().Format(time.RFC3339Nano)
+}
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelPrefix = map[logLevel]string{
+	levelDebug: "debug: ",
+	levelInfo:  "",
+	levelWarn:  "warning: ",
+	levelError: "error: ",
+}
+
+// Logger receives the messages of a migration.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// TerminalLogger writes messages to the terminal filtered by verbosity and,
+// optionally, everything to a log file with a timestamp on each line.
+type TerminalLogger struct {
+	mu       sync.Mutex
+	terminal io.Writer
+	// Verbose shows debug messages on the terminal too.
+	Verbose bool
+	file    *os.File
+}
+
+func NewTerminalLogger() *TerminalLogger {
+	return &TerminalLogger{terminal: os.Stdout}
+}
+
+// log is the default logger. Code that runs for a Migrator logs to the
+// Migrator's instead, which it finds in its context or Options and keeps in
+// a local log that shadows this one.
+var log Logger = NewTerminalLogger()
+
+type loggerKey struct{}
+
+// with_logger returns ctx carrying l for logger.
+func with_logger(ctx context.Context, l Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// logger returns the logger of the run ctx belongs to, the default one
+// outside of a run.
+func logger(ctx context.Context) Logger {
+	if l, ok := ctx.Value(loggerKey{}).(Logger); ok {
+		return l
+	}
+	return log
+}
+
+// logger is logger for code that has the run's Options but no context.
+func (o Options) logger() Logger {
+	if o.log != nil {
+		return o.log
+	}
+	return log
+}
+
+// OpenFile opens path for appending and writes a header line so that an
+// unwritable file is reported before the migration starts.
+func (l *TerminalLogger) OpenFile(path string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("open log file: %w", err)
+	}
+
+	if _, err := fmt.Fprintf(file, "%s --- log opened ---\n", format_time(wall_clock())); err != nil {
+		file.Close()
+		return fmt.Errorf("write log file: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("sync log file: %w", err)
+	}
+
+	l.file = file
+	return nil
+}
+
+func (l *TerminalLogger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+func (l *TerminalLogger) logf(level logLevel, format string, args ...interface{}) {
+	msg := levelPrefix[level] + fmt.Sprintf(format, args...)
+	if len(msg) == 0 || msg[len(msg)-1] != '\n' {
+		msg += "\n"
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if level >= levelInfo || l.Verbose {
+		out := l.terminal
+		if level >= levelWarn {
+			out = os.Stderr
+		}
+		fmt.Fprint(out, msg)
+	}
+	if l.file != nil {
+		fmt.Fprintf(l.file, "%s %s", format_time(wall_clock()), msg)
+	}
+}
+
+func (l *TerminalLogger) Debugf(format string, args ...interface{}) {
+	l.logf(levelDebug, format, args...)
+}
+func (l *TerminalLogger) Infof(format string, args ...interface{}) {
+	l.logf(levelInfo, format, args...)
+}
+func (l *TerminalLogger) Warnf(format string, args ...interface{}) {
+	l.logf(levelWarn, format, args...)
+}
+func (l *TerminalLogger) Errorf(format string, args ...interface{}) {
+	l.logf(levelError, format, args...)
+}
+
+// Fatal logs err and exits, mirroring the standard library's log.Fatal.
+func (l *TerminalLogger) Fatal(err error) {
+	l.Errorf("%v", err)
+	l.Close()
+	os.Exit(1)
+}
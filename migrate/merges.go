@@ -0,0 +1,112 @@
+package migrate
+
+import (
+	"context"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// rowMerges describes source rows that are merged into others or get new
+// values on the way to the destination, decided before migrating as the
+// tables referencing them may be copied first.
+type rowMerges struct {
+	// merged maps, per table, the ids of dropped rows to the id of the row
+	// they were merged into.
+	merged map[string]map[int64]int64
+	// values maps, per table, row ids to the column values they get.
+	values map[string]map[int64]map[string]interface{}
+	// refs are the foreign keys pointing at tables with merged rows.
+	refs []foreignKey
+	log  Logger
+}
+
+func new_row_merges(log Logger) *rowMerges {
+	return &rowMerges{merged: map[string]map[int64]int64{}, values: map[string]map[int64]map[string]interface{}{}, log: log}
+}
+
+func (m *rowMerges) merge(table string, id int64, into int64) {
+	if m.merged[table] == nil {
+		m.merged[table] = map[int64]int64{}
+	}
+	m.merged[table][id] = into
+}
+
+func (m *rowMerges) set(table string, id int64, column string, value interface{}) {
+	if m.values[table] == nil {
+		m.values[table] = map[int64]map[string]interface{}{}
+	}
+	if m.values[table][id] == nil {
+		m.values[table][id] = map[string]interface{}{}
+	}
+	m.values[table][id][column] = value
+}
+
+// load_refs finds the foreign keys whose values need to follow merges.
+func (m *rowMerges) load_refs(ctx context.Context, destDB *sqlx.DB) error {
+	if len(m.merged) == 0 {
+		return nil
+	}
+	fks, err := load_foreign_keys(ctx, destDB)
+	if err != nil {
+		return err
+	}
+	for _, fk := range fks {
+		if _, ok := m.merged[fk.refTable]; ok && len(fk.columns) == 1 {
+			m.refs = append(m.refs, fk)
+		}
+	}
+	return nil
+}
+
+// remaps reports whether rows of table reference merged rows, which can
+// make them duplicates of each other.
+func (m *rowMerges) remaps(table string) bool {
+	for _, fk := range m.refs {
+		if fk.table == table {
+			return true
+		}
+	}
+	return false
+}
+
+// apply drops the merged rows of table, sets the new values of others, and
+// points references to merged rows at the rows they were merged into.
+// Returns the rows that are kept.
+func (m *rowMerges) apply(table string, rows []map[string]interface{}, stats *tableStats) []map[string]interface{} {
+	log := m.log
+	merged := m.merged[table]
+	values := m.values[table]
+
+	kept := rows[:0]
+	for _, row := range rows {
+		id, _ := row["id"].(int64)
+		if into, ok := merged[id]; ok {
+			log.Infof("%s (id=%d): merged into id=%d", table, id, into)
+			stats.merged++
+			continue
+		}
+		for column, value := range values[id] {
+			log.Debugf("%s (id=%d): %s %v changed to %v", table, id, column, row[column], value)
+			row[column] = value
+			stats.modified++
+			stats.changed++
+		}
+
+		for _, fk := range m.refs {
+			if fk.table != table {
+				continue
+			}
+			column := fk.columns[0]
+			ref, ok := row[column].(int64)
+			if !ok {
+				continue
+			}
+			if into, ok := m.merged[fk.refTable][ref]; ok {
+				row[column] = into
+				stats.modified++
+			}
+		}
+		kept = append(kept, row)
+	}
+	return kept
+}
@@ -0,0 +1,33 @@
+package migrate
+
+import "testing"
+
+func TestMergesApply(t *testing.T) {
+	m := new_row_merges(log)
+	m.merge("folders", 2, 1)
+	m.set("folders", 3, "path", "/media/b")
+	m.refs = []foreignKey{{table: "files", columns: []string{"parent_folder_id"}, refTable: "folders"}}
+
+	rep := &Report{}
+	stats := rep.table("folders")
+	kept := m.apply("folders", []map[string]interface{}{
+		{"id": int64(1), "path": "/media/a"},
+		{"id": int64(2), "path": "/media/a/"},
+		{"id": int64(3), "path": `\media\b`},
+	}, stats)
+	if len(kept) != 2 || kept[1]["path"] != "/media/b" {
+		t.Errorf("kept %v, want folders 1 and 3 with /media/b", kept)
+	}
+	// Merged rows aren't rejects, a dry run with merges succeeds
+	if stats.merged != 1 || stats.changed != 1 || stats.skipped != 0 || rep.Rejected() != 0 {
+		t.Errorf("merged = %d, changed = %d, skipped = %d, rejected = %d", stats.merged, stats.changed, stats.skipped, rep.Rejected())
+	}
+	if stats.not_copied() != 1 {
+		t.Errorf("not copied = %d, want 1", stats.not_copied())
+	}
+
+	files := m.apply("files", []map[string]interface{}{{"id": int64(7), "parent_folder_id": int64(2)}}, rep.table("files"))
+	if files[0]["parent_folder_id"] != int64(1) {
+		t.Errorf("parent_folder_id = %v, want 1", files[0]["parent_folder_id"])
+	}
+}
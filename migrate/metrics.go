@@ -0,0 +1,156 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// When a migration seems stuck, -pprof and -stats-interval show whether it
+// waits on the source, the destination or the garbage collector. The batch
+// loops time their phases into a phaseTimes, which the periodic stats and
+// the report read.
+
+// phaseTimes accumulates the time the batch loop spends in each phase. The
+// stats logger reads it from its own goroutine. A nil *phaseTimes records
+// nothing.
+type phaseTimes struct {
+	fetchTime     atomic.Int64
+	fetches       atomic.Int64
+	transformTime atomic.Int64
+	insertTime    atomic.Int64
+	inserts       atomic.Int64
+}
+
+// phaseSnapshot is a phaseTimes at one point in time.
+type phaseSnapshot struct {
+	fetchTime, transformTime, insertTime time.Duration
+	fetches, inserts                     int64
+}
+
+// fetched and inserted also return the time taken, for the caller's own
+// per-table accounting.
+func (p *phaseTimes) fetched(start time.Time) time.Duration {
+	took := time.Since(start)
+	if p != nil {
+		p.fetchTime.Add(int64(took))
+		p.fetches.Add(1)
+	}
+	return took
+}
+
+func (p *phaseTimes) transformed(start time.Time) {
+	if p == nil {
+		return
+	}
+	p.transformTime.Add(int64(time.Since(start)))
+}
+
+func (p *phaseTimes) inserted(start time.Time) time.Duration {
+	took := time.Since(start)
+	if p != nil {
+		p.insertTime.Add(int64(took))
+		p.inserts.Add(1)
+	}
+	return took
+}
+
+func (p *phaseTimes) snapshot() phaseSnapshot {
+	if p == nil {
+		return phaseSnapshot{}
+	}
+	return phaseSnapshot{
+		fetchTime:     time.Duration(p.fetchTime.Load()),
+		fetches:       p.fetches.Load(),
+		transformTime: time.Duration(p.transformTime.Load()),
+		insertTime:    time.Duration(p.insertTime.Load()),
+		inserts:       p.inserts.Load(),
+	}
+}
+
+// since returns the time spent between earlier and s.
+func (s phaseSnapshot) since(earlier phaseSnapshot) phaseSnapshot {
+	return phaseSnapshot{
+		fetchTime:     s.fetchTime - earlier.fetchTime,
+		fetches:       s.fetches - earlier.fetches,
+		transformTime: s.transformTime - earlier.transformTime,
+		insertTime:    s.insertTime - earlier.insertTime,
+		inserts:       s.inserts - earlier.inserts,
+	}
+}
+
+func average(total time.Duration, count int64) time.Duration {
+	if count == 0 {
+		return 0
+	}
+	return total / time.Duration(count)
+}
+
+func (s phaseSnapshot) String() string {
+	return fmt.Sprintf("source %s in %d queries (%s each), transforming %s, destination %s in %d inserts (%s each)",
+		s.fetchTime.Round(time.Millisecond), s.fetches, average(s.fetchTime, s.fetches).Round(time.Microsecond),
+		s.transformTime.Round(time.Millisecond),
+		s.insertTime.Round(time.Millisecond), s.inserts, average(s.insertTime, s.inserts).Round(time.Microsecond))
+}
+
+// start_stats logs the heap, goroutines and phase times of the last interval
+// every interval, until the returned function is called.
+func start_stats(interval time.Duration, phases *phaseTimes, log Logger) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		last := phases.snapshot()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			var mem runtime.MemStats
+			runtime.ReadMemStats(&mem)
+			now := phases.snapshot()
+			log.Infof("Stats: heap %d MB in use, %d goroutines, %d GC cycles; last %s: %s",
+				mem.HeapInuse>>20, runtime.NumGoroutine(), mem.NumGC, interval, now.since(last))
+			last = now
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// start_pprof serves net/http/pprof on addr until the returned function is
+// called. The handlers go on their own mux rather than the default one.
+func start_pprof(addr string, log Logger) (func(), error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("-pprof: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	server := &http.Server{Handler: mux}
+
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Warnf("pprof: %v", err)
+		}
+	}()
+	log.Infof("Serving pprof on http://%s/debug/pprof/", listener.Addr())
+	return func() { server.Close() }, nil
+}
@@ -0,0 +1,942 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/doug-martin/goqu/v9"
+	_ "github.com/doug-martin/goqu/v9/dialect/postgres"
+	_ "github.com/doug-martin/goqu/v9/dialect/sqlite3"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/jmoiron/sqlx"
+)
+
+var anon_dialect = goqu.Dialect("sqlite3")
+var dialect = goqu.Dialect("postgres")
+
+// tables are the stash tables copied by the migration. Those a source lacks,
+// being from a stash version before they were added, are skipped, so a new
+// table only needs adding here.
+var tables = []string{
+	"blobs",
+	"files",
+	"files_fingerprints",
+	"folders",
+	"galleries",
+	"galleries_chapters",
+	"galleries_files",
+	"galleries_images",
+	"galleries_tags",
+	"gallery_urls",
+	"group_urls",
+	"groups",
+	"groups_relations",
+	"groups_scenes",
+	"groups_tags",
+	"image_files",
+	"image_urls",
+	"images",
+	"images_files",
+	"images_tags",
+	"performer_aliases",
+	"performer_custom_fields",
+	"performer_stash_ids",
+	"performer_urls",
+	"performers",
+	"performers_galleries",
+	"performers_images",
+	"performers_scenes",
+	"performers_tags",
+	"saved_filters",
+	"scene_markers",
+	"scene_markers_tags",
+	"scene_stash_ids",
+	"scene_urls",
+	"scenes",
+	"scenes_files",
+	"scenes_galleries",
+	"scenes_o_dates",
+	"scenes_tags",
+	"scenes_view_dates",
+	"studio_aliases",
+	"studio_stash_ids",
+	"studios",
+	"studios_tags",
+	"tag_aliases",
+	"tags",
+	"tags_relations",
+	"video_captions",
+	"video_files",
+}
+
+func open_sqlite(path string, log Logger) (conn *sqlx.DB, err error) {
+	const disableForeignKeys = false
+	const writable = false
+
+	// The journal mode is a property of the file, and changing it needs
+	// write access. A read-only open keeps whatever mode the file is in,
+	// which for old databases is often DELETE.
+	url := "file:" + path + "?" + sqlite_params(!disableForeignKeys, writable)
+
+	conn, err = sqlx.Open(sqlite_driver, url)
+
+	if err != nil {
+		return nil, fmt.Errorf("db.Open(): %w", err)
+	}
+
+	var journal string
+	if err := conn.Get(&journal, "PRAGMA journal_mode"); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("read journal mode: %w", err)
+	}
+	log.Debugf("Source journal mode is %s", journal)
+
+	return conn, nil
+}
+
+// open_source opens the sqlite database at opts.SQLite, unless opts.SourceDB
+// is given. The returned close function only closes a handle opened here,
+// one that was given stays open for its owner.
+func open_source(opts Options) (*sqlx.DB, func() error, error) {
+	if opts.SourceDB != nil {
+		return opts.SourceDB, func() error { return nil }, nil
+	}
+	if err := check_sqlite_file(opts.SQLite); err != nil {
+		return nil, nil, err
+	}
+	db, err := open_sqlite(opts.SQLite, opts.logger())
+	if err != nil {
+		return nil, nil, classify(ErrSource, fmt.Errorf("failed to open db: %w", err))
+	}
+	set_pool(db, opts)
+	return db, db.Close, nil
+}
+
+// open_dest is open_source for the destination, connecting to connector
+// unless opts.DestDB is given.
+func open_dest(ctx context.Context, connector string, opts Options) (*sqlx.DB, func() error, error) {
+	if opts.DestDB != nil {
+		return opts.DestDB, func() error { return nil }, nil
+	}
+	db, err := open_pgsql(ctx, connector, !opts.DryRun, opts.Pg.PgBouncer)
+	if err != nil {
+		return nil, nil, err
+	}
+	set_pool(db, opts)
+	return db, db.Close, nil
+}
+
+// set_pool sizes the connection pool of a database opened here.
+func set_pool(db *sqlx.DB, opts Options) {
+	db.SetMaxOpenConns(opts.MaxConns)
+	db.SetMaxIdleConns(opts.MaxIdleConns)
+}
+
+// pgbouncerPort is PgBouncer's default port.
+const pgbouncerPort = 6432
+
+// open_pgsql connects to the destination. Behind PgBouncer in transaction
+// pooling mode consecutive statements outside a transaction may run on
+// different server connections, so nothing is left on a connection:
+// queries use the simple protocol instead of prepared statements, and only
+// the startup parameters PgBouncer tracks for its clients are sent.
+// It connects right away, so that a failing connection, TLS included, is
+// reported as such rather than by the first query.
+func open_pgsql(ctx context.Context, connector string, writable bool, pgbouncer bool) (conn *sqlx.DB, err error) {
+	log := logger(ctx)
+	config, err := parse_connector(connector)
+	if err != nil {
+		return nil, err
+	}
+	check_password(connector, config, log)
+
+	if !pgbouncer && config.Port == pgbouncerPort {
+		log.Infof("Port %d is PgBouncer's, connecting as with -pgbouncer", pgbouncerPort)
+		pgbouncer = true
+	}
+	if pgbouncer {
+		config.DefaultQueryExecMode = pgx.QueryExecModeSimpleProtocol
+	}
+
+	// A startup parameter lives and dies with the connection, unlike a SET
+	// SESSION which could outlive us on a pooled server connection.
+	// PgBouncer refuses it, dry runs write nothing to the destination
+	// either way.
+	if !writable && !pgbouncer {
+		config.RuntimeParams["default_transaction_read_only"] = "on"
+	}
+
+	conn = sqlx.NewDb(stdlib.OpenDB(*config), "pgx")
+	if err := conn.PingContext(ctx); err != nil {
+		conn.Close()
+		return nil, classify(ErrDestConnect, connect_error(err))
+	}
+
+	return conn, nil
+}
+
+// Options holds the settings of a migration. Apart from the connections,
+// hooks and Logger, every field can be set by a command line flag, see
+// BindFlags.
+type Options struct {
+	// Postgres is the destination's connection string and SQLite the path
+	// of the source database. SourceDB and DestDB, when set, are used
+	// instead and are left open.
+	Postgres string
+	SQLite   string
+	SourceDB *sqlx.DB
+	DestDB   *sqlx.DB
+	// Logger receives the log messages of the Migrator's runs, by default
+	// written to the terminal.
+	Logger Logger
+	// log is the logger a run was set up with, see logger.
+	log Logger
+	// Transforms are run on the source rows before they are inserted.
+	Transforms Transforms
+	// Filters leave the source rows they reject out, by table, together
+	// with the rows depending on them like -where.
+	Filters map[string]RowFilter
+
+	LogFile    string
+	Verbose    bool
+	ConfigFile string
+	Preset     string
+	// Pprof serves net/http/pprof on this address, and StatsInterval logs
+	// the memory use and where the time went this often.
+	Pprof         string
+	StatsInterval time.Duration
+	// StatusAddr serves the progress of the run as JSON at /status on
+	// this address.
+	StatusAddr string
+	// phases times the batch loops of a run for the stats and the report,
+	// progress tracks where it is.
+	phases   *phaseTimes
+	progress *progress
+	// stopping is the Migrator's, set by Stop.
+	stopping *stopSignal
+
+	Provenance  bool
+	SourceLabel string
+	DryRun      bool
+
+	Oversize    string
+	WarnValueMB int
+	InvalidUTF8 string
+	NonFinite   string
+	IntOverflow string
+	RejectFile  string
+	rejects     *rejectFile
+	// ReportJSON is where Run writes the report as JSON, see
+	// Report.WriteJSON.
+	ReportJSON string
+
+	Verify      string
+	EmitFixes   string
+	Resume      bool
+	GracePeriod time.Duration
+
+	Pg PgOptions
+
+	Retries      int
+	RetryBackoff time.Duration
+
+	// BatchSize is the most rows per INSERT. Batches taking longer than
+	// BatchTimeout are split and make the following ones smaller.
+	BatchSize    int
+	BatchTimeout time.Duration
+	// StatementTimeout bounds each fetch and insert of a batch, and
+	// Timeout the whole run, so that a hung server fails the migration
+	// instead of stalling it. 0 turns them off.
+	StatementTimeout time.Duration
+	Timeout          time.Duration
+	// MaxConns and MaxIdleConns size the connection pools of both
+	// databases, MaxConns 0 for no limit.
+	MaxConns     int
+	MaxIdleConns int
+
+	ContinueOnError bool
+	MaxErrors       int
+
+	// Force skips the check for existing data in the destination.
+	Force bool
+	// OnConflict decides what happens to rows already in the destination:
+	// error, skip or update.
+	OnConflict string
+	// Dedupe drops source rows that collide on a destination unique key.
+	Dedupe bool
+	// CaseDuplicates merges or renames names that differ only in case.
+	CaseDuplicates string
+	// CaptionLanguage is the language code given to video captions whose
+	// stored language isn't recognized.
+	CaptionLanguage string
+	// Anonymize replaces identifying text with pseudonyms and empties the
+	// images, see anonymized_columns.
+	Anonymize  bool
+	anonymizer *anonymizer
+	// PathStyle rewrites folder paths with unix or windows separators.
+	PathStyle string
+	// DeepCheck runs the full integrity_check on the source instead of
+	// quick_check.
+	DeepCheck bool
+	// IgnoreIntegrity migrates even if the source fails the check.
+	IgnoreIntegrity bool
+	// PruneOrphans leaves out references to rows missing in the source.
+	PruneOrphans bool
+	// FKViolations decides whether foreign key violations found after
+	// loading fail the migration: error or warn.
+	FKViolations string
+	// ValidateConstraints validates the destination's NOT VALID
+	// constraints after loading.
+	ValidateConstraints bool
+	// DiskCheck decides what an estimated destination size larger than the
+	// free space does: error, warn or off. DiskPath is a directory on the
+	// destination's data volume, for a server on another machine.
+	DiskCheck string
+	DiskPath  string
+	// Output writes the migration to this SQL script instead of loading
+	// the destination.
+	Output string
+	// OutputDir writes the migration to this directory as COPY files and
+	// a restore.sql instead of loading the destination.
+	OutputDir string
+	// Reverse copies the postgres database back into sqlite instead.
+	Reverse bool
+	// FixSequences only resets the destination's sequences, without the
+	// sqlite source.
+	FixSequences bool
+	// NoAnalyze skips analyzing the migrated tables.
+	NoAnalyze bool
+	// RebuildIndexes drops secondary indexes while loading a table.
+	RebuildIndexes bool
+	// Fast applies bulk load settings to the destination transactions.
+	Fast bool
+	// CreateDB creates the destination database if it doesn't exist, with
+	// the given owner, encoding and locale where set.
+	CreateDB         bool
+	CreateDBOwner    string
+	CreateDBEncoding string
+	CreateDBLocale   string
+	// GrantTo is the role stash connects as, to be granted access to the
+	// migrated tables.
+	GrantTo string
+	// SetSchemaVersion records the source's stash schema version in the
+	// destination after a successful migration.
+	SetSchemaVersion bool
+
+	// Only and Skip select the tables to migrate.
+	Only      string
+	Skip      string
+	SkipBlobs bool
+	// Where leaves out the rows not matching a condition, with the rows
+	// depending on them: "table: condition; table: condition".
+	Where string
+	// StartFrom skips the tables before it.
+	StartFrom string
+	// Since starts an incremental sync from a time, or from the last run.
+	Since string
+	// Clean truncates the destination tables before migrating, after asking
+	// unless yes is set.
+	Clean bool
+	Yes   bool
+	// Confirm asks the user a yes/no question; nil when nobody can answer.
+	Confirm func(question string) bool
+
+	GeneratedDir  string
+	GeneratedList string
+
+	BlobsDir    string
+	BlobFsync   string
+	BlobWorkers int
+}
+
+// Validate checks the settings of o, and that they can be used together.
+func (o *Options) Validate() error {
+	switch o.Verify {
+	case verifyCount, verifyChecksum:
+	default:
+		return fmt.Errorf("invalid -verify %q", o.Verify)
+	}
+	if o.EmitFixes != "" && o.Verify != verifyChecksum {
+		return fmt.Errorf("-emit-fixes needs -verify checksum")
+	}
+	switch o.Oversize {
+	case oversizeFail, oversizeSkip, oversizeTruncate:
+	default:
+		return fmt.Errorf("invalid -oversize %q", o.Oversize)
+	}
+	switch o.InvalidUTF8 {
+	case utf8Replace, utf8Latin1:
+	default:
+		return fmt.Errorf("invalid -invalid-utf8 %q", o.InvalidUTF8)
+	}
+	switch o.NonFinite {
+	case nonFiniteNull, nonFiniteZero:
+	default:
+		return fmt.Errorf("invalid -non-finite %q", o.NonFinite)
+	}
+	switch o.IntOverflow {
+	case intOverflowClamp, intOverflowNull:
+	default:
+		return fmt.Errorf("invalid -int-overflow %q", o.IntOverflow)
+	}
+	switch o.CaseDuplicates {
+	case "", caseDuplicatesMerge, caseDuplicatesRename:
+	default:
+		return fmt.Errorf("invalid -case-duplicates %q", o.CaseDuplicates)
+	}
+	switch o.PathStyle {
+	case "", pathStyleUnix, pathStyleWindows:
+	default:
+		return fmt.Errorf("invalid -path-style %q", o.PathStyle)
+	}
+	if o.Anonymize {
+		if o.Reverse || o.BlobsDir != "" || o.Verify == verifyChecksum {
+			return fmt.Errorf("-anonymize can't be used with -reverse, -blobs-to-filesystem or -verify checksum")
+		}
+		// The key of the pseudonyms is drawn for each run
+		if o.Resume || o.Since != "" {
+			return fmt.Errorf("-anonymize can't be used with -resume or -since, another run gives other pseudonyms")
+		}
+	}
+	if o.CaptionLanguage == "" {
+		return fmt.Errorf("-caption-language can't be empty")
+	}
+	switch o.FKViolations {
+	case fkViolationsError, fkViolationsWarn:
+	default:
+		return fmt.Errorf("invalid -fk-violations %q", o.FKViolations)
+	}
+	switch o.DiskCheck {
+	case diskCheckError, diskCheckWarn, diskCheckOff:
+	default:
+		return fmt.Errorf("invalid -disk-check %q", o.DiskCheck)
+	}
+	switch o.BlobFsync {
+	case fsyncFile, fsyncDir, fsyncNone:
+	default:
+		return fmt.Errorf("invalid -blob-fsync %q", o.BlobFsync)
+	}
+	switch o.OnConflict {
+	case onConflictError, onConflictSkip, onConflictUpdate:
+	default:
+		return fmt.Errorf("invalid -on-conflict %q", o.OnConflict)
+	}
+	if o.Clean && o.Resume {
+		return fmt.Errorf("-clean and -resume can't be used together")
+	}
+	// The tables skipped by -start-from reference the ones left, so
+	// truncating those would empty the skipped ones too, and nothing
+	// would copy them again
+	if o.Clean && o.StartFrom != "" {
+		return fmt.Errorf("-clean and -start-from can't be used together")
+	}
+	if selected, err := select_tables(o.Only, o.Skip); err != nil {
+		return err
+	} else if _, _, err := start_from(selected, o.StartFrom); err != nil {
+		return err
+	}
+	if _, err := parse_where(o.Where); err != nil {
+		return err
+	}
+	for table := range o.Filters {
+		if !slices.Contains(tables, table) {
+			return fmt.Errorf("filter for unknown table %q", table)
+		}
+	}
+	if (o.Where != "" || len(o.Filters) > 0) && o.Resume {
+		return fmt.Errorf("-where and filters can't be used with -resume")
+	}
+	if o.CreateDB && o.Pg.PgBouncer {
+		return fmt.Errorf("-create-db doesn't work through PgBouncer, create the database on the server and add it to PgBouncer's [databases]")
+	}
+	if o.Output != "" && o.OutputDir != "" {
+		return fmt.Errorf("-output and -output-dir can't be used together")
+	}
+	for flag, value := range map[string]string{"output": o.Output, "output-dir": o.OutputDir} {
+		if value == "" {
+			continue
+		}
+		if o.Dedupe || o.PruneOrphans || o.CaseDuplicates != "" || o.PathStyle != "" || o.Where != "" || len(o.Filters) > 0 {
+			return fmt.Errorf("-%s can't be used with -dedupe, -prune-orphans, -case-duplicates, -path-style or -where, they need the destination", flag)
+		}
+		if o.Clean || o.Resume || o.Since != "" || o.Reverse {
+			return fmt.Errorf("-%s can't be used with -clean, -resume, -since or -reverse", flag)
+		}
+	}
+	if o.SkipBlobs && o.BlobsDir != "" {
+		return fmt.Errorf("-skip-blobs and -blobs-to-filesystem can't be used together")
+	}
+	if o.Since != "" && (o.Clean || o.Resume) {
+		return fmt.Errorf("-since can't be used with -clean or -resume")
+	}
+	if o.BatchSize < minBatchSize {
+		return fmt.Errorf("-batch-size must be at least %d", minBatchSize)
+	}
+	if o.BlobWorkers < 1 {
+		o.BlobWorkers = 1
+	}
+	if o.MaxConns < 0 || o.MaxIdleConns < 0 {
+		return fmt.Errorf("-max-conns and -max-idle-conns can't be negative")
+	}
+	if o.MaxConns == 1 {
+		// A table's transaction and the catalog lookups beside it
+		return fmt.Errorf("-max-conns must be 0 or at least 2")
+	}
+	if o.StatementTimeout < 0 || o.Timeout < 0 {
+		return fmt.Errorf("-statement-timeout and -timeout can't be negative")
+	}
+	return o.Pg.check_tls_files()
+}
+
+// select_tables applies the -only and -skip filters to tables. Both take a
+// comma separated list of names, optionally prefixed with "tables=".
+func select_tables(only string, skip string) ([]string, error) {
+	parse := func(flag string, value string) (map[string]bool, error) {
+		names := map[string]bool{}
+		value = strings.TrimPrefix(value, "tables=")
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if !slices.Contains(tables, name) {
+				return nil, classify(ErrUsage, fmt.Errorf("-%s: unknown table %q", flag, name))
+			}
+			names[name] = true
+		}
+		return names, nil
+	}
+
+	include, err := parse("only", only)
+	if err != nil {
+		return nil, err
+	}
+	exclude, err := parse("skip", skip)
+	if err != nil {
+		return nil, err
+	}
+
+	var selected []string
+	for _, table := range tables {
+		if (len(include) == 0 || include[table]) && !exclude[table] {
+			selected = append(selected, table)
+		}
+	}
+	if len(selected) == 0 {
+		return nil, classify(ErrUsage, fmt.Errorf("-only and -skip leave no tables to migrate"))
+	}
+	return selected, nil
+}
+
+// start_from drops the tables before table from selected, as a simple way to
+// pick up a failed run where it stopped.
+func start_from(selected []string, table string) ([]string, []string, error) {
+	if table == "" {
+		return selected, nil, nil
+	}
+	if !slices.Contains(tables, table) {
+		return nil, nil, classify(ErrUsage, fmt.Errorf("-start-from: unknown table %q", table))
+	}
+	idx := slices.Index(selected, table)
+	if idx < 0 {
+		return nil, nil, classify(ErrUsage, fmt.Errorf("-start-from: %s is excluded by -only or -skip", table))
+	}
+	return selected[idx:], selected[:idx], nil
+}
+
+// count_source_rows returns the total number of rows in the given source
+// tables.
+func count_source_rows(ctx context.Context, sourceDB *sqlx.DB, tables []string) (int64, error) {
+	var total int64
+	for _, table := range tables {
+		count, err := count_rows(ctx, sourceDB, anon_dialect, table)
+		if err != nil {
+			return 0, err
+		}
+		total += count
+	}
+	return total, nil
+}
+
+func migrate(ctx context.Context, opts Options) (*Report, error) {
+	log := logger(ctx)
+	rep := new_report(opts)
+	started := wall_clock()
+	dbpath := opts.SQLite
+	if opts.SourceLabel == "" {
+		opts.SourceLabel = default_source_label(dbpath)
+	}
+
+	if !opts.SkipBlobs && opts.BlobsDir == "" && dbpath != "" && stash_blob_storage(dbpath) == blobStorageFilesystem {
+		log.Warnf("Stash is configured to store blobs on the filesystem, the blobs table probably holds nothing of use")
+		if opts.Confirm != nil && opts.Confirm("Skip the blobs table?") {
+			opts.SkipBlobs = true
+		} else {
+			log.Warnf("Use --skip-blobs to skip it")
+		}
+	}
+	skip := opts.Skip
+	if opts.SkipBlobs {
+		skip += ",blobs"
+	}
+
+	selected, err := select_tables(opts.Only, skip)
+	if err != nil {
+		return nil, err
+	}
+	for _, table := range tables {
+		if !slices.Contains(selected, table) {
+			rep.excluded = append(rep.excluded, table)
+		}
+	}
+	if len(selected) < len(tables) {
+		log.Warnf("Migrating only %s; keeping foreign keys to and from other tables consistent is up to you", strings.Join(selected, ", "))
+	}
+	todo, skipped, err := start_from(selected, opts.StartFrom)
+	if err != nil {
+		return nil, err
+	}
+	if len(skipped) > 0 {
+		log.Warnf("Starting from %s, skipping %s", opts.StartFrom, strings.Join(skipped, ", "))
+	}
+	rep.planned = todo
+
+	connector, err := opts.Pg.apply(opts.Postgres)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.CreateDB && opts.DestDB == nil {
+		if opts.DryRun {
+			log.Infof("Dry run: not creating the database")
+		} else if created, err := create_database(ctx, connector, opts); err != nil {
+			return nil, err
+		} else if created {
+			return nil, classify(ErrSchema, fmt.Errorf("the new database is empty: start stash against it once to create its tables, then migrate"))
+		}
+	}
+
+	if dbpath != "" {
+		if err := check_source_not_in_use(ctx, dbpath, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	sourceDB, closeSource, err := open_source(opts)
+	if err != nil {
+		return nil, err
+	}
+	// Closing is idempotent, these only matter on error paths
+	defer closeSource()
+	if err := check_stash_database(ctx, sourceDB, "source"); err != nil {
+		return nil, err
+	}
+
+	destDB, closeDest, err := open_dest(ctx, connector, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer closeDest()
+	// A no-op on the success path, where the pool is already closed
+	defer reset_dest_session(ctx, destDB)
+
+	if err := check_dest_server(ctx, destDB); err != nil {
+		return nil, err
+	}
+	if opts.Pg.Schema != "" {
+		if err := check_dest_schema(ctx, destDB, opts.Pg.Schema); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := check_source_integrity(ctx, sourceDB, opts.DeepCheck, opts.IgnoreIntegrity); err != nil {
+		return nil, err
+	}
+	if err := check_source_not_empty(ctx, sourceDB); err != nil {
+		return nil, err
+	}
+
+	// Sources from older stash versions lack the newer tables
+	missing, err := missing_source_tables(ctx, sourceDB, todo)
+	if err != nil {
+		return nil, err
+	}
+	if len(missing) > 0 {
+		log.Infof("Source has no %s, from before stash added them, skipping", strings.Join(missing, ", "))
+		var present []string
+		for _, table := range todo {
+			if !slices.Contains(missing, table) {
+				present = append(present, table)
+			}
+		}
+		todo = present
+		rep.planned = todo
+		rep.excluded = append(rep.excluded, missing...)
+	}
+
+	notify := new_notifier(log)
+	defer notify.stopping()
+	notify.ready()
+
+	totalRows, err := count_source_rows(ctx, sourceDB, todo)
+	if err != nil {
+		return nil, err
+	}
+	opts.progress.set_total(totalRows)
+
+	if opts.DiskCheck != diskCheckOff {
+		rep.estimatedSize, err = check_disk_space(ctx, sourceDB, destDB, todo, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.DryRun {
+		log.Infof("Dry run: nothing will be written to the destination")
+		opts.Provenance = false
+	}
+
+	if opts.Since != "" {
+		rep.since, err = resolve_since(ctx, destDB, opts.Since, opts.SourceLabel)
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("Syncing rows changed since %s", format_time(rep.since))
+	}
+
+	if err := confirm_plan(ctx, sourceDB, destDB, connector, todo, totalRows, opts); err != nil {
+		return nil, err
+	}
+	// The summary named -clean, so it isn't asked about again
+	opts.Yes = opts.Yes || opts.Confirm != nil
+
+	if err := check_dest_privileges(ctx, destDB, todo, opts); err != nil {
+		return nil, err
+	}
+
+	if opts.Clean {
+		// Decided before missing tables shrank the list. Validate rejects
+		// -start-from with -clean, never cascade into skipped tables all
+		// the same
+		cascade := len(selected) == len(tables) && len(skipped) == 0
+		if err := clean_dest(ctx, destDB, todo, cascade, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	if !opts.Force && !opts.Resume && !opts.DryRun && opts.OnConflict == onConflictError && opts.Since == "" {
+		if err := check_dest_empty(ctx, destDB, todo, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Provenance {
+		if err := create_provenance_table(ctx, destDB); err != nil {
+			return nil, err
+		}
+	}
+
+	var merges *rowMerges
+	if opts.CaseDuplicates != "" || (opts.PathStyle != "" && slices.Contains(selected, "folders")) {
+		merges = new_row_merges(log)
+		if opts.CaseDuplicates != "" {
+			if err := find_case_duplicates(ctx, sourceDB, selected, opts.CaseDuplicates, merges); err != nil {
+				return nil, err
+			}
+		}
+		if opts.PathStyle != "" && slices.Contains(selected, "folders") {
+			if err := find_folder_duplicates(ctx, sourceDB, opts.PathStyle, merges); err != nil {
+				return nil, err
+			}
+		}
+		if err := merges.load_refs(ctx, destDB); err != nil {
+			return nil, err
+		}
+	}
+
+	orphans, err := find_orphans(ctx, sourceDB, destDB, selected)
+	if err != nil {
+		return nil, err
+	}
+	if !opts.PruneOrphans {
+		zeros, others := orphans.zero_refs()
+		if others {
+			log.Warnf("Use --prune-orphans to leave references to missing rows out")
+		}
+		orphans = zeros
+	}
+
+	filters, err := new_row_filters(opts, todo)
+	if err != nil {
+		return nil, err
+	}
+	if filters != nil {
+		dependents, err := find_filtered(ctx, sourceDB, destDB, selected, filters)
+		if err != nil {
+			return nil, err
+		}
+		if orphans == nil {
+			orphans = map[string][]orphanRef{}
+		}
+		for table, refs := range dependents {
+			orphans[table] = append(orphans[table], refs...)
+		}
+	}
+
+	var settings []string
+	if opts.Fast && !opts.DryRun {
+		settings, err = probe_local_settings(ctx, destDB, fast_settings)
+		if err != nil {
+			return nil, err
+		}
+		rep.settings = settings
+	}
+
+	m := &migration{
+		sourceDB: sourceDB,
+		destDB:   destDB,
+		opts:     opts,
+		rep:      rep,
+		notify:   notify,
+		since:    rep.since,
+		tables:   todo,
+		merges:   merges,
+		orphans:  orphans,
+		filters:  filters,
+		settings: settings,
+	}
+	for tableIdx, table := range todo {
+		err := m.copy_table(ctx, tableIdx, table)
+		// A lost connection takes the table's transaction with it, so the
+		// whole table is copied again on a fresh one.
+		for attempt := 0; err != nil && ctx.Err() == nil && is_transient(err) && attempt < opts.Retries; attempt++ {
+			wait := backoff(attempt, opts.RetryBackoff)
+			log.Warnf("%s failed (%v), starting the table over in %s", table, err, wait)
+			if err := sleep_ctx(ctx, wait); err != nil {
+				break
+			}
+			m.restart_table(table)
+			err = m.copy_table(ctx, tableIdx, table)
+		}
+
+		if err != nil {
+			if ctx.Err() != nil && !errors.Is(err, ErrInterrupted) {
+				err = fmt.Errorf("%s: %w", table, ErrInterrupted)
+			}
+			return rep, err
+		}
+	}
+
+	notify.status("Finalizing")
+
+	if opts.GeneratedDir != "" {
+		// Nothing has been written in a dry run, so look at the source
+		db := destDB
+		if opts.DryRun {
+			db = sourceDB
+		}
+		if err := find_orphaned_generated(ctx, db, opts.GeneratedDir, opts.GeneratedList); err != nil {
+			return rep, err
+		}
+	}
+
+	if opts.DryRun {
+		if err := closeSource(); err != nil {
+			return rep, fmt.Errorf("source close: %w", err)
+		}
+		reset_dest_session(ctx, destDB)
+		if err := closeDest(); err != nil {
+			return rep, fmt.Errorf("dest close: %w", err)
+		}
+		return rep, nil
+	}
+
+	if err := reset_sequences(ctx, destDB, selected); err != nil {
+		return rep, err
+	}
+
+	if opts.GrantTo != "" {
+		if err := grant_privileges(ctx, destDB, opts.GrantTo, todo); err != nil {
+			return rep, err
+		}
+	}
+
+	if !opts.NoAnalyze {
+		if err := analyze_tables(ctx, destDB, rep); err != nil {
+			return rep, err
+		}
+	}
+
+	if opts.Provenance {
+		if err := report_provenance(ctx, destDB); err != nil {
+			return rep, err
+		}
+	}
+
+	if err := check_dest_session(ctx, destDB); err != nil {
+		return rep, err
+	}
+	if opts.ValidateConstraints {
+		if err := validate_constraints(ctx, destDB); err != nil {
+			return rep, err
+		}
+	}
+
+	violations, err := report_orphans(ctx, destDB)
+	if err != nil {
+		return rep, err
+	}
+	if violations > 0 {
+		if opts.FKViolations == fkViolationsError {
+			return rep, classify(ErrData, fmt.Errorf("%d rows violate foreign keys, see above; --prune-orphans leaves them out", violations))
+		}
+		log.Warnf("%d rows violate foreign keys", violations)
+	}
+
+	if err := verify_counts(ctx, sourceDB, destDB, rep); err != nil {
+		return rep, err
+	}
+	if opts.Verify == verifyChecksum {
+		differing, err := verify_checksums(ctx, sourceDB, destDB, rep)
+		if opts.EmitFixes != "" && len(differing) > 0 {
+			if err := m.write_fixes(ctx, opts.EmitFixes, differing); err != nil {
+				return rep, err
+			}
+		}
+		if err != nil {
+			return rep, err
+		}
+	}
+
+	if len(rep.failures) == 0 {
+		if err := record_sync(ctx, destDB, opts.SourceLabel, started); err != nil {
+			return rep, err
+		}
+		if opts.SetSchemaVersion {
+			if err := record_schema_version(ctx, sourceDB, destDB); err != nil {
+				return rep, err
+			}
+		}
+	} else if opts.SetSchemaVersion {
+		log.Warnf("Not recording the schema version, some rows failed")
+	}
+
+	if err := closeSource(); err != nil {
+		return rep, fmt.Errorf("source close: %w", err)
+	}
+
+	reset_dest_session(ctx, destDB)
+	if err := closeDest(); err != nil {
+		return rep, fmt.Errorf("dest close: %w", err)
+	}
+
+	if len(rep.failures) > 0 {
+		return rep, classify(ErrData, fmt.Errorf("%d rows or batches failed to insert", len(rep.failures)))
+	}
+	return rep, nil
+}
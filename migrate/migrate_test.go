@@ -0,0 +1,85 @@
+package migrate
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// new_delete_journal_fixture creates a source in DELETE journal mode, as
+// databases of older stash versions are.
+func new_delete_journal_fixture(t *testing.T) string {
+	t.Helper()
+	path := new_sqlite(t,
+		"CREATE TABLE tags (id INTEGER PRIMARY KEY, name VARCHAR(255))",
+		"INSERT INTO tags (id, name) VALUES (1, 'a'), (2, 'b')",
+	)
+	db, err := sqlx.Open(sqlite_driver, "file:"+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var mode string
+	if err := db.Get(&mode, "PRAGMA journal_mode = DELETE"); err != nil || mode != "delete" {
+		t.Fatalf("journal mode %s: %v", mode, err)
+	}
+	return path
+}
+
+// TestDeleteJournalSource checks that a source in DELETE journal mode is
+// migrated as it is, without being switched to WAL.
+func TestDeleteJournalSource(t *testing.T) {
+	path := new_delete_journal_fixture(t)
+	source, err := open_sqlite(path, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	m, fake := new_test_migration(t)
+	m.sourceDB = source
+	m.opts.SourceDB = source
+	if err := m.copy_table(context.Background(), 0, "tags"); err != nil {
+		t.Fatal(err)
+	}
+	if stats := m.rep.table("tags"); !stats.committed || stats.inserted != 2 {
+		t.Errorf("committed = %v, inserted = %d, want 2 committed: %v", stats.committed, stats.inserted, fake.statements)
+	}
+
+	var mode string
+	if err := source.Get(&mode, "PRAGMA journal_mode"); err != nil {
+		t.Fatal(err)
+	}
+	if mode != "delete" {
+		t.Errorf("journal mode = %s while migrating, want delete", mode)
+	}
+	source.Close()
+	if _, err := os.Stat(path + "-wal"); !os.IsNotExist(err) {
+		t.Errorf("the source got a WAL file: %v", err)
+	}
+}
+
+// TestCleanStartFrom checks that -clean can't be combined with -start-from,
+// whose skipped tables reference the ones left and would be emptied along
+// with them by the truncate, never to be copied again.
+func TestCleanStartFrom(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Clean = true
+	opts.StartFrom = "tags"
+	if err := opts.Validate(); err == nil || !strings.Contains(err.Error(), "-start-from") {
+		t.Errorf("Validate = %v, want -clean with -start-from rejected", err)
+	}
+
+	opts.StartFrom = ""
+	if err := opts.Validate(); err != nil {
+		t.Errorf("-clean alone: %v", err)
+	}
+	opts.Clean = false
+	opts.StartFrom = "tags"
+	if err := opts.Validate(); err != nil {
+		t.Errorf("-start-from alone: %v", err)
+	}
+}
@@ -0,0 +1,169 @@
+// Package migrate copies a stash sqlite database into postgres.
+package migrate
+
+import (
+	"context"
+	"errors"
+)
+
+// Migrator runs a migration, or the repair of an already migrated
+// destination, with the given Options.
+type Migrator struct {
+	opts     Options
+	stopping stopSignal
+}
+
+// New returns a Migrator for opts, which are best started from
+// DefaultOptions and must pass Options.Validate.
+func New(opts Options) *Migrator {
+	return &Migrator{opts: opts}
+}
+
+// Run migrates the source into the destination, or with Output or
+// OutputDir set writes the migration to a script. The report is returned
+// when the migration got far enough to have one, also along with an error.
+// Errors carry a class like ErrSource or ErrData.
+func (m *Migrator) Run(ctx context.Context) (*Report, error) {
+	// A Stop only applies to the run it was called during
+	m.stopping.reset()
+	ctx, release, err := m.setup(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	var rep *Report
+	switch {
+	case m.opts.Output != "":
+		rep, err = dump(ctx, m.opts)
+	case m.opts.OutputDir != "":
+		rep, err = dump_copy(ctx, m.opts)
+	default:
+		rep, err = migrate(ctx, m.opts)
+	}
+	if rep != nil && m.opts.ReportJSON != "" {
+		if werr := write_report_json(m.opts.ReportJSON, rep); werr != nil {
+			err = errors.Join(err, werr)
+		}
+	}
+	return rep, classify_error(err)
+}
+
+// Repair resets the destination's sequences and reports its schema
+// problems, without needing the source.
+func (m *Migrator) Repair(ctx context.Context) error {
+	ctx, release, err := m.setup(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return classify_error(repair(ctx, m.opts))
+}
+
+// FixSequences only resets the destination's sequences.
+func (m *Migrator) FixSequences(ctx context.Context) error {
+	ctx, release, err := m.setup(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return classify_error(fix_sequences(ctx, m.opts))
+}
+
+// Reverse copies the postgres database back into the sqlite one, which
+// stash must have created. Postgres or DestDB name the postgres database
+// and SQLite or SourceDB the sqlite one, as for Run.
+func (m *Migrator) Reverse(ctx context.Context) (*Report, error) {
+	ctx, release, err := m.setup(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	rep, err := reverse(ctx, m.opts)
+	return rep, classify_error(err)
+}
+
+// Stop makes a running Run finish the batch in flight, roll back the
+// current table and return ErrInterrupted. Cancelling Run's context stops
+// it right away instead.
+func (m *Migrator) Stop() {
+	m.stopping.stop()
+}
+
+// setup picks the logger, opens the reject file, bounds ctx by Timeout
+// and starts the diagnostics, returning the context to run with and what
+// undoes the rest. The logger goes into the context and the Options of the
+// run, so that Migrators running at the same time each log to their own.
+func (m *Migrator) setup(ctx context.Context) (context.Context, func(), error) {
+	logger := m.opts.Logger
+	if logger == nil {
+		logger = log
+	}
+	m.opts.progress = new_progress()
+	if m.opts.StatusAddr != "" {
+		logger = &countingLogger{Logger: logger, progress: m.opts.progress}
+	}
+	m.opts.log = logger
+	ctx = with_logger(ctx, logger)
+
+	var undo []func()
+	release := func() {
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+	}
+
+	if m.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.opts.Timeout)
+		undo = append(undo, cancel)
+	}
+
+	if m.opts.RejectFile != "" && m.opts.rejects == nil {
+		rejects, err := open_reject_file(m.opts.RejectFile, logger)
+		if err != nil {
+			release()
+			return nil, nil, err
+		}
+		m.opts.rejects = rejects
+		undo = append(undo, func() {
+			rejects.close()
+			m.opts.rejects = nil
+		})
+	}
+
+	if m.opts.Pprof != "" {
+		stop, err := start_pprof(m.opts.Pprof, logger)
+		if err != nil {
+			release()
+			return nil, nil, classify(ErrUsage, err)
+		}
+		undo = append(undo, stop)
+	}
+	m.opts.stopping = &m.stopping
+	m.opts.phases = &phaseTimes{}
+	if m.opts.StatsInterval > 0 {
+		undo = append(undo, start_stats(m.opts.StatsInterval, m.opts.phases, logger))
+	}
+	if m.opts.Anonymize {
+		anonymizer, err := new_anonymizer()
+		if err != nil {
+			release()
+			return nil, nil, err
+		}
+		m.opts.anonymizer = anonymizer
+	}
+	if m.opts.StatusAddr != "" {
+		stop, err := start_status(m.opts.StatusAddr, m.opts.progress, logger)
+		if err != nil {
+			release()
+			return nil, nil, classify(ErrUsage, err)
+		}
+		undo = append(undo, stop)
+	}
+
+	return ctx, release, nil
+}
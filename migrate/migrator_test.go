@@ -0,0 +1,221 @@
+package migrate
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// run_fixture is the image-only library of a stash at schema version 60.
+var run_fixture = slices.Concat(image_only_fixture, []string{
+	"CREATE TABLE schema_migrations (version INTEGER, dirty BOOLEAN)",
+	"INSERT INTO schema_migrations VALUES (60, false)",
+})
+
+// new_run_fixture returns options for a whole run from run_fixture into a
+// fake destination with the same tables, which answers the checks before
+// the copy.
+func new_run_fixture(t *testing.T) (Options, *fakeDest) {
+	t.Helper()
+	fake, dest := new_fake_dest(t)
+	for _, table := range []string{"scenes", "images", "galleries"} {
+		fake.columns[table] = []columnInfo{{name: "id", dataType: "integer"}, {name: "title", dataType: "text", nullable: true}}
+	}
+	for _, table := range []string{"groups", "performers", "studios", "tags"} {
+		fake.columns[table] = []columnInfo{{name: "id", dataType: "integer"}, {name: "name", dataType: "text", nullable: true}}
+	}
+	fake.columns["files"] = []columnInfo{{name: "id", dataType: "integer"}, {name: "basename", dataType: "text"}}
+	fake.columns["images_files"] = []columnInfo{{name: "image_id", dataType: "integer"}, {name: "file_id", dataType: "integer"}}
+
+	fake.answer("SELECT current_setting('server_version_num')", []string{"current_setting"}, []driver.Value{int64(160000)})
+	fake.answer("SELECT EXISTS (SELECT 1 FROM pg_available_extensions", []string{"exists"}, []driver.Value{true})
+	fake.answer("SELECT has_table_privilege(", []string{"has_table_privilege"}, []driver.Value{true})
+	fake.answer(select_sequences, sequence_columns)
+	fake.answer(select_foreign_keys, []string{"conname", "relname", "relname", "columns", "ref_columns"})
+
+	opts := DefaultOptions()
+	opts.SourceDB = open_test_source(t, run_fixture...)
+	opts.DestDB = dest
+	opts.Yes = true
+	return opts, fake
+}
+
+// TestDryRunKeepsGivenHandles checks that a dry run leaves the handles
+// given in the options open for their owner.
+func TestDryRunKeepsGivenHandles(t *testing.T) {
+	opts, _ := new_run_fixture(t)
+	opts.DryRun = true
+	rep, err := New(opts).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.table("images").inserted != 2 {
+		t.Errorf("would insert %d images, want 2", rep.table("images").inserted)
+	}
+	if err := opts.SourceDB.Ping(); err != nil {
+		t.Errorf("source closed: %v", err)
+	}
+	if err := opts.DestDB.Ping(); err != nil {
+		t.Errorf("destination closed: %v", err)
+	}
+}
+
+// TestFailedRunReport checks that a run failing partway returns the report
+// of what it got done along with the error.
+func TestFailedRunReport(t *testing.T) {
+	opts, _ := new_run_fixture(t)
+	opts.DryRun = true
+	failure := errors.New("injected failure")
+	opts.Transforms.Add("images", "failing", func(table string, row map[string]interface{}) (bool, error) {
+		return false, failure
+	})
+
+	rep, err := New(opts).Run(context.Background())
+	if !errors.Is(err, failure) {
+		t.Fatalf("Run = %v, want the injected failure", err)
+	}
+	if rep == nil {
+		t.Fatal("no report for the failed run")
+	}
+	if files := rep.table("files"); files.inserted != 2 {
+		t.Errorf("report has %d files, want the 2 copied before the failure", files.inserted)
+	}
+}
+
+// recordingLogger keeps the messages logged to it.
+type recordingLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *recordingLogger) record(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Debugf(format string, args ...interface{}) { l.record(format, args...) }
+func (l *recordingLogger) Infof(format string, args ...interface{})  { l.record(format, args...) }
+func (l *recordingLogger) Warnf(format string, args ...interface{})  { l.record(format, args...) }
+func (l *recordingLogger) Errorf(format string, args ...interface{}) { l.record(format, args...) }
+
+// logged reports whether a message starts with the given words.
+func (l *recordingLogger) logged(words ...string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.ContainsFunc(l.messages, func(m string) bool {
+		fields := strings.Fields(m)
+		return len(fields) >= len(words) && slices.Equal(fields[:len(words)], words)
+	})
+}
+
+// TestMigratorsKeepTheirLoggers runs two Migrators at the same time and
+// checks that each logs, its report included, only to its own Logger.
+func TestMigratorsKeepTheirLoggers(t *testing.T) {
+	loggers := []*recordingLogger{{}, {}}
+	reports := make([]*Report, len(loggers))
+	errs := make([]error, len(loggers))
+
+	var wg sync.WaitGroup
+	for i, logger := range loggers {
+		opts, _ := new_run_fixture(t)
+		opts.DryRun = true
+		opts.Logger = logger
+		if i == 1 {
+			opts.Skip = "galleries"
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reports[i], errs[i] = New(opts).Run(context.Background())
+		}()
+	}
+	wg.Wait()
+
+	for i, rep := range reports {
+		if errs[i] != nil {
+			t.Fatalf("run %d: %v", i, errs[i])
+		}
+		rep.Print(true)
+	}
+	if !loggers[0].logged("Fetching", "images") || !loggers[1].logged("Fetching", "images") {
+		t.Error("a Migrator logged nothing to its Logger")
+	}
+	if loggers[0].logged("galleries", "excluded") {
+		t.Error("the first Migrator's Logger got the second one's messages")
+	}
+	if !loggers[1].logged("galleries", "excluded") {
+		t.Error("the second Migrator's report wasn't printed to its Logger")
+	}
+}
+
+// TestReportAccessors checks what the exported accessors of a Report
+// return after a run.
+func TestReportAccessors(t *testing.T) {
+	opts, _ := new_run_fixture(t)
+	opts.DryRun = true
+	opts.Skip = "galleries"
+	rep, err := New(opts).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if slices.Contains(rep.Planned(), "galleries") || !slices.Contains(rep.Planned(), "images") {
+		t.Errorf("Planned() = %v, want images without galleries", rep.Planned())
+	}
+	if !slices.Contains(rep.Excluded(), "galleries") {
+		t.Errorf("Excluded() = %v, want galleries among them", rep.Excluded())
+	}
+	var images *TableResult
+	for _, r := range rep.Tables() {
+		if r.Table == "images" {
+			images = &r
+		}
+	}
+	if images == nil {
+		t.Fatalf("Tables() = %+v, no images", rep.Tables())
+	}
+	if images.Fetched != 2 || images.Inserted != 2 || images.Skipped != 0 || images.BytesRead == 0 {
+		t.Errorf("images = %+v, want 2 rows fetched and inserted", *images)
+	}
+	if len(rep.Failures()) != 0 {
+		t.Errorf("Failures() = %v, want none", rep.Failures())
+	}
+}
+
+// TestReportJSON checks the report Run writes with ReportJSON.
+func TestReportJSON(t *testing.T) {
+	opts, _ := new_run_fixture(t)
+	opts.DryRun = true
+	opts.ReportJSON = filepath.Join(t.TempDir(), "report.json")
+	if _, err := New(opts).Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(opts.ReportJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc reportDoc
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatalf("%v in %s", err, data)
+	}
+	i := slices.IndexFunc(doc.Tables, func(d tableDoc) bool { return d.Table == "images" })
+	if i < 0 || doc.Tables[i].Inserted != 2 || doc.Tables[i].BytesRead == 0 {
+		t.Errorf("tables = %+v, want images with 2 rows", doc.Tables)
+	}
+	if doc.Usage.CPUSeconds <= 0 || doc.Usage.PeakRSSBytes <= 0 || doc.Usage.BytesRead == 0 {
+		t.Errorf("usage = %+v, want CPU, peak RSS and bytes read", doc.Usage)
+	}
+	if doc.Failures == nil || len(doc.Failures) != 0 {
+		t.Errorf("failures = %v, want an empty list", doc.Failures)
+	}
+}
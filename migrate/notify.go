@@ -0,0 +1,79 @@
+package migrate
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// notifier implements the sd_notify protocol so that systemd can show the
+// progress of a migration run as a service. A nil *notifier does nothing,
+// which is what plain CLI usage gets.
+type notifier struct {
+	conn     net.Conn
+	watchdog bool
+	log      Logger
+}
+
+// How long each batch may take before a watchdog-enabled unit is killed.
+const notifyExtendTimeout = 10 * time.Minute
+
+func new_notifier(log Logger) *notifier {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	// Abstract namespace sockets are announced with a leading '@'.
+	if path[0] == '@' {
+		path = "\x00" + path[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		log.Warnf("sd_notify: %v", err)
+		return nil
+	}
+
+	_, watchdog := os.LookupEnv("WATCHDOG_USEC")
+	return &notifier{conn: conn, watchdog: watchdog, log: log}
+}
+
+func (n *notifier) send(state string) {
+	if n == nil {
+		return
+	}
+	if _, err := n.conn.Write([]byte(state)); err != nil {
+		n.log.Debugf("sd_notify: %v", err)
+	}
+}
+
+func (n *notifier) ready() {
+	n.send("READY=1")
+}
+
+func (n *notifier) status(format string, args ...interface{}) {
+	n.send("STATUS=" + fmt.Sprintf(format, args...))
+}
+
+// extend is sent before every batch so that a slow batch doesn't trip the
+// unit's start or watchdog timeout.
+func (n *notifier) extend() {
+	if n == nil {
+		return
+	}
+	state := "EXTEND_TIMEOUT_USEC=" + strconv.FormatInt(notifyExtendTimeout.Microseconds(), 10)
+	if n.watchdog {
+		state += "\nWATCHDOG=1"
+	}
+	n.send(state)
+}
+
+func (n *notifier) stopping() {
+	if n == nil {
+		return
+	}
+	n.send("STOPPING=1")
+	n.conn.Close()
+}
@@ -0,0 +1,204 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+// The destination's foreign keys aren't enforced while loading, so rows of
+// the source referencing rows that no longer exist, like a scenes_tags row
+// of a deleted tag, would be copied silently and break stash later. They are
+// found before migrating using the destination's foreign keys, and with
+// -prune-orphans left out: references in nullable columns become NULL, and
+// rows with references in NOT NULL columns are dropped.
+//
+// Older stash versions stored 0 for no reference in some columns, like the
+// folder_id of galleries that aren't folder based. No row has id 0, so such
+// references in nullable columns are always stored as NULL, with or without
+// -prune-orphans.
+
+const (
+	fkViolationsError = "error"
+	fkViolationsWarn  = "warn"
+)
+
+// orphanRef is a foreign key column and the referenced values that don't
+// exist, or with filtered set, that a row filter leaves out. With zero set
+// the missing value is 0 meaning none.
+type orphanRef struct {
+	fk       foreignKey
+	missing  map[string]bool
+	filtered bool
+	zero     bool
+}
+
+// orphans maps tables to their references to missing rows.
+type orphans map[string][]orphanRef
+
+// find_orphans reports the source rows of the selected tables referencing
+// missing rows, and returns the missing references of single column foreign
+// keys.
+func find_orphans(ctx context.Context, sourceDB *sqlx.DB, destDB *sqlx.DB, selected []string) (orphans, error) {
+	log := logger(ctx)
+	fks, err := load_foreign_keys(ctx, destDB)
+	if err != nil {
+		return nil, err
+	}
+	missingTables, err := missing_source_tables(ctx, sourceDB, tables)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("Checking %d foreign keys in the source...", len(fks))
+	found := orphans{}
+	for _, fk := range fks {
+		if !slices.Contains(selected, fk.table) || !slices.Contains(tables, fk.refTable) ||
+			slices.Contains(missingTables, fk.table) || slices.Contains(missingTables, fk.refTable) {
+			continue
+		}
+
+		count, err := count_orphans(ctx, sourceDB, fk)
+		if err != nil {
+			return nil, fmt.Errorf("source %w", err)
+		}
+		if count == 0 {
+			continue
+		}
+		if len(fk.columns) != 1 {
+			log.Warnf("%s: %d rows of %s reference missing %s rows", fk.name, count, fk.table, fk.refTable)
+			continue
+		}
+
+		missing, err := load_missing_refs(ctx, sourceDB, fk)
+		if err != nil {
+			return nil, err
+		}
+		if missing["0"] {
+			var zeros int64
+			query := fk.orphan_query() + " AND c." + pgx.Identifier{fk.columns[0]}.Sanitize() + " = 0"
+			if err := sourceDB.GetContext(ctx, &zeros, query); err != nil {
+				return nil, fmt.Errorf("source %s: %w", fk.name, err)
+			}
+			log.Infof("%s: %d rows of %s have %s 0 for no %s row", fk.name, zeros, fk.table, fk.columns[0], fk.refTable)
+			found[fk.table] = append(found[fk.table], orphanRef{fk: fk, missing: map[string]bool{"0": true}, zero: true})
+			delete(missing, "0")
+			count -= zeros
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		log.Warnf("%s: %d rows of %s reference missing %s rows", fk.name, count, fk.table, fk.refTable)
+		found[fk.table] = append(found[fk.table], orphanRef{fk: fk, missing: missing})
+	}
+	return found, nil
+}
+
+// zero_refs returns the references of 0 meaning none, which are stored as
+// NULL even without -prune-orphans, and whether there are others.
+func (o orphans) zero_refs() (orphans, bool) {
+	zeros := orphans{}
+	others := false
+	for table, refs := range o {
+		for _, ref := range refs {
+			if ref.zero {
+				zeros[table] = append(zeros[table], ref)
+			} else {
+				others = true
+			}
+		}
+	}
+	return zeros, others
+}
+
+// load_missing_refs returns the values of fk's column with no referent.
+func load_missing_refs(ctx context.Context, sourceDB *sqlx.DB, fk foreignKey) (map[string]bool, error) {
+	query := strings.Replace(fk.orphan_query(), "SELECT count(*)", "SELECT DISTINCT c."+pgx.Identifier{fk.columns[0]}.Sanitize(), 1)
+	rows, err := sourceDB.QueryxContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("query `%s`: %w", query, err)
+	}
+	defer rows.Close()
+
+	missing := map[string]bool{}
+	for rows.Next() {
+		var value interface{}
+		if err := rows.Scan(&value); err != nil {
+			return nil, fmt.Errorf("source %s: %w", fk.name, err)
+		}
+		missing[canonical_value(value)] = true
+	}
+	return missing, rows.Err()
+}
+
+// prune leaves the references to missing rows out of the rows of table.
+// Returns the rows that are kept.
+func (o orphans) prune(table string, rows []map[string]interface{}, columns tableColumns, opts Options, stats *tableStats) []map[string]interface{} {
+	log := opts.logger()
+	refs := o[table]
+	if len(refs) == 0 {
+		return rows
+	}
+
+	kept := rows[:0]
+	for _, row := range rows {
+		keep := true
+		filtered := false
+		for _, ref := range refs {
+			column := ref.fk.columns[0]
+			value := row[column]
+			if value == nil || !ref.missing[canonical_value(value)] {
+				continue
+			}
+
+			if ref.zero {
+				// A NOT NULL column is left to the foreign key report
+				if columns[column].nullable {
+					row[column] = nil
+					stats.zeroRefs++
+					stats.modified++
+				}
+				continue
+			}
+
+			if ref.filtered {
+				if columns[column].nullable {
+					row[column] = nil
+					stats.modified++
+					continue
+				}
+				log.Debugf("%s (%s): left out, %s %v references a filtered %s row", table, row_ident(row), column, value, ref.fk.refTable)
+				keep, filtered = false, true
+				break
+			}
+
+			stats.orphans++
+			if columns[column].nullable {
+				log.Debugf("%s (%s): %s %v references a missing %s row, stored as NULL", table, row_ident(row), column, value, ref.fk.refTable)
+				row[column] = nil
+				stats.modified++
+				continue
+			}
+			reason := fmt.Sprintf("%s %v references a missing %s row", column, value, ref.fk.refTable)
+			log.Debugf("%s (%s): dropped, %s", table, row_ident(row), reason)
+			opts.rejects.add(rejectEntry{Table: table, Row: row_ident(row), Column: column, Reason: reason})
+			keep = false
+			break
+		}
+
+		if filtered {
+			stats.filtered++
+			continue
+		}
+		if !keep {
+			stats.skipped++
+			continue
+		}
+		kept = append(kept, row)
+	}
+	return kept
+}
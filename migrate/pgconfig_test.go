@@ -0,0 +1,137 @@
+package migrate
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestApplyHost(t *testing.T) {
+	tests := []struct {
+		connector string
+		p         PgOptions
+		want      string
+	}{
+		{"postgres://stash@db:5433/stash", PgOptions{Host: "other"}, "postgres://stash@other:5433/stash"},
+		{"postgres://stash@db/stash", PgOptions{Port: 5433}, "postgres://stash@db:5433/stash"},
+		{"postgres://stash@db:5433/stash", PgOptions{Host: "::1"}, "postgres://stash@[::1]:5433/stash"},
+		{"postgres://stash@db/stash", PgOptions{Host: "::1"}, "postgres://stash@[::1]/stash"},
+		{"postgres://stash@[::1]/stash", PgOptions{Port: 5433}, "postgres://stash@[::1]:5433/stash"},
+		{"postgres://stash@db/stash", PgOptions{Host: "fe80::1", Port: 5433}, "postgres://stash@[fe80::1]:5433/stash"},
+		{"postgres://stash@db/stash", PgOptions{Host: "/var/run/postgresql"}, "postgres://stash@db/stash?host=%2Fvar%2Frun%2Fpostgresql"},
+		{"dbname=stash", PgOptions{Host: "::1", Port: 5433}, "dbname=stash host='::1' port='5433'"},
+	}
+	for _, test := range tests {
+		got, err := test.p.apply(test.connector)
+		if err != nil {
+			t.Errorf("apply(%s): %v", test.connector, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("apply(%s) = %s, want %s", test.connector, got, test.want)
+		}
+		if _, err := parse_connector(got); err != nil {
+			t.Errorf("%s doesn't parse: %v", got, err)
+		}
+	}
+}
+
+// write_passfile writes a password file and points PGPASSFILE at it, with
+// PGPASSWORD empty, which pgx and check_password take as unset.
+func write_passfile(t *testing.T, mode os.FileMode, lines string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "pgpass")
+	if err := os.WriteFile(path, []byte(lines), mode); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PGPASSFILE", path)
+	t.Setenv("PGPASSWORD", "")
+}
+
+func TestPassfileMatching(t *testing.T) {
+	write_passfile(t, 0600, `# a comment
+db:5432:stash:stash:first
+db:5432:stash:stash:second
+*:5432:stash:other:wildcard host
+db:*:*:admin:wildcard port and database
+db\:1:5432:stash:stash:escaped colon
+db:5432:stash:colon:pass\:word
+`)
+	tests := []struct {
+		connector string
+		want      string
+	}{
+		// The first matching line wins
+		{"postgres://stash@db:5432/stash", "first"},
+		{"postgres://other@anywhere:5432/stash", "wildcard host"},
+		{"postgres://admin@db:6000/things", "wildcard port and database"},
+		{"postgres://colon@db:5432/stash", "pass:word"},
+		// Each field must match
+		{"postgres://stash@db:5433/stash", ""},
+		{"postgres://stash@db:5432/things", ""},
+		{"postgres://nobody@db:5432/stash", ""},
+		{"postgres://stash@elsewhere:5432/stash", ""},
+	}
+	for _, test := range tests {
+		config, err := parse_connector(test.connector)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check_password(test.connector, config, log)
+		if config.Password != test.want {
+			t.Errorf("%s: password %q, want %q", test.connector, config.Password, test.want)
+		}
+	}
+}
+
+func TestPasswordPrecedence(t *testing.T) {
+	write_passfile(t, 0600, "*:*:*:*:from the file\n")
+
+	config, err := parse_connector("postgres://stash@db/stash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Password != "from the file" {
+		t.Errorf("without PGPASSWORD: password %q, want the file's", config.Password)
+	}
+
+	t.Setenv("PGPASSWORD", "from the environment")
+	config, err = parse_connector("postgres://stash@db/stash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Password != "from the environment" {
+		t.Errorf("with PGPASSWORD: password %q, want PGPASSWORD", config.Password)
+	}
+
+	for _, connector := range []string{"postgres://stash:given@db/stash", "host=db user=stash password=given"} {
+		config, err = parse_connector(connector)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check_password(connector, config, log)
+		if config.Password != "given" {
+			t.Errorf("%s: password %q, want the connector's", connector, config.Password)
+		}
+	}
+}
+
+// TestPassfileTooOpen checks that, like libpq, a password file others can
+// read is ignored.
+func TestPassfileTooOpen(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no file permissions")
+	}
+	write_passfile(t, 0644, "*:*:*:*:secret\n")
+
+	connector := "postgres://stash@db/stash"
+	config, err := parse_connector(connector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check_password(connector, config, log)
+	if config.Password != "" {
+		t.Errorf("password %q read from a world readable file", config.Password)
+	}
+}
@@ -0,0 +1,114 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Before the first write, the migration prints what it is about to do and
+// where, and asks for a go-ahead unless -yes is given. The point is the
+// destination line: a pasted production connection string is easier to
+// catch there than in the log of a finished run.
+
+// plannedRowsPerSecond is the rate the duration estimate assumes, a modest
+// one for a destination on another machine. The per-table throughput in
+// the log of a real run gives a better figure.
+const plannedRowsPerSecond = 20000
+
+// schema_version reads the stash schema version of a database from the
+// table golang-migrate keeps it in, sqlite or postgres alike. dirty is set
+// when an upgrade failed halfway.
+func schema_version(ctx context.Context, db *sqlx.DB) (version int64, dirty bool, err error) {
+	if err := db.QueryRowxContext(ctx, "SELECT version, dirty FROM schema_migrations").Scan(&version, &dirty); err != nil {
+		return 0, false, fmt.Errorf("schema version: %w", err)
+	}
+	return version, dirty, nil
+}
+
+// source_schema_version describes the stash schema version of the source.
+func source_schema_version(ctx context.Context, sourceDB *sqlx.DB) (string, error) {
+	version, dirty, err := schema_version(ctx, sourceDB)
+	if err != nil {
+		return "", err
+	}
+	if dirty {
+		return fmt.Sprintf("%d (dirty, an upgrade failed halfway)", version), nil
+	}
+	return strconv.FormatInt(version, 10), nil
+}
+
+// describe_dest names the destination database for the user, without the
+// password: the host as given, and the database and role as the server
+// reports them.
+func describe_dest(ctx context.Context, destDB *sqlx.DB, connector string) string {
+	log := logger(ctx)
+	var database, user string
+	if err := destDB.QueryRowxContext(ctx, "SELECT current_database(), current_user").Scan(&database, &user); err != nil {
+		log.Debugf("dest description: %v", err)
+	}
+
+	host := "?"
+	if config, err := parse_connector(connector); err == nil {
+		host = config.Host
+		if !strings.HasPrefix(host, "/") {
+			host += ":" + strconv.Itoa(int(config.Port))
+		}
+	} else {
+		var addr *string
+		if err := destDB.GetContext(ctx, &addr, "SELECT host(inet_server_addr()) || ':' || inet_server_port()"); err == nil {
+			host = "unix socket"
+			if addr != nil {
+				host = *addr
+			}
+		}
+	}
+	return fmt.Sprintf("database %s on %s as %s", database, host, user)
+}
+
+// confirm_plan prints the summary of the migration and asks whether to go
+// ahead. Nothing is asked with -yes or a dry run, nor when nobody can
+// answer, for scripted runs.
+func confirm_plan(ctx context.Context, sourceDB *sqlx.DB, destDB *sqlx.DB, connector string, tables []string, totalRows int64, opts Options) error {
+	log := logger(ctx)
+	source := opts.SQLite
+	if source == "" {
+		source = "(open database)"
+	} else if info, err := os.Stat(source); err == nil {
+		source = fmt.Sprintf("%s (%d MB)", source, info.Size()>>20)
+	}
+	version, err := source_schema_version(ctx, sourceDB)
+	if err != nil {
+		version = "unknown"
+		log.Debugf("%v", err)
+	}
+
+	log.Infof("About to migrate:")
+	log.Infof("  from   %s, stash schema %s", source, version)
+	log.Infof("  into   %s", describe_dest(ctx, destDB, connector))
+	log.Infof("  tables %d, %d rows, roughly %s", len(tables), totalRows,
+		(time.Duration(totalRows) * time.Second / plannedRowsPerSecond).Round(time.Second))
+	var modes []string
+	if opts.Clean {
+		modes = append(modes, "-clean: the destination tables are emptied first")
+	}
+	if opts.Force {
+		modes = append(modes, "-force: rows already in the destination are kept")
+	}
+	for _, mode := range modes {
+		log.Warnf("  %s", mode)
+	}
+
+	if opts.Yes || opts.DryRun || opts.Confirm == nil {
+		return nil
+	}
+	if !opts.Confirm("Start the migration?") {
+		return fmt.Errorf("the migration was not confirmed")
+	}
+	return nil
+}
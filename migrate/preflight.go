@@ -0,0 +1,408 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jmoiron/sqlx"
+)
+
+// entity_tables are the tables that hold a library's actual content. A stash
+// can be made of any of them: image-only libraries have no scenes at all.
+var entity_tables = []string{
+	"scenes",
+	"images",
+	"galleries",
+	"groups",
+	"performers",
+	"studios",
+	"tags",
+	"files",
+}
+
+// check_source_not_empty refuses to migrate a database that has no content
+// in any entity table, which usually means the wrong file was given. Tables
+// older stash versions lack, like groups, don't count.
+func check_source_not_empty(ctx context.Context, sourceDB *sqlx.DB) error {
+	log := logger(ctx)
+	missing, err := missing_source_tables(ctx, sourceDB, entity_tables)
+	if err != nil {
+		return err
+	}
+	var counts []string
+	var total int64
+	for _, table := range entity_tables {
+		if slices.Contains(missing, table) {
+			continue
+		}
+		count, err := count_rows(ctx, sourceDB, anon_dialect, table)
+		if err != nil {
+			return classify(ErrSource, fmt.Errorf("source %w", err))
+		}
+		total += count
+		counts = append(counts, fmt.Sprintf("%s=%d", table, count))
+	}
+
+	log.Infof("Source contains %s", strings.Join(counts, ", "))
+	if total == 0 {
+		return classify(ErrSource, fmt.Errorf("source database has no rows in any of %s", strings.Join(entity_tables, ", ")))
+	}
+	return nil
+}
+
+// sqliteHeader starts every sqlite 3 database file.
+const sqliteHeader = "SQLite format 3\x00"
+
+// check_sqlite_file makes sure path is a sqlite database before it is
+// opened: sqlite itself only finds out with the first query, and creates
+// missing files.
+func check_sqlite_file(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return classify(ErrSource, err)
+	}
+	defer file.Close()
+
+	header := make([]byte, len(sqliteHeader))
+	if _, err := io.ReadFull(file, header); err != nil || string(header) != sqliteHeader {
+		if info, statErr := file.Stat(); statErr == nil && info.IsDir() {
+			return classify(ErrSource, fmt.Errorf("%s is a directory, not a sqlite database", path))
+		}
+		return classify(ErrSource, fmt.Errorf("%s is not a sqlite database", path))
+	}
+	return nil
+}
+
+// CheckSource reports whether path is a sqlite database, for callers to
+// ask again about a mistyped path before starting.
+func CheckSource(path string) error {
+	return check_sqlite_file(path)
+}
+
+// CheckConnector connects to the postgres database connector and the Pg
+// options name, for callers to ask again about a mistyped one before
+// starting. With CreateDB the database may not exist yet, so the connector
+// is only parsed.
+func (o Options) CheckConnector(ctx context.Context, connector string) error {
+	connector, err := o.Pg.apply(connector)
+	if err != nil {
+		return err
+	}
+	if o.CreateDB {
+		_, err := parse_connector(connector)
+		return err
+	}
+	db, err := open_pgsql(ctx, connector, false, o.Pg.PgBouncer)
+	if err != nil {
+		return err
+	}
+	return db.Close()
+}
+
+// check_source_integrity runs quick_check on the source, or the full
+// integrity_check when deep is set, so a corrupt file is found before the
+// migration rather than as a read error hours into it.
+func check_source_integrity(ctx context.Context, sourceDB *sqlx.DB, deep bool, ignore bool) error {
+	log := logger(ctx)
+	pragma := "quick_check"
+	if deep {
+		pragma = "integrity_check"
+	}
+
+	log.Infof("Running %s on the source", pragma)
+	start := time.Now()
+	var results []string
+	if err := sourceDB.SelectContext(ctx, &results, "PRAGMA "+pragma); err != nil {
+		return classify(ErrSource, fmt.Errorf("source %s: %w", pragma, err))
+	}
+	elapsed := time.Since(start).Round(time.Millisecond)
+
+	if len(results) == 1 && results[0] == "ok" {
+		log.Infof("Source %s passed in %s", pragma, elapsed)
+		return nil
+	}
+
+	problems := strings.Join(results, "\n  ")
+	if ignore {
+		log.Warnf("Source %s found problems in %s, continuing anyway:\n  %s", pragma, elapsed, problems)
+		return nil
+	}
+	return classify(ErrSource, fmt.Errorf("source %s found problems (use -ignore-integrity to migrate anyway):\n  %s", pragma, problems))
+}
+
+// minServerVersion is the oldest postgres stash supports, as
+// server_version_num.
+const minServerVersion = 120000
+
+// required_extensions are the extensions stash's postgres schema uses,
+// which must at least be installable.
+var required_extensions = []string{"pg_trgm"}
+
+// check_dest_server fails early on a server stash would refuse later, after
+// a successful migration.
+func check_dest_server(ctx context.Context, destDB *sqlx.DB) error {
+	var version int
+	if err := destDB.GetContext(ctx, &version, "SELECT current_setting('server_version_num')::int"); err != nil {
+		return fmt.Errorf("server version: %w", err)
+	}
+	if version < minServerVersion {
+		return fmt.Errorf("postgres %d.%d is too old for stash, it needs %d or later", version/10000, version%10000, minServerVersion/10000)
+	}
+
+	var missing []string
+	for _, extension := range required_extensions {
+		var available bool
+		if err := destDB.GetContext(ctx, &available, "SELECT EXISTS (SELECT 1 FROM pg_available_extensions WHERE name = $1)", extension); err != nil {
+			return fmt.Errorf("available extensions: %w", err)
+		}
+		if !available {
+			missing = append(missing, extension)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("the server can't install the extensions stash needs: %s (usually in the postgresql-contrib package)", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// check_dest_privileges tests everything the migration will need to do on
+// the destination and reports all that is missing at once, rather than
+// failing with the first in the middle of a run.
+func check_dest_privileges(ctx context.Context, destDB *sqlx.DB, tables []string, opts Options) error {
+	var missing []string
+
+	// Changing it takes superuser, or since postgres 15 a grant
+	txn, err := destDB.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("dest begin tx: %w", err)
+	}
+	_, err = txn.ExecContext(ctx, "SET LOCAL session_replication_role = replica")
+	txn.Rollback()
+	if err != nil {
+		missing = append(missing, fmt.Sprintf("set session_replication_role (%v)", err))
+	}
+
+	// has_table_privilege is true when any one of a list is held, so each
+	// privilege is asked for on its own
+	privileges := []string{"INSERT"}
+	if opts.Clean {
+		privileges = append(privileges, "TRUNCATE")
+	}
+	if opts.OnConflict == onConflictUpdate || opts.Since != "" {
+		privileges = append(privileges, "UPDATE")
+	}
+	var insertable []string
+	for _, table := range tables {
+		for _, privilege := range privileges {
+			var ok bool
+			err := destDB.GetContext(ctx, &ok, "SELECT has_table_privilege($1, $2)", pgx.Identifier{table}.Sanitize(), privilege)
+			if err != nil {
+				return fmt.Errorf("check privileges on %s: %w", table, err)
+			}
+			if !ok {
+				missing = append(missing, fmt.Sprintf("%s on %s", privilege, table))
+			} else if privilege == "INSERT" {
+				insertable = append(insertable, table)
+			}
+		}
+	}
+	denied, err := probe_inserts(ctx, destDB, insertable)
+	if err != nil {
+		return err
+	}
+	missing = append(missing, denied...)
+
+	sequences, err := discover_sequences(ctx, destDB)
+	if err != nil {
+		return err
+	}
+	for _, s := range sequences {
+		if !slices.Contains(tables, s.table) {
+			continue
+		}
+		var ok bool
+		if err := destDB.GetContext(ctx, &ok, "SELECT has_sequence_privilege($1, 'UPDATE')", s.sequence); err != nil {
+			return fmt.Errorf("check privileges on %s: %w", s.sequence, err)
+		}
+		if !ok {
+			missing = append(missing, "setval on "+s.sequence)
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("the destination role lacks privileges:\n  %s", strings.Join(missing, "\n  "))
+	}
+	return nil
+}
+
+// probe_inserts inserts into each table in a transaction that is rolled
+// back, catching what has_table_privilege doesn't see, like row security
+// policies. The insert adds no rows, but postgres checks it all the same.
+func probe_inserts(ctx context.Context, destDB *sqlx.DB, tables []string) ([]string, error) {
+	log := logger(ctx)
+	txn, err := destDB.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("dest begin tx: %w", err)
+	}
+	defer txn.Rollback()
+
+	var denied []string
+	for _, table := range tables {
+		if _, err := txn.ExecContext(ctx, "SAVEPOINT probe_insert"); err != nil {
+			return nil, fmt.Errorf("probe insert into %s: %w", table, err)
+		}
+		name := pgx.Identifier{table}.Sanitize()
+		_, err := txn.ExecContext(ctx, "INSERT INTO "+name+" SELECT (NULL::"+name+").* WHERE false")
+		if err == nil {
+			continue
+		}
+		// Anything else, like a generated column, is for the migration to
+		// report on the rows
+		if is_insufficient_privilege(err) {
+			denied = append(denied, fmt.Sprintf("INSERT on %s (%v)", table, err))
+		} else {
+			log.Debugf("Probe insert into %s: %v", table, err)
+		}
+		if _, err := txn.ExecContext(ctx, "ROLLBACK TO SAVEPOINT probe_insert"); err != nil {
+			return nil, fmt.Errorf("probe insert into %s: %w", table, err)
+		}
+	}
+	return denied, nil
+}
+
+func is_insufficient_privilege(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "42501"
+}
+
+// check_dest_schema verifies that -pg-schema names an existing schema, as
+// postgres silently skips missing schemas in the search_path.
+func check_dest_schema(ctx context.Context, destDB *sqlx.DB, schema string) error {
+	var current *string
+	if err := destDB.GetContext(ctx, &current, "SELECT current_schema()"); err != nil {
+		return fmt.Errorf("current schema: %w", err)
+	}
+	if current == nil || *current != schema {
+		return classify(ErrSchema, fmt.Errorf("schema %q does not exist in the destination database", schema))
+	}
+	return nil
+}
+
+// stash_signature_tables are in every stash database, whatever its
+// version, and tell one from other sqlite files.
+var stash_signature_tables = []string{"schema_migrations", "scenes", "performers", "tags"}
+
+// check_stash_database refuses a sqlite database stash didn't create, and
+// logs the schema version of one it did.
+func check_stash_database(ctx context.Context, db *sqlx.DB, what string) error {
+	log := logger(ctx)
+	missing, err := missing_source_tables(ctx, db, stash_signature_tables)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return classify(ErrSource, fmt.Errorf("the %s isn't a stash database, it lacks the tables %s", what, strings.Join(missing, ", ")))
+	}
+	version, err := source_schema_version(ctx, db)
+	if err != nil {
+		return classify(ErrSource, fmt.Errorf("%s %w", what, err))
+	}
+	log.Infof("The %s is a stash database at schema version %s", what, version)
+	return nil
+}
+
+// missing_source_tables lists the tables that don't exist in the source.
+func missing_source_tables(ctx context.Context, sourceDB *sqlx.DB, tables []string) ([]string, error) {
+	var missing []string
+	for _, table := range tables {
+		var exists bool
+		err := sourceDB.GetContext(ctx, &exists, "SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = ?)", table)
+		if err != nil {
+			return nil, classify(ErrSource, fmt.Errorf("source tables: %w", err))
+		}
+		if !exists {
+			missing = append(missing, table)
+		}
+	}
+	return missing, nil
+}
+
+// check_dest_empty refuses to load into tables that already hold data, as
+// happens when the tool is accidentally run twice, unless the user confirms.
+func check_dest_empty(ctx context.Context, destDB *sqlx.DB, tables []string, opts Options) error {
+	log := logger(ctx)
+	var nonEmpty []string
+	for _, table := range tables {
+		var exists bool
+		sql := "SELECT EXISTS (SELECT 1 FROM " + pgx.Identifier{table}.Sanitize() + ")"
+		if err := destDB.GetContext(ctx, &exists, sql); err != nil {
+			return fmt.Errorf("dest check %s: %w", table, err)
+		}
+		if exists {
+			nonEmpty = append(nonEmpty, table)
+		}
+	}
+	if len(nonEmpty) == 0 {
+		return nil
+	}
+
+	log.Warnf("Destination tables already contain data: %s", strings.Join(nonEmpty, ", "))
+	if opts.Confirm != nil && opts.Confirm(fmt.Sprintf("Destination contains data in %d tables, continue?", len(nonEmpty))) {
+		return nil
+	}
+	return fmt.Errorf("destination is not empty, use --clean to empty it first, --force to migrate anyway or --resume to continue a previous run")
+}
+
+func truncate_statement(selected []string, cascade bool) string {
+	quoted := make([]string, len(selected))
+	for i, table := range selected {
+		quoted[i] = pgx.Identifier{table}.Sanitize()
+	}
+	sql := "TRUNCATE " + strings.Join(quoted, ", ") + " RESTART IDENTITY"
+	if cascade {
+		sql += " CASCADE"
+	}
+	return sql
+}
+
+// clean_dest empties the tables the migration writes to, in a single
+// TRUNCATE so that foreign keys between them don't get in the way, and
+// restarts their sequences. cascade is set when every table was selected:
+// the ones left out for missing from the source still reference the
+// others, and are emptied along with them. Otherwise other
+// tables are never touched, and postgres refuses to truncate tables that
+// others still reference.
+func clean_dest(ctx context.Context, destDB *sqlx.DB, selected []string, cascade bool, opts Options) error {
+	log := logger(ctx)
+	sql := truncate_statement(selected, cascade)
+	log.Warnf("--clean will delete all rows of: %s", strings.Join(selected, ", "))
+	if cascade && len(selected) < len(tables) {
+		log.Warnf("--clean will also delete the rows of the tables referencing them")
+	}
+	if opts.DryRun {
+		log.Infof("Dry run, not truncating")
+		return nil
+	}
+	if !opts.Yes {
+		if opts.Confirm == nil {
+			return fmt.Errorf("--clean needs confirmation, use --yes when not running interactively")
+		}
+		if !opts.Confirm(fmt.Sprintf("Truncate %d destination tables?", len(selected))) {
+			return fmt.Errorf("truncating the destination was not confirmed")
+		}
+	}
+
+	if _, err := destDB.ExecContext(ctx, sql); err != nil {
+		return fmt.Errorf("dest truncate: %w", err)
+	}
+	log.Infof("Truncated %d destination tables", len(selected))
+	return nil
+}
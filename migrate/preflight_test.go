@@ -0,0 +1,99 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+)
+
+// entity_schema creates the entity tables, reduced to what the checks look
+// at.
+var entity_schema = []string{
+	"CREATE TABLE scenes (id INTEGER PRIMARY KEY, title TEXT)",
+	"CREATE TABLE images (id INTEGER PRIMARY KEY, title TEXT)",
+	"CREATE TABLE galleries (id INTEGER PRIMARY KEY, title TEXT)",
+	"CREATE TABLE groups (id INTEGER PRIMARY KEY, name TEXT)",
+	"CREATE TABLE performers (id INTEGER PRIMARY KEY, name TEXT)",
+	"CREATE TABLE studios (id INTEGER PRIMARY KEY, name TEXT)",
+	"CREATE TABLE tags (id INTEGER PRIMARY KEY, name TEXT)",
+	"CREATE TABLE files (id INTEGER PRIMARY KEY, basename TEXT)",
+	"CREATE TABLE images_files (image_id INTEGER, file_id INTEGER)",
+}
+
+// image_only_fixture is a library of images alone: no scenes, performers,
+// studios or tags.
+var image_only_fixture = slices.Concat(entity_schema, []string{
+	"INSERT INTO files (id, basename) VALUES (1, 'a.jpg'), (2, 'b.png')",
+	"INSERT INTO images (id, title) VALUES (1, 'a'), (2, 'b')",
+	"INSERT INTO images_files (image_id, file_id) VALUES (1, 1), (2, 2)",
+})
+
+func TestSourceNotEmpty(t *testing.T) {
+	db := open_test_source(t, image_only_fixture...)
+	if err := check_source_not_empty(context.Background(), db); err != nil {
+		t.Errorf("image-only library: %v", err)
+	}
+
+	// Content in any one entity table is enough
+	for _, table := range entity_tables {
+		db := open_test_source(t, slices.Concat(entity_schema, []string{"INSERT INTO " + table + " (id) VALUES (1)"})...)
+		if err := check_source_not_empty(context.Background(), db); err != nil {
+			t.Errorf("%s only: %v", table, err)
+		}
+	}
+}
+
+func TestSourceEmpty(t *testing.T) {
+	tests := []struct {
+		name       string
+		statements []string
+	}{
+		{"no rows", entity_schema},
+		// Rows outside the entity tables don't count
+		{"join rows only", slices.Concat(entity_schema, []string{"INSERT INTO images_files VALUES (1, 1)"})},
+		// An older stash without groups
+		{"no groups table", slices.DeleteFunc(slices.Clone(entity_schema), func(sql string) bool {
+			return sql == "CREATE TABLE groups (id INTEGER PRIMARY KEY, name TEXT)"
+		})},
+		{"not a stash", []string{"CREATE TABLE notes (id INTEGER PRIMARY KEY)", "INSERT INTO notes VALUES (1)"}},
+	}
+	for _, test := range tests {
+		db := open_test_source(t, test.statements...)
+		if err := check_source_not_empty(context.Background(), db); !errors.Is(err, ErrSource) {
+			t.Errorf("%s: %v, want a source error", test.name, err)
+		}
+	}
+}
+
+func TestMissingSourceTables(t *testing.T) {
+	db := open_test_source(t,
+		"CREATE TABLE performers (id INTEGER PRIMARY KEY, name TEXT)",
+		"CREATE TABLE tags (id INTEGER PRIMARY KEY, name TEXT)",
+	)
+	missing, err := missing_source_tables(context.Background(), db, []string{"performer_custom_fields", "performers", "tags"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(missing, []string{"performer_custom_fields"}) {
+		t.Errorf("missing = %v, want [performer_custom_fields]", missing)
+	}
+}
+
+func TestTruncateStatement(t *testing.T) {
+	tests := []struct {
+		selected []string
+		cascade  bool
+		want     string
+	}{
+		{[]string{"performers", "tags"}, false, `TRUNCATE "performers", "tags" RESTART IDENTITY`},
+		// A source without performer_custom_fields still truncates what
+		// references the tables
+		{[]string{"performers", "tags"}, true, `TRUNCATE "performers", "tags" RESTART IDENTITY CASCADE`},
+	}
+	for _, test := range tests {
+		if got := truncate_statement(test.selected, test.cascade); got != test.want {
+			t.Errorf("truncate_statement(%v, %v) = %s, want %s", test.selected, test.cascade, got, test.want)
+		}
+	}
+}
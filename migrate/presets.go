@@ -0,0 +1,70 @@
+package migrate
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// presets bundle settings for the two things most people want: a careful
+// migration that checks everything, or a quick one. A preset only supplies
+// defaults, flags given on the command line or in a config file win.
+var presets = map[string][][2]string{
+	"safe": {
+		{"verify", verifyChecksum},
+		{"oversize", oversizeFail},
+		{"continue-on-error", "false"},
+		{"retries", "5"},
+		{"batch-timeout", "1m"},
+		{"blob-fsync", fsyncFile},
+		{"blob-workers", "2"},
+	},
+	"fast": {
+		{"verify", verifyCount},
+		{"batch-size", "5000"},
+		{"retries", "3"},
+		{"blob-fsync", fsyncDir},
+		{"blob-workers", "8"},
+		{"fast", "true"},
+	},
+}
+
+func preset_names() string {
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// ApplyPreset sets the preset's values for every flag of fs that wasn't
+// set explicitly. It returns what the preset expanded to, for the caller to
+// log once the log, and -log-file, are set up.
+func ApplyPreset(fs *flag.FlagSet, name string) (string, error) {
+	values, ok := presets[name]
+	if !ok {
+		return "", fmt.Errorf("unknown -preset %q, expected one of %s", name, preset_names())
+	}
+
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		if s := find_setting(f.Name); s != nil {
+			explicit[s.name] = true
+		}
+	})
+
+	var expanded []string
+	for _, v := range values {
+		if explicit[v[0]] {
+			expanded = append(expanded, fmt.Sprintf("%s=%s (overridden)", v[0], fs.Lookup(v[0]).Value))
+			continue
+		}
+		if err := fs.Set(v[0], v[1]); err != nil {
+			return "", fmt.Errorf("preset %s: %s: %w", name, v[0], err)
+		}
+		expanded = append(expanded, v[0]+"="+v[1])
+	}
+	return strings.Join(expanded, ", "), nil
+}
@@ -0,0 +1,51 @@
+package migrate
+
+import (
+	"flag"
+	"strings"
+	"testing"
+)
+
+// TestPresets checks that every preset only uses existing settings with
+// values they accept, so that the presets can't drift from the flags.
+func TestPresets(t *testing.T) {
+	for name, values := range presets {
+		var o Options
+		fs := flag.NewFlagSet(name, flag.ContinueOnError)
+		BindFlags(fs, &o)
+		for _, v := range values {
+			s := find_setting(v[0])
+			if s == nil || s.name != v[0] {
+				t.Errorf("preset %s: no setting %s", name, v[0])
+				continue
+			}
+			if err := fs.Set(v[0], v[1]); err != nil {
+				t.Errorf("preset %s: %s: %v", name, v[0], err)
+			}
+		}
+	}
+}
+
+func TestApplyPreset(t *testing.T) {
+	var o Options
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	BindFlags(fs, &o)
+	if err := fs.Parse([]string{"-retries", "9"}); err != nil {
+		t.Fatal(err)
+	}
+
+	expanded, err := ApplyPreset(fs, "safe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Retries != 9 || o.Verify != verifyChecksum {
+		t.Errorf("retries = %d, verify = %s, want the explicit 9 and the preset's %s", o.Retries, o.Verify, verifyChecksum)
+	}
+	if !strings.Contains(expanded, "retries=9 (overridden)") || !strings.Contains(expanded, "verify="+verifyChecksum) {
+		t.Errorf("expanded to %s", expanded)
+	}
+
+	if _, err := ApplyPreset(fs, "reckless"); err == nil {
+		t.Errorf("unknown preset accepted")
+	}
+}
@@ -0,0 +1,91 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Provenance is recorded in a sidecar table so that rows can be traced back
+// to the database they were migrated from, which is what makes a merged
+// library diagnosable after the fact.
+const provenance_table = "_migration_provenance"
+
+const create_provenance = `
+CREATE TABLE IF NOT EXISTS _migration_provenance (
+	dest_table   text   NOT NULL,
+	new_id       bigint NOT NULL,
+	source_label text   NOT NULL,
+	original_id  bigint NOT NULL,
+	PRIMARY KEY (dest_table, new_id)
+);
+`
+
+// default_source_label derives a label from the source file name, so
+// "/data/stash-go.sqlite" becomes "stash-go".
+func default_source_label(dbpath string) string {
+	base := filepath.Base(dbpath)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+func create_provenance_table(ctx context.Context, db *sqlx.DB) error {
+	if _, err := db.ExecContext(ctx, create_provenance); err != nil {
+		return fmt.Errorf("create %s: %w", provenance_table, err)
+	}
+	return nil
+}
+
+// record_provenance inserts one provenance row for every row of the batch
+// that has an id column. Until ids are remapped by a merge, the new id is the
+// original id.
+func record_provenance(ctx context.Context, txn *sqlx.Tx, table string, label string, rows []map[string]interface{}) error {
+	var values []string
+	var args []interface{}
+	for _, row := range rows {
+		id, ok := row["id"].(int64)
+		if !ok {
+			continue
+		}
+		n := len(args)
+		values = append(values, fmt.Sprintf("($%d, $%d, $%d, $%d)", n+1, n+2, n+3, n+4))
+		args = append(args, table, id, label, id)
+	}
+	if len(values) == 0 {
+		return nil
+	}
+
+	sql := "INSERT INTO " + provenance_table + " (dest_table, new_id, source_label, original_id) VALUES " +
+		strings.Join(values, ", ") + " ON CONFLICT (dest_table, new_id) DO NOTHING"
+	if _, err := txn.ExecContext(ctx, sql, args...); err != nil {
+		return fmt.Errorf("record provenance for %s: %w", table, err)
+	}
+	return nil
+}
+
+// report_provenance prints how many rows each source contributed per table.
+func report_provenance(ctx context.Context, db *sqlx.DB) error {
+	log := logger(ctx)
+	rows, err := db.QueryxContext(ctx, `
+SELECT source_label, dest_table, count(*)
+FROM _migration_provenance
+GROUP BY source_label, dest_table
+ORDER BY source_label, dest_table`)
+	if err != nil {
+		return fmt.Errorf("query provenance: %w", err)
+	}
+	defer rows.Close()
+
+	log.Infof("Provenance by source:")
+	for rows.Next() {
+		var label, table string
+		var count int64
+		if err := rows.Scan(&label, &table, &count); err != nil {
+			return fmt.Errorf("scan provenance: %w", err)
+		}
+		log.Infof("  %-20s %-24s %d", label, table, count)
+	}
+	return rows.Err()
+}
@@ -0,0 +1,56 @@
+package migrate
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// rejectEntry describes a row that was not migrated and why.
+type rejectEntry struct {
+	Table string `json:"table"`
+	Row   string `json:"row"`
+	// Name is the row's name, for rows like saved filters that are easier
+	// to recreate than to find by key.
+	Name   string `json:"name,omitempty"`
+	Column string `json:"column,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// rejectFile appends one JSON object per rejected row. A nil *rejectFile
+// discards everything, so callers never have to check whether one was given.
+type rejectFile struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+	log  Logger
+}
+
+func open_reject_file(path string, log Logger) (*rejectFile, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open reject file: %w", err)
+	}
+	return &rejectFile{file: file, enc: json.NewEncoder(file), log: log}, nil
+}
+
+func (r *rejectFile) add(entry rejectEntry) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.enc.Encode(entry); err != nil {
+		r.log.Warnf("write reject file: %v", err)
+	}
+}
+
+func (r *rejectFile) close() error {
+	if r == nil {
+		return nil
+	}
+	return r.file.Close()
+}
@@ -0,0 +1,235 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+// The repair command runs the checks and fixes that don't need the SQLite
+// source against an existing destination, typically one loaded by another
+// tool. Only sequence resets and ANALYZE write anything; the rest is
+// reported, with SQL to fix it where that can be generated.
+
+func open_repair_dest(ctx context.Context, opts Options) (*sqlx.DB, func() error, error) {
+	connector, err := opts.Pg.apply(opts.Postgres)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	destDB, closeDest, err := open_dest(ctx, connector, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	if opts.Pg.Schema != "" {
+		if err := check_dest_schema(ctx, destDB, opts.Pg.Schema); err != nil {
+			closeDest()
+			return nil, nil, err
+		}
+	}
+	return destDB, closeDest, nil
+}
+
+// fix_sequences only resets the sequences, for databases migrated by
+// versions of this tool that missed some. It is safe on a live database.
+func fix_sequences(ctx context.Context, opts Options) error {
+	destDB, closeDest, err := open_repair_dest(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer closeDest()
+
+	return repair_sequences(ctx, destDB, opts.DryRun)
+}
+
+func repair(ctx context.Context, opts Options) error {
+	log := logger(ctx)
+	destDB, closeDest, err := open_repair_dest(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer closeDest()
+
+	if err := repair_sequences(ctx, destDB, opts.DryRun); err != nil {
+		return err
+	}
+	if err := check_boolean_columns(ctx, destDB); err != nil {
+		return err
+	}
+	if err := scan_timestamps(ctx, destDB); err != nil {
+		return err
+	}
+	if _, err := report_orphans(ctx, destDB); err != nil {
+		return err
+	}
+
+	if opts.DryRun {
+		return nil
+	}
+	if opts.GrantTo != "" {
+		present, err := dest_tables(ctx, destDB)
+		if err != nil {
+			return err
+		}
+		if err := grant_privileges(ctx, destDB, opts.GrantTo, present); err != nil {
+			return err
+		}
+	}
+	log.Infof("Analyzing...")
+	start := time.Now()
+	if _, err := destDB.ExecContext(ctx, "ANALYZE"); err != nil {
+		return fmt.Errorf("analyze: %w", err)
+	}
+	log.Infof("Analyzed in %s", time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// analyze_tables gives the planner statistics for the migrated tables,
+// which autovacuum would take hours to collect on large ones, and records
+// their size on disk.
+func analyze_tables(ctx context.Context, destDB *sqlx.DB, rep *Report) error {
+	log := logger(ctx)
+	log.Infof("Analyzing...")
+	start := time.Now()
+	for _, t := range rep.tables {
+		if !t.committed {
+			continue
+		}
+		table := pgx.Identifier{t.table}.Sanitize()
+		if _, err := destDB.ExecContext(ctx, "ANALYZE "+table); err != nil {
+			return fmt.Errorf("analyze %s: %w", t.table, err)
+		}
+		if err := destDB.GetContext(ctx, &t.destSize, "SELECT pg_total_relation_size($1)", table); err != nil {
+			return fmt.Errorf("size of %s: %w", t.table, err)
+		}
+	}
+	rep.analyzeTime = time.Since(start)
+	log.Infof("Analyzed in %s", rep.analyzeTime.Round(time.Millisecond))
+	return nil
+}
+
+func repair_sequences(ctx context.Context, destDB *sqlx.DB, dryRun bool) error {
+	log := logger(ctx)
+	sequences, err := discover_sequences(ctx, destDB)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Resetting %d sequences...", len(sequences))
+	for _, s := range sequences {
+		txn, err := destDB.BeginTxx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("dest begin tx: %w", err)
+		}
+
+		before, after, err := reset_sequence(ctx, txn, s)
+		if err != nil {
+			txn.Rollback()
+			return err
+		}
+
+		if dryRun {
+			txn.Rollback()
+		} else if err := txn.Commit(); err != nil {
+			return fmt.Errorf("commit: %w", err)
+		}
+
+		mark := ""
+		if before != after {
+			mark = "  (fixed)"
+		}
+		log.Infof("  %-40s next value %d -> %d%s", s.sequence, before, after, mark)
+	}
+	return nil
+}
+
+// check_boolean_columns finds stash boolean columns stored as integers and
+// prints the SQL converting them back.
+func check_boolean_columns(ctx context.Context, destDB *sqlx.DB) error {
+	log := logger(ctx)
+	var tablesSorted []string
+	for table := range stash_boolean_columns {
+		tablesSorted = append(tablesSorted, table)
+	}
+	sort.Strings(tablesSorted)
+
+	for _, table := range tablesSorted {
+		names := stash_boolean_columns[table]
+		columns, err := load_dest_columns(ctx, destDB, table)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			col, ok := columns[name]
+			if !ok || !is_integer_type(col.dataType) {
+				continue
+			}
+
+			t, c := pgx.Identifier{table}.Sanitize(), pgx.Identifier{name}.Sanitize()
+			log.Warnf("%s.%s is %s instead of boolean, fix with:", table, name, col.dataType)
+			log.Infof("  ALTER TABLE %s ALTER COLUMN %s DROP DEFAULT, ALTER COLUMN %s TYPE boolean USING %s <> 0, ALTER COLUMN %s SET DEFAULT false;",
+				t, c, c, c, c)
+		}
+	}
+	return nil
+}
+
+// scan_timestamps counts implausible values in every date and timestamp
+// column: before 1900, more than a year in the future, or the Unix epoch,
+// which is what zero timestamps turn into.
+func scan_timestamps(ctx context.Context, destDB *sqlx.DB) error {
+	log := logger(ctx)
+	columns, err := load_schema_columns(ctx, destDB)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Scanning timestamps...")
+	for _, col := range columns {
+		if !is_time_type(col.dataType) {
+			continue
+		}
+
+		c := pgx.Identifier{col.name}.Sanitize()
+		sql := fmt.Sprintf(`SELECT count(*) FROM %s WHERE %s < '1900-01-01' OR %s > now() + interval '1 year' OR %s = 'epoch'`,
+			pgx.Identifier{col.table}.Sanitize(), c, c, c)
+
+		var count int64
+		if err := destDB.GetContext(ctx, &count, sql); err != nil {
+			return fmt.Errorf("exec `%s`: %w", sql, err)
+		}
+		if count > 0 {
+			log.Warnf("%s.%s: %d implausible values", col.table, col.name, count)
+		}
+	}
+	return nil
+}
+
+// report_orphans counts the rows violating every foreign key of the
+// destination, which nothing checked while loading in replica mode, and
+// returns the total.
+func report_orphans(ctx context.Context, destDB *sqlx.DB) (int64, error) {
+	log := logger(ctx)
+	fks, err := load_foreign_keys(ctx, destDB)
+	if err != nil {
+		return 0, err
+	}
+
+	log.Infof("Checking %d foreign keys...", len(fks))
+	var total int64
+	for _, fk := range fks {
+		count, err := count_orphans(ctx, destDB, fk)
+		if err != nil {
+			return 0, err
+		}
+		if count > 0 {
+			log.Warnf("%s: %d rows of %s reference missing %s rows", fk.name, count, fk.table, fk.refTable)
+		}
+		total += count
+	}
+	return total, nil
+}
@@ -0,0 +1,475 @@
+package migrate
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// tableStats counts what happened to the rows of a single table.
+type tableStats struct {
+	table    string
+	fetched  int64
+	inserted int64
+	skipped  int64
+	// modified counts values the migration changed on the way through.
+	modified int64
+	// timestampsFixed counts the invalid timestamps among them.
+	timestampsFixed int64
+	// datesCleared counts empty and sentinel dates stored as NULL.
+	datesCleared int64
+	// defaulted counts NULLs left to the default of a NOT NULL column.
+	defaulted int64
+	// nulStripped counts text values NUL bytes were removed from.
+	nulStripped int64
+	// utf8Repaired counts text values that weren't valid UTF-8.
+	utf8Repaired int64
+	// nonFinite counts NaN and infinite numbers that were replaced.
+	nonFinite int64
+	// intClamped counts integers out of range of their destination column.
+	intClamped int64
+	// jsonRepaired counts serialized documents that needed repairs.
+	jsonRepaired int64
+	// filtered counts rows left out by a row filter, or for depending on
+	// such a row.
+	filtered int64
+	// duplicates counts rows dropped for colliding with an earlier one.
+	// collapsed is set when they were exact duplicates, which aren't
+	// rejects and aren't among skipped.
+	duplicates int64
+	collapsed  bool
+	// orphans counts references to missing rows that were left out.
+	orphans int64
+	// anonymized counts values replaced with pseudonyms.
+	anonymized int64
+	// zeroRefs counts references of 0 meaning none, stored as NULL.
+	zeroRefs int64
+	// merged counts rows merged into another, which aren't rejects and
+	// aren't among skipped, changed rows given new values before
+	// migrating, like names differing only in case.
+	merged  int64
+	changed int64
+	// transforms counts what each row transform did, in the order they
+	// first ran.
+	transforms []*transformStats
+	// failed counts rows of batches that could not be inserted.
+	failed int64
+	// resumed is set when the table was found complete and not copied again.
+	resumed bool
+	// committed is set once the table's destination transaction committed.
+	committed bool
+
+	// bytesRead and bytesWritten approximate the data fetched from the
+	// source and sent to the destination.
+	bytesRead    int64
+	bytesWritten int64
+
+	// elapsed is the time the table took, fetchTime and insertTime the part
+	// of it spent waiting on the source and on the destination.
+	elapsed    time.Duration
+	fetchTime  time.Duration
+	insertTime time.Duration
+
+	// destSize is the table's size in the destination, with indexes and
+	// TOAST, once analyzed.
+	destSize int64
+
+	// batchSize is the batch size the table ended with, smallestBatch the
+	// smallest it was reduced to on the way.
+	batchSize     int
+	smallestBatch int
+}
+
+// batchFailure records rows that could not be inserted: a single row when
+// it was isolated, or a whole batch.
+type batchFailure struct {
+	table       string
+	first, last int
+	err         error
+}
+
+// Report collects the per-table statistics of a run, in migration order.
+type Report struct {
+	// planned are the tables selected for migration, excluded the ones
+	// left out on purpose.
+	planned  []string
+	excluded []string
+	tables   []*tableStats
+	failures []batchFailure
+	// blobs is set when blobs were written to the filesystem.
+	blobs *blobStats
+	// since is set for an incremental sync.
+	since time.Time
+	// settings are the extra session settings the tables were loaded
+	// with.
+	settings []string
+	// analyzeTime is the time ANALYZE took.
+	analyzeTime time.Duration
+	// estimatedSize is the size the tables were expected to take in the
+	// destination.
+	estimatedSize int64
+	// phases is the time the batch loops spent in each phase.
+	phases *phaseTimes
+	// anonymizer is set with -anonymize.
+	anonymizer *anonymizer
+	// log is the run's logger, which the report is printed to.
+	log Logger
+}
+
+func new_report(opts Options) *Report {
+	return &Report{phases: opts.phases, anonymizer: opts.anonymizer, log: opts.logger()}
+}
+
+// logger is the logger the report is printed to, the default one for a
+// report that wasn't made by a run.
+func (r *Report) logger() Logger {
+	if r.log != nil {
+		return r.log
+	}
+	return log
+}
+
+func (r *Report) add_failure(table string, first int, last int, err error) {
+	r.failures = append(r.failures, batchFailure{table: table, first: first, last: last, err: err})
+}
+
+func (r *Report) table(name string) *tableStats {
+	for _, t := range r.tables {
+		if t.table == name {
+			return t
+		}
+	}
+	t := &tableStats{table: name}
+	r.tables = append(r.tables, t)
+	return t
+}
+
+// not_copied counts the source rows that didn't make it to the
+// destination, rejected or left out on purpose.
+func (t *tableStats) not_copied() int64 {
+	n := t.skipped + t.failed + t.filtered + t.merged
+	if t.collapsed {
+		n += t.duplicates
+	}
+	return n
+}
+
+// throughput describes the rows and bytes per second the table was read at,
+// and where the time went.
+func (t *tableStats) throughput() string {
+	seconds := t.elapsed.Seconds()
+	if seconds <= 0 {
+		return "no time measured"
+	}
+	return fmt.Sprintf("%.0f rows/s, %.2f MB/s; %s fetching, %s inserting",
+		float64(t.fetched)/seconds, float64(t.bytesRead)/(1<<20)/seconds,
+		t.fetchTime.Round(time.Millisecond), t.insertTime.Round(time.Millisecond))
+}
+
+func (t *tableStats) transform(name string) *transformStats {
+	for _, s := range t.transforms {
+		if s.name == name {
+			return s
+		}
+	}
+	s := &transformStats{name: name}
+	t.transforms = append(t.transforms, s)
+	return s
+}
+
+// committed lists the tables whose data is safely in the destination.
+func (r *Report) committed() []string {
+	var names []string
+	for _, t := range r.tables {
+		if t.committed || t.resumed {
+			names = append(names, t.table)
+		}
+	}
+	return names
+}
+
+// PrintInterrupted summarizes an interrupted run: what is safely in the
+// destination and where the run stopped.
+func (r *Report) PrintInterrupted() {
+	log := r.logger()
+	committed := r.committed()
+	log.Warnf("Committed tables (%d of %d): %s", len(committed), len(r.planned), strings.Join(committed, ", "))
+	if len(r.tables) > 0 {
+		last := r.tables[len(r.tables)-1]
+		if !last.committed && !last.resumed {
+			log.Warnf("Stopped in %s after %d rows, its changes were rolled back", last.table, last.fetched)
+		}
+	}
+	log.Warnf("Run again with --resume to continue")
+}
+
+// Rejected is the number of rows that were (or would have been) skipped.
+func (r *Report) Rejected() int64 {
+	var n int64
+	for _, t := range r.tables {
+		n += t.skipped + t.failed
+	}
+	return n
+}
+
+// TableResult is what happened to the rows of one table, see Report.Tables.
+type TableResult struct {
+	Table    string `json:"table"`
+	Fetched  int64  `json:"fetched"`
+	Inserted int64  `json:"inserted"`
+	// Skipped rows were rejected, Failed ones were in batches that could
+	// not be inserted.
+	Skipped int64 `json:"skipped"`
+	Failed  int64 `json:"failed"`
+	// Filtered rows were left out by a row filter, Duplicates and Merged
+	// ones were dropped in favour of another row.
+	Filtered   int64 `json:"filtered"`
+	Duplicates int64 `json:"duplicates"`
+	Merged     int64 `json:"merged"`
+	// Modified counts the values changed on the way through.
+	Modified int64 `json:"modified"`
+	// Resumed is set when the table was found complete and not copied
+	// again, Committed once its rows were committed in the destination.
+	Resumed   bool `json:"resumed"`
+	Committed bool `json:"committed"`
+	// BytesRead and BytesWritten approximate the data fetched from the
+	// source and sent to the destination.
+	BytesRead    int64         `json:"bytes_read"`
+	BytesWritten int64         `json:"bytes_written"`
+	Elapsed      time.Duration `json:"-"`
+	// DestSize is the table's size in the destination once analyzed, zero
+	// before.
+	DestSize int64 `json:"dest_size,omitempty"`
+}
+
+// RowFailure is rows of a table that could not be inserted, First to Last
+// in the order they were fetched.
+type RowFailure struct {
+	Table       string
+	First, Last int
+	Err         error
+}
+
+// Planned lists the tables selected for the run, in migration order.
+func (r *Report) Planned() []string {
+	return slices.Clone(r.planned)
+}
+
+// Excluded lists the tables left out of the run on purpose.
+func (r *Report) Excluded() []string {
+	return slices.Clone(r.excluded)
+}
+
+// Committed lists the tables whose data is safely in the destination.
+func (r *Report) Committed() []string {
+	return r.committed()
+}
+
+// Tables returns the results of the tables the run got to, in migration
+// order.
+func (r *Report) Tables() []TableResult {
+	results := make([]TableResult, 0, len(r.tables))
+	for _, t := range r.tables {
+		results = append(results, TableResult{
+			Table:        t.table,
+			Fetched:      t.fetched,
+			Inserted:     t.inserted,
+			Skipped:      t.skipped,
+			Failed:       t.failed,
+			Filtered:     t.filtered,
+			Duplicates:   t.duplicates,
+			Merged:       t.merged,
+			Modified:     t.modified,
+			Resumed:      t.resumed,
+			Committed:    t.committed,
+			BytesRead:    t.bytesRead,
+			BytesWritten: t.bytesWritten,
+			Elapsed:      t.elapsed,
+			DestSize:     t.destSize,
+		})
+	}
+	return results
+}
+
+// Failures returns the rows that could not be inserted.
+func (r *Report) Failures() []RowFailure {
+	failures := make([]RowFailure, 0, len(r.failures))
+	for _, f := range r.failures {
+		failures = append(failures, RowFailure{Table: f.table, First: f.first, Last: f.last, Err: f.err})
+	}
+	return failures
+}
+
+// Print logs the per-table statistics and totals of the run.
+func (r *Report) Print(dryRun bool) {
+	log := r.logger()
+	inserted := "inserted"
+	if dryRun {
+		inserted = "would insert"
+	}
+
+	log.Infof("%-24s %12s %12s %12s %16s %10s", "table", inserted, "skipped", "failed", "batch size", "size MB")
+	for _, t := range r.tables {
+		if t.resumed {
+			log.Infof("%-24s %12s", t.table, "resumed")
+			continue
+		}
+		batch := fmt.Sprint(t.batchSize)
+		if t.smallestBatch < t.batchSize {
+			batch = fmt.Sprintf("%d (min %d)", t.batchSize, t.smallestBatch)
+		}
+		size := ""
+		if t.destSize > 0 {
+			size = fmt.Sprint(t.destSize >> 20)
+		}
+		log.Infof("%-24s %12d %12d %12d %16s %10s", t.table, t.inserted, t.skipped, t.failed, batch, size)
+	}
+	for _, t := range r.tables {
+		if t.timestampsFixed > 0 {
+			log.Warnf("%s: replaced %d invalid timestamps", t.table, t.timestampsFixed)
+		}
+		if t.nulStripped > 0 {
+			log.Warnf("%s: removed NUL bytes from %d values", t.table, t.nulStripped)
+		}
+		if t.utf8Repaired > 0 {
+			log.Warnf("%s: repaired %d values that weren't valid UTF-8", t.table, t.utf8Repaired)
+		}
+		if t.nonFinite > 0 {
+			log.Warnf("%s: replaced %d NaN or infinite numbers", t.table, t.nonFinite)
+		}
+		if t.intClamped > 0 {
+			log.Warnf("%s: replaced %d integers out of range", t.table, t.intClamped)
+		}
+		if t.jsonRepaired > 0 {
+			log.Warnf("%s: repaired %d malformed JSON documents", t.table, t.jsonRepaired)
+		}
+		if t.duplicates > 0 {
+			if t.collapsed {
+				log.Infof("%s: collapsed %d exact duplicate rows", t.table, t.duplicates)
+			} else {
+				log.Warnf("%s: dropped %d duplicate rows", t.table, t.duplicates)
+			}
+		}
+		if t.merged > 0 || t.changed > 0 {
+			log.Warnf("%s: merged %d rows into others and changed %d", t.table, t.merged, t.changed)
+		}
+		if t.filtered > 0 {
+			log.Infof("%s: left out %d filtered rows", t.table, t.filtered)
+		}
+		if t.orphans > 0 {
+			log.Warnf("%s: left out %d references to missing rows", t.table, t.orphans)
+		}
+		if t.anonymized > 0 {
+			log.Infof("%s: anonymized %d values", t.table, t.anonymized)
+		}
+		if t.zeroRefs > 0 {
+			log.Infof("%s: stored %d references of 0, meaning none, as NULL", t.table, t.zeroRefs)
+		}
+		if t.datesCleared > 0 {
+			log.Infof("%s: stored %d empty or placeholder dates as NULL", t.table, t.datesCleared)
+		}
+		if t.defaulted > 0 {
+			log.Warnf("%s: gave %d NULLs in NOT NULL columns the column's default", t.table, t.defaulted)
+		}
+		for _, s := range t.transforms {
+			if s.dropped > 0 || s.changed > 0 {
+				log.Infof("%s: transform %s dropped %d rows and changed %d", t.table, s.name, s.dropped, s.changed)
+			}
+		}
+	}
+	for _, table := range r.excluded {
+		log.Infof("%-24s %12s", table, "excluded")
+	}
+	r.print_slowest()
+
+	if r.blobs != nil {
+		log.Infof("Blob files: %d written, %d already present, %d bytes, %d verified on disk", r.blobs.written, r.blobs.skipped, r.blobs.bytes, r.blobs.verified)
+	}
+
+	if !r.since.IsZero() {
+		log.Warnf("Incremental sync since %s: rows deleted from the source are still in the destination", format_time(r.since))
+	}
+
+	if len(r.settings) > 0 {
+		log.Infof("Loaded with: %s", strings.Join(r.settings, "; "))
+	}
+	if r.analyzeTime > 0 {
+		log.Infof("ANALYZE took %s", r.analyzeTime.Round(time.Millisecond))
+	}
+	r.print_size()
+	if r.anonymizer != nil {
+		log.Infof("Anonymized: %s", strings.Join(r.anonymizer.columns(), ", "))
+	}
+
+	r.print_usage()
+
+	for _, f := range r.failures {
+		if f.first == f.last {
+			log.Errorf("%s: row %d failed: %v", f.table, f.first, f.err)
+			continue
+		}
+		log.Errorf("%s: rows %d-%d failed: %v", f.table, f.first, f.last, f.err)
+	}
+}
+
+// print_size compares the estimated destination size with the actual one,
+// known once the tables were analyzed.
+func (r *Report) print_size() {
+	log := r.logger()
+	if r.estimatedSize == 0 {
+		return
+	}
+	var actual int64
+	for _, t := range r.tables {
+		actual += t.destSize
+	}
+	if actual == 0 {
+		log.Infof("Destination size: estimated %d MB", r.estimatedSize>>20)
+		return
+	}
+	log.Infof("Destination size: %d MB, estimated %d MB (%.2fx the actual)", actual>>20, r.estimatedSize>>20, float64(r.estimatedSize)/float64(actual))
+}
+
+// slowestTables is how many tables the summary singles out as the slowest.
+const slowestTables = 3
+
+// print_slowest names the tables that took longest, with what they waited
+// on, when there are several to compare.
+func (r *Report) print_slowest() {
+	log := r.logger()
+	var timed []*tableStats
+	for _, t := range r.tables {
+		if t.elapsed > 0 {
+			timed = append(timed, t)
+		}
+	}
+	if len(timed) < 2 {
+		return
+	}
+	slices.SortStableFunc(timed, func(a, b *tableStats) int {
+		return cmp.Compare(b.elapsed, a.elapsed)
+	})
+	for _, t := range timed[:min(slowestTables, len(timed))] {
+		log.Infof("Slowest: %s took %s (%s)", t.table, t.elapsed.Round(time.Millisecond), t.throughput())
+	}
+}
+
+func (r *Report) print_usage() {
+	log := r.logger()
+	var read, written int64
+	for _, t := range r.tables {
+		read += t.bytesRead
+		written += t.bytesWritten
+	}
+
+	u := read_usage()
+	log.Infof("Resources: %s CPU (%s user, %s system), peak RSS %d MB, %s GC pauses over %d cycles",
+		(u.userCPU + u.sysCPU).Round(time.Millisecond), u.userCPU.Round(time.Millisecond), u.sysCPU.Round(time.Millisecond),
+		u.peakRSS>>20, u.gcPause.Round(time.Microsecond), u.gcCycles)
+	log.Infof("Data: %d MB read from source, %d MB written to destination", read>>20, written>>20)
+	if times := r.phases.snapshot(); times.fetches > 0 {
+		log.Infof("Time: %s", times)
+	}
+}
@@ -0,0 +1,100 @@
+package migrate
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// reportDoc is the JSON document of a Report, written by WriteJSON.
+type reportDoc struct {
+	Planned   []string     `json:"planned"`
+	Excluded  []string     `json:"excluded"`
+	Committed []string     `json:"committed"`
+	Rejected  int64        `json:"rejected"`
+	Tables    []tableDoc   `json:"tables"`
+	Failures  []failureDoc `json:"failures"`
+	Usage     usageDoc     `json:"usage"`
+}
+
+type tableDoc struct {
+	TableResult
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+}
+
+type failureDoc struct {
+	Table string `json:"table"`
+	First int    `json:"first"`
+	Last  int    `json:"last"`
+	Error string `json:"error"`
+}
+
+// usageDoc is what the process cost over the run, as print_usage logs it.
+type usageDoc struct {
+	CPUSeconds       float64 `json:"cpu_seconds"`
+	UserCPUSeconds   float64 `json:"user_cpu_seconds"`
+	SystemCPUSeconds float64 `json:"system_cpu_seconds"`
+	// PeakRSSBytes is the memory obtained from the OS where the platform
+	// doesn't report the peak RSS.
+	PeakRSSBytes   int64   `json:"peak_rss_bytes"`
+	GCPauseSeconds float64 `json:"gc_pause_seconds"`
+	GCCycles       uint32  `json:"gc_cycles"`
+	BytesRead      int64   `json:"bytes_read"`
+	BytesWritten   int64   `json:"bytes_written"`
+}
+
+func (r *Report) doc() reportDoc {
+	doc := reportDoc{
+		// Lists are written as [] rather than null when empty
+		Planned:   append([]string{}, r.planned...),
+		Excluded:  append([]string{}, r.excluded...),
+		Committed: append([]string{}, r.committed()...),
+		Rejected:  r.Rejected(),
+		Tables:    []tableDoc{},
+		Failures:  []failureDoc{},
+	}
+	for _, t := range r.Tables() {
+		doc.Tables = append(doc.Tables, tableDoc{TableResult: t, ElapsedSeconds: t.Elapsed.Seconds()})
+		doc.Usage.BytesRead += t.BytesRead
+		doc.Usage.BytesWritten += t.BytesWritten
+	}
+	for _, f := range r.Failures() {
+		doc.Failures = append(doc.Failures, failureDoc{Table: f.Table, First: f.First, Last: f.Last, Error: f.Err.Error()})
+	}
+
+	u := read_usage()
+	doc.Usage.CPUSeconds = (u.userCPU + u.sysCPU).Seconds()
+	doc.Usage.UserCPUSeconds = u.userCPU.Seconds()
+	doc.Usage.SystemCPUSeconds = u.sysCPU.Seconds()
+	doc.Usage.PeakRSSBytes = u.peakRSS
+	doc.Usage.GCPauseSeconds = u.gcPause.Seconds()
+	doc.Usage.GCCycles = u.gcCycles
+	return doc
+}
+
+// WriteJSON writes the report as an indented JSON document: the tables of
+// the run with their row counts, the failed rows, and what the process
+// cost in CPU, memory, garbage collection and data read and written.
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r.doc())
+}
+
+// write_report_json writes the report to path for -report-json.
+func write_report_json(path string, r *Report) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("create report: %w", err)
+	}
+	defer file.Close()
+
+	if err := r.WriteJSON(file); err != nil {
+		return fmt.Errorf("write report: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("write report: %w", err)
+	}
+	return nil
+}
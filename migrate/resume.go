@@ -0,0 +1,30 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// table_already_migrated reports whether the destination table holds as many
+// rows as the source one. A table that is only partially filled can't be
+// resumed safely and is reported as an error.
+func table_already_migrated(ctx context.Context, sourceDB *sqlx.DB, destDB *sqlx.DB, table string) (bool, error) {
+	source, err := count_rows(ctx, sourceDB, anon_dialect, table)
+	if err != nil {
+		return false, fmt.Errorf("source %w", err)
+	}
+	dest, err := count_rows(ctx, destDB, dialect, table)
+	if err != nil {
+		return false, fmt.Errorf("dest %w", err)
+	}
+
+	switch {
+	case dest == 0:
+		return source == 0, nil
+	case dest == source:
+		return true, nil
+	}
+	return false, fmt.Errorf("cannot resume %s: destination has %d of %d rows, truncate it and run again", table, dest, source)
+}
@@ -0,0 +1,91 @@
+package migrate
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// errTxnLost marks errors after which the destination transaction can't be
+// used anymore, so a retry has to start the table over.
+var errTxnLost = errors.New("destination transaction lost")
+
+const maxBackoff = time.Minute
+
+// is_transient reports whether err is worth retrying: a dropped connection,
+// a server shutting down, or a serialization failure. Constraint violations,
+// data type errors and the like are permanent and never retried.
+func is_transient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch {
+		case strings.HasPrefix(pgErr.Code, "08"): // connection_exception
+			return true
+		case pgErr.Code == "57P01", // admin_shutdown
+			pgErr.Code == "57P02", // crash_shutdown
+			pgErr.Code == "57P03", // cannot_connect_now
+			pgErr.Code == "53300", // too_many_connections
+			pgErr.Code == "40001", // serialization_failure
+			pgErr.Code == "40P01": // deadlock_detected
+			return true
+		}
+		return false
+	}
+
+	var netErr net.Error
+	switch {
+	case errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, io.EOF),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.EPIPE),
+		errors.Is(err, driver.ErrBadConn),
+		errors.As(err, &netErr):
+		return true
+	}
+	return pgconn.SafeToRetry(err)
+}
+
+// is_statement_timeout reports whether err is postgres cancelling a
+// statement, as it does when statement_timeout runs out.
+func is_statement_timeout(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "57014" // query_canceled
+}
+
+// backoff returns how long to wait before the given retry attempt (0-based),
+// doubling from base up to maxBackoff.
+func backoff(attempt int, base time.Duration) time.Duration {
+	d := base
+	for i := 0; i < attempt && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
+
+// sleep_ctx waits for d or until ctx is done.
+func sleep_ctx(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
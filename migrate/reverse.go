@@ -0,0 +1,290 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+// A reverse migration copies a migrated postgres database back into sqlite,
+// for going back to it. It is best effort: the sqlite file must have been
+// created by stash, which knows its schema, and only the values are
+// converted back, booleans to 0 and 1, timestamps to RFC 3339 text and
+// dates to YYYY-MM-DD. Sqlite keeps its own sequences, so there is no
+// sequence step, but the foreign keys are checked at the end.
+
+// sqliteMaxVariables is how many parameters a sqlite statement can take.
+const sqliteMaxVariables = 32766
+
+// open_sqlite_dest opens the stash created sqlite file at path for writing,
+// with foreign keys off while loading.
+func open_sqlite_dest(path string) (*sqlx.DB, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("%w: start stash against a new database once to create it", err)
+	}
+	if err := check_sqlite_file(path); err != nil {
+		return nil, err
+	}
+	db, err := sqlx.Open(sqlite_driver, "file:"+path+"?"+sqlite_params(false, true))
+	if err != nil {
+		return nil, fmt.Errorf("db.Open(): %w", err)
+	}
+	// One connection, so that the PRAGMAs apply to every statement
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
+
+// reverse_value converts a value read from postgres for sqlite, by the
+// postgres column's type.
+func reverse_value(value interface{}, dataType string) interface{} {
+	switch v := value.(type) {
+	case bool:
+		if v {
+			return int64(1)
+		}
+		return int64(0)
+	case time.Time:
+		if dataType == "date" {
+			return v.Format("2006-01-02")
+		}
+		return v.Format(time.RFC3339)
+	}
+	return value
+}
+
+// fetch_pg_batch reads rows of table from postgres in a stable order, which
+// OFFSET needs: ctid doesn't change within the snapshot.
+func fetch_pg_batch(ctx context.Context, txn *sqlx.Tx, table string, offset int, limit int) ([]map[string]interface{}, error) {
+	query := fmt.Sprintf("SELECT * FROM %s ORDER BY ctid LIMIT %d OFFSET %d", pgx.Identifier{table}.Sanitize(), limit, offset)
+	rows, err := txn.QueryxContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("query `%s`: %w", query, err)
+	}
+	defer rows.Close()
+
+	scanner, err := new_row_scanner(rows)
+	if err != nil {
+		return nil, fmt.Errorf("columns: %w", err)
+	}
+	batch := make([]map[string]interface{}, 0, limit)
+	for rows.Next() {
+		row, err := scanner.scan(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed mapscan: %w", err)
+		}
+		batch = append(batch, row)
+	}
+	return batch, rows.Err()
+}
+
+// reverse_table copies table from postgres into sqlite in one sqlite
+// transaction, rolled back on a dry run.
+func reverse_table(ctx context.Context, ptxn *sqlx.Tx, sqliteDB *sqlx.DB, pgDB *sqlx.DB, table string, opts Options, stats *tableStats) error {
+	log := logger(ctx)
+	columns, err := load_dest_columns(ctx, pgDB, table)
+	if err != nil {
+		return err
+	}
+
+	stxn, err := sqliteDB.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("sqlite begin tx: %w", err)
+	}
+	defer stxn.Rollback()
+
+	start := time.Now()
+	stats.batchSize, stats.smallestBatch = opts.BatchSize, opts.BatchSize
+	var insert *insertBuilder
+	for offset := 0; ; {
+		fetchStart := time.Now()
+		rows, err := fetch_pg_batch(ctx, ptxn, table, offset, opts.BatchSize)
+		if err != nil {
+			return err
+		}
+		stats.fetchTime += opts.phases.fetched(fetchStart)
+		if len(rows) == 0 {
+			break
+		}
+		offset += len(rows)
+		stats.fetched += int64(len(rows))
+		opts.progress.add_rows(int64(len(rows)))
+		stats.bytesRead += rows_bytes(rows)
+
+		for _, row := range rows {
+			for column, value := range row {
+				row[column] = reverse_value(value, columns[column].dataType)
+			}
+		}
+
+		if insert == nil {
+			sqliteColumns, _, err := load_source_columns(ctx, sqliteDB, table)
+			if err != nil {
+				return err
+			}
+			insert = new_insert_builder(table, sqliteColumns)
+		}
+		if _, err := insert.columns.add(rows); err != nil {
+			return err
+		}
+		per := max(1, sqliteMaxVariables/len(insert.columns.names))
+		for done := 0; done < len(rows); done += per {
+			batch := rows[done:min(done+per, len(rows))]
+			query, args, err := insert.build(batch)
+			if err != nil {
+				return err
+			}
+			insertStart := time.Now()
+			if _, err := stxn.ExecContext(ctx, query, args...); err != nil {
+				return fmt.Errorf("%s: insert rows %d-%d: %w", table, offset-len(rows)+done, offset-len(rows)+done+len(batch)-1, err)
+			}
+			stats.insertTime += opts.phases.inserted(insertStart)
+			stats.inserted += int64(len(batch))
+			stats.bytesWritten += rows_bytes(batch)
+		}
+		log.Debugf("%s: copied %d rows", table, offset)
+	}
+	stats.elapsed = time.Since(start)
+	log.Infof("Copied %s back (%d rows in %s, %s)", table, stats.inserted, stats.elapsed.Round(time.Millisecond), stats.throughput())
+
+	if opts.DryRun {
+		return nil
+	}
+	if err := stxn.Commit(); err != nil {
+		return fmt.Errorf("sqlite commit: %w", err)
+	}
+	stats.committed = true
+	return nil
+}
+
+// sqlite_foreign_key_check runs PRAGMA foreign_key_check and logs the
+// violations by table and parent, returning their number.
+func sqlite_foreign_key_check(ctx context.Context, sqliteDB *sqlx.DB) (int64, error) {
+	log := logger(ctx)
+	rows, err := sqliteDB.QueryContext(ctx, "PRAGMA foreign_key_check")
+	if err != nil {
+		return 0, fmt.Errorf("foreign_key_check: %w", err)
+	}
+	defer rows.Close()
+
+	counts := map[string]int64{}
+	var keys []string
+	var total int64
+	for rows.Next() {
+		var table, parent string
+		var rowid sql.NullInt64
+		var fkid int64
+		if err := rows.Scan(&table, &rowid, &parent, &fkid); err != nil {
+			return 0, fmt.Errorf("foreign_key_check: %w", err)
+		}
+		key := table + " -> " + parent
+		if counts[key] == 0 {
+			keys = append(keys, key)
+		}
+		counts[key]++
+		total++
+	}
+	for _, key := range keys {
+		log.Warnf("%s: %d rows reference missing rows", key, counts[key])
+	}
+	return total, rows.Err()
+}
+
+// reverse copies the postgres database of opts.Postgres back into the
+// sqlite file at opts.SQLite.
+func reverse(ctx context.Context, opts Options) (*Report, error) {
+	log := logger(ctx)
+	rep := new_report(opts)
+
+	selected, err := select_tables(opts.Only, opts.Skip)
+	if err != nil {
+		return nil, err
+	}
+	todo, _, err := start_from(selected, opts.StartFrom)
+	if err != nil {
+		return nil, err
+	}
+
+	connector, err := opts.Pg.apply(opts.Postgres)
+	if err != nil {
+		return nil, err
+	}
+	pgDB := opts.DestDB
+	if pgDB == nil {
+		if pgDB, err = open_pgsql(ctx, connector, false, opts.Pg.PgBouncer); err != nil {
+			return nil, err
+		}
+		set_pool(pgDB, opts)
+		defer pgDB.Close()
+	}
+
+	sqliteDB := opts.SourceDB
+	if sqliteDB == nil {
+		if sqliteDB, err = open_sqlite_dest(opts.SQLite); err != nil {
+			return nil, err
+		}
+		defer sqliteDB.Close()
+	}
+	if err := check_stash_database(ctx, sqliteDB, "sqlite database"); err != nil {
+		return nil, err
+	}
+
+	missing, err := missing_source_tables(ctx, sqliteDB, todo)
+	if err != nil {
+		return nil, err
+	}
+	if len(missing) > 0 {
+		log.Warnf("The sqlite database has no %s, skipping", strings.Join(missing, ", "))
+	}
+	var nonEmpty []string
+	for _, table := range todo {
+		if slices.Contains(missing, table) {
+			rep.excluded = append(rep.excluded, table)
+			continue
+		}
+		rep.planned = append(rep.planned, table)
+		count, err := count_rows(ctx, sqliteDB, anon_dialect, table)
+		if err != nil {
+			return nil, fmt.Errorf("sqlite %w", err)
+		}
+		if count > 0 {
+			nonEmpty = append(nonEmpty, table)
+		}
+	}
+	if len(nonEmpty) > 0 && !opts.Force {
+		return nil, fmt.Errorf("the sqlite database already has rows in %s, use a new one or -force", strings.Join(nonEmpty, ", "))
+	}
+
+	// One snapshot for every table, so that they are consistent
+	ptxn, err := pgDB.BeginTxx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("postgres begin tx: %w", err)
+	}
+	defer ptxn.Rollback()
+
+	for i, table := range rep.planned {
+		log.Infof("Copying %s back...", table)
+		opts.progress.start_table(table, i, len(rep.planned))
+		if err := reverse_table(ctx, ptxn, sqliteDB, pgDB, table, opts, rep.table(table)); err != nil {
+			return rep, err
+		}
+	}
+
+	if opts.DryRun {
+		return rep, nil
+	}
+	violations, err := sqlite_foreign_key_check(ctx, sqliteDB)
+	if err != nil {
+		return rep, err
+	}
+	if violations > 0 && opts.FKViolations == fkViolationsError {
+		return rep, classify(ErrData, fmt.Errorf("%d rows of the sqlite database violate foreign keys, see above", violations))
+	}
+	return rep, nil
+}
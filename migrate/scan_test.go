@@ -0,0 +1,109 @@
+package migrate
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// scan_fixture holds the timestamps, blobs and booleans the two sqlite
+// drivers scan differently unless column_converters evens them out.
+var scan_fixture = []string{
+	"CREATE TABLE t (id INTEGER PRIMARY KEY, at DATETIME, day DATE, flag BOOLEAN, data BLOB)",
+	"INSERT INTO t VALUES (1, '2023-01-02 03:04:05.123+00:00', '2023-01-02', true, x'00ff10')",
+	"INSERT INTO t VALUES (2, '', '', false, x'')",
+	"INSERT INTO t VALUES (3, NULL, NULL, NULL, NULL)",
+	"INSERT INTO t VALUES (4, '0000-00-00 00:00:00', 'unknown', 1, 'text')",
+	"INSERT INTO t VALUES (5, 1672628645, 1672628645123, 0, zeroblob(2))",
+	"INSERT INTO t VALUES (6, '2023-01-02T03:04:05.5-07:00', '2023-01-02 00:00:00', 0, NULL)",
+}
+
+// same_value compares scanned values, times by instant and zone offset.
+func same_value(a, b interface{}) bool {
+	if at, ok := a.(time.Time); ok {
+		bt, ok := b.(time.Time)
+		_, aOffset := at.Zone()
+		_, bOffset := bt.Zone()
+		return ok && at.Equal(bt) && aOffset == bOffset
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// TestScanFixture checks the values scan_fixture scans as. They are what
+// mattn/go-sqlite3 returns, and run without cgo the test checks that the
+// pure Go driver returns the same.
+func TestScanFixture(t *testing.T) {
+	day := time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)
+	want := []map[string]interface{}{
+		{"id": int64(1), "at": time.Date(2023, 1, 2, 3, 4, 5, 123000000, time.UTC), "day": day, "flag": true, "data": []byte{0x00, 0xff, 0x10}},
+		{"id": int64(2), "at": time.Time{}, "day": time.Time{}, "flag": false, "data": []byte{}},
+		{"id": int64(3), "at": nil, "day": nil, "flag": nil, "data": nil},
+		{"id": int64(4), "at": time.Time{}, "day": time.Time{}, "flag": true, "data": "text"},
+		{"id": int64(5), "at": time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC), "day": time.Date(2023, 1, 2, 3, 4, 5, 123000000, time.UTC), "flag": false, "data": []byte{0, 0}},
+		{"id": int64(6), "at": time.Date(2023, 1, 2, 3, 4, 5, 500000000, time.FixedZone("", -7*3600)), "day": day, "flag": false, "data": nil},
+	}
+
+	db := open_test_source(t, scan_fixture...)
+	rows, err := db.Queryx("SELECT * FROM t ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	scanner, err := new_row_scanner(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []map[string]interface{}
+	for rows.Next() {
+		row, err := scanner.scan(rows)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, row)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("scanned %d rows, want %d", len(got), len(want))
+	}
+	for i, row := range got {
+		for column, value := range want[i] {
+			if !same_value(row[column], value) {
+				t.Errorf("row %d %s = %#v, want %#v", i+1, column, row[column], value)
+			}
+		}
+	}
+
+	// And they come out of the conversions the same
+	columns := tableColumns{
+		"id":   {name: "id", dataType: "integer"},
+		"at":   {name: "at", dataType: "timestamp with time zone", nullable: true},
+		"day":  {name: "day", dataType: "date", nullable: true},
+		"flag": {name: "flag", dataType: "boolean", nullable: true},
+		"data": {name: "data", dataType: "bytea", nullable: true},
+	}
+	kept, err := transform_rows("t", 0, got, columns, DefaultOptions(), &tableStats{table: "t"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := []map[string]interface{}{
+		{"at": time.Date(2023, 1, 2, 3, 4, 5, 123000000, time.UTC), "day": day, "flag": true, "data": []byte{0x00, 0xff, 0x10}},
+		{"at": nil, "day": nil, "flag": false, "data": []byte{}},
+		{"at": nil, "day": nil, "flag": nil, "data": nil},
+		{"at": nil, "day": nil, "flag": true, "data": "text"},
+		{"at": time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC), "flag": false, "data": []byte{0, 0}},
+		{"flag": false, "data": nil},
+	}
+	if len(kept) != len(stored) {
+		t.Fatalf("kept %d rows, want %d", len(kept), len(stored))
+	}
+	for i, row := range kept {
+		for column, value := range stored[i] {
+			if !same_value(row[column], value) {
+				t.Errorf("row %d %s stored as %#v, want %#v", i+1, column, row[column], value)
+			}
+		}
+	}
+}
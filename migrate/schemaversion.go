@@ -0,0 +1,52 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// With -set-schema-version the destination's schema_migrations gets the
+// source's stash schema version once the data is loaded. Stash decides from
+// it which of its migrations to run on the next start, so it must describe
+// the destination's tables: right when they were created at the source's
+// version, wrong when a newer stash created them, since it would then run
+// migrations again on tables that already have their changes.
+
+// record_schema_version sets the destination's schema version to the
+// source's, with the dirty flag cleared.
+func record_schema_version(ctx context.Context, sourceDB *sqlx.DB, destDB *sqlx.DB) error {
+	log := logger(ctx)
+	version, dirty, err := schema_version(ctx, sourceDB)
+	if err != nil {
+		return classify(ErrSource, fmt.Errorf("source %w", err))
+	}
+	if dirty {
+		log.Warnf("The source's upgrade to schema version %d failed halfway, not recording it in the destination", version)
+		return nil
+	}
+	previous, previousDirty, err := schema_version(ctx, destDB)
+	if err != nil {
+		return fmt.Errorf("destination %w", err)
+	}
+	if previous == version && !previousDirty {
+		log.Infof("The destination is already at schema version %d", version)
+		return nil
+	}
+	log.Warnf("Setting the destination's schema version from %d to the source's %d: stash will run its migrations after %d on the next start, which is only right if its tables were created at that version", previous, version, version)
+
+	txn, err := destDB.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("dest begin tx: %w", err)
+	}
+	defer txn.Rollback()
+
+	if _, err := txn.ExecContext(ctx, "DELETE FROM schema_migrations"); err != nil {
+		return fmt.Errorf("clear schema_migrations: %w", err)
+	}
+	if _, err := txn.ExecContext(ctx, "INSERT INTO schema_migrations (version, dirty) VALUES ($1, false)", version); err != nil {
+		return fmt.Errorf("record schema version: %w", err)
+	}
+	return txn.Commit()
+}
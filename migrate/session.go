@@ -0,0 +1,120 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Destination session state
+//
+// Every setting the migration needs on the destination is applied with SET
+// LOCAL inside the transaction that uses it, so it ends with that transaction
+// whether it commits, rolls back or the connection drops. On top of that,
+// reset_dest_session runs RESET ALL when migrate returns, on success and on
+// every error path.
+//
+// The one case this can't cover is a hard kill (SIGKILL, OOM killer) while
+// connected through a pooler in session pooling mode: the deferred reset
+// never runs and the pooler may hand the server connection to its next client
+// without resetting it. Connect through a pooler in transaction pooling mode
+// if that matters, since no state the tool sets survives a transaction there.
+// Such a pooler also moves the statements outside a transaction between
+// server connections, which -pgbouncer accounts for, see open_pgsql. The
+// sequence resets each run in a transaction of their own for the same
+// reason.
+
+// dest_local_settings are applied to every destination transaction.
+var dest_local_settings = []string{
+	// Disable triggers and with them foreign key enforcement
+	"SET LOCAL session_replication_role = replica",
+}
+
+// fast_settings speed up the bulk load with -fast, at the price of
+// durability while loading: a crash can lose the last commits, which a
+// rerun with -resume copies again. They are applied with SET LOCAL like
+// dest_local_settings, so nothing outlives the migration.
+var fast_settings = []string{
+	"SET LOCAL synchronous_commit = off",
+	// For rebuilding indexes and the checks after loading
+	"SET LOCAL maintenance_work_mem = '1GB'",
+	"SET LOCAL work_mem = '256MB'",
+}
+
+// probe_local_settings returns the settings the server accepts, trying each
+// in a transaction of its own. Managed postgres services may refuse some.
+func probe_local_settings(ctx context.Context, db *sqlx.DB, settings []string) ([]string, error) {
+	log := logger(ctx)
+	var accepted []string
+	for _, setting := range settings {
+		txn, err := db.BeginTxx(ctx, nil)
+		if err != nil {
+			return nil, fmt.Errorf("dest begin tx: %w", err)
+		}
+		_, err = txn.ExecContext(ctx, setting)
+		txn.Rollback()
+		if err != nil {
+			log.Warnf("Server refused `%s`, loading without it: %v", setting, err)
+			continue
+		}
+		accepted = append(accepted, setting)
+	}
+	return accepted, nil
+}
+
+// begin_dest starts a destination transaction with the migration's
+// transaction-local settings, and any extra ones, applied.
+func begin_dest(ctx context.Context, db *sqlx.DB, extra ...string) (*sqlx.Tx, error) {
+	txn, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("dest begin tx: %w", err)
+	}
+
+	for _, setting := range slices.Concat(dest_local_settings, extra) {
+		if _, err := txn.ExecContext(ctx, setting); err != nil {
+			txn.Rollback()
+			return nil, fmt.Errorf("dest `%s`: %w", setting, err)
+		}
+	}
+	return txn, nil
+}
+
+// reset_dest_session resets every idle pooled connection to its defaults.
+// It isn't cancelled with ctx, so that it still runs after the migration's
+// context was.
+func reset_dest_session(ctx context.Context, db *sqlx.DB) {
+	log := logger(ctx)
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+
+	stats := db.Stats()
+	for i := 0; i < stats.Idle; i++ {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			log.Debugf("reset session: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		if _, err := conn.ExecContext(ctx, "RESET ALL"); err != nil {
+			log.Debugf("reset session: %v", err)
+		}
+	}
+}
+
+// check_dest_session confirms, on a connection from the pool, that loading
+// left session_replication_role at its default and with it triggers and
+// foreign keys enforced for whatever uses the connection next.
+func check_dest_session(ctx context.Context, db *sqlx.DB) error {
+	var role string
+	if err := db.GetContext(ctx, &role, "SELECT current_setting('session_replication_role')"); err != nil {
+		return fmt.Errorf("dest session_replication_role: %w", err)
+	}
+	if role != "origin" {
+		return fmt.Errorf("dest session_replication_role is still %s after loading", role)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// TestSessionAfterCopy checks that the settings loading a table needs,
+// session_replication_role among them, don't outlive its transaction,
+// whether it commits or fails.
+func TestSessionAfterCopy(t *testing.T) {
+	for _, fail := range []bool{false, true} {
+		m, fake := new_test_migration(t)
+		m.settings = fast_settings
+		if fail {
+			fake.fail("INSERT INTO", errors.New("injected failure"))
+		}
+
+		err := m.copy_table(context.Background(), 0, "tags")
+		if fail == (err == nil) {
+			t.Fatalf("failing %v: copy_table = %v", fail, err)
+		}
+		if len(fake.ran("SET LOCAL session_replication_role")) != 1 {
+			t.Fatalf("failing %v: ran %v, want replication role set", fail, fake.statements)
+		}
+		if err := check_dest_session(context.Background(), m.destDB); err != nil {
+			t.Errorf("failing %v: %v", fail, err)
+		}
+		if left := fake.session_settings(); len(left) > 0 {
+			t.Errorf("failing %v: settings left on the session: %v", fail, left)
+		}
+	}
+}
+
+// TestResetDestSession checks that reset_dest_session clears what a
+// session could still hold, like a setting left by a killed run on a
+// pooler's server connection.
+func TestResetDestSession(t *testing.T) {
+	fake, db := new_fake_dest(t)
+	if _, err := db.Exec("SET session_replication_role = replica"); err != nil {
+		t.Fatal(err)
+	}
+	if err := check_dest_session(context.Background(), db); err == nil {
+		t.Fatalf("the fake destination kept no session settings")
+	}
+
+	reset_dest_session(context.Background(), db)
+	if left := fake.session_settings(); len(left) > 0 {
+		t.Errorf("settings left on the session: %v", left)
+	}
+	if err := check_dest_session(context.Background(), db); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,29 @@
+package migrate
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// ErrInterrupted is returned by a run stopped by Migrator.Stop or by the
+// cancellation of its context.
+var ErrInterrupted = errors.New("interrupted")
+
+// stopSignal is set by Migrator.Stop: the batch in flight is finished, then
+// the run stops between batches and the current table is rolled back.
+type stopSignal struct {
+	stopped atomic.Bool
+}
+
+func (s *stopSignal) stop() {
+	s.stopped.Store(true)
+}
+
+func (s *stopSignal) reset() {
+	s.stopped.Store(false)
+}
+
+// requested reports whether the run should stop. A nil signal never stops.
+func (s *stopSignal) requested() bool {
+	return s != nil && s.stopped.Load()
+}
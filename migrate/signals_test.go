@@ -0,0 +1,79 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// TestStopInterruptsCopy stops a copy during its first batch and checks
+// that it finishes that batch only, whether it inserts, is a dry run, or has
+// every row left out.
+func TestStopInterruptsCopy(t *testing.T) {
+	tests := []struct {
+		name   string
+		dryRun bool
+		// keep is what the transform stopping the run returns.
+		keep    bool
+		inserts int
+	}{
+		{"insert", false, true, 1},
+		{"dry run", true, true, 0},
+		{"left out", false, false, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, fake := new_test_migration(t)
+			m.opts.BatchSize = 1
+			m.opts.DryRun = test.dryRun
+			m.opts.stopping = &stopSignal{}
+			m.opts.Transforms.Add("tags", "stop", func(table string, row map[string]interface{}) (bool, error) {
+				m.opts.stopping.stop()
+				return test.keep, nil
+			})
+
+			err := m.copy_table(context.Background(), 0, "tags")
+			if !errors.Is(err, ErrInterrupted) {
+				t.Fatalf("copy_table = %v, want ErrInterrupted", err)
+			}
+			if stats := m.rep.table("tags"); stats.fetched != 1 {
+				t.Errorf("fetched %d rows, want the first batch only", stats.fetched)
+			}
+			if inserts := fake.ran("INSERT INTO"); len(inserts) != test.inserts {
+				t.Errorf("inserted %d batches, want %d", len(inserts), test.inserts)
+			}
+			if len(fake.ran("COMMIT")) != 0 {
+				t.Errorf("ran %v, want no commit", fake.statements)
+			}
+		})
+	}
+}
+
+// TestRunResetsStop checks that a Stop doesn't outlive the run, and that
+// Migrators don't share it.
+func TestRunResetsStop(t *testing.T) {
+	opts := DefaultOptions()
+	opts.SourceDB = open_test_source(t, slices.Concat(image_only_fixture, []string{
+		"CREATE TABLE schema_migrations (version INTEGER, dirty BOOLEAN)",
+		"INSERT INTO schema_migrations VALUES (60, false)",
+	})...)
+	opts.Output = filepath.Join(t.TempDir(), "dump.sql")
+	m := New(opts)
+	other := New(opts)
+
+	m.Stop()
+	if other.stopping.requested() {
+		t.Errorf("stopping one Migrator stopped another")
+	}
+	if _, err := m.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if m.stopping.requested() {
+		t.Errorf("still stopping after a new run")
+	}
+	if m.opts.stopping != &m.stopping {
+		t.Errorf("the run doesn't use the Migrator's signal")
+	}
+}
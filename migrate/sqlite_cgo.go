@@ -0,0 +1,30 @@
+//go:build cgo
+
+package migrate
+
+import (
+	"github.com/jmoiron/sqlx"
+	// https://github.com/mattn/go-sqlite3
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const sqlite_driver = "sqlite3"
+
+func sqlite_params(foreignKeys bool, writable bool) string {
+	params := "_busy_timeout=50"
+	if foreignKeys {
+		params += "&_fk=true"
+	}
+	if writable {
+		params += "&_journal=WAL&_sync=NORMAL&_txlock=immediate"
+	} else {
+		params += "&mode=ro"
+	}
+	return params
+}
+
+// column_converters has nothing to convert, everything else is written
+// against how mattn/go-sqlite3 scans.
+func column_converters(rows *sqlx.Rows) ([]func(interface{}) interface{}, error) {
+	return nil, nil
+}
@@ -0,0 +1,110 @@
+//go:build !cgo
+
+package migrate
+
+// Without cgo, as when cross compiling, the pure Go translation of sqlite
+// is used instead. It takes pragmas as _pragma parameters.
+// https://pkg.go.dev/modernc.org/sqlite
+
+import (
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	_ "modernc.org/sqlite"
+)
+
+const sqlite_driver = "sqlite"
+
+func sqlite_params(foreignKeys bool, writable bool) string {
+	params := "_pragma=busy_timeout(50)"
+	if foreignKeys {
+		params += "&_pragma=foreign_keys(1)"
+	}
+	if writable {
+		params += "&_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)&_txlock=immediate"
+	} else {
+		params += "&mode=ro"
+	}
+	return params
+}
+
+// column_converters makes rows scan like mattn/go-sqlite3 would, which
+// everything else is written against: it returns BOOLEAN columns as bool
+// rather than int64, empty blobs as empty rather than nil, and values of
+// time columns as mattn parses them. Postgres column types have different
+// names and are left alone.
+func column_converters(rows *sqlx.Rows) ([]func(interface{}) interface{}, error) {
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+
+	convert := make([]func(interface{}) interface{}, len(types))
+	for i, t := range types {
+		switch strings.ToUpper(t.DatabaseTypeName()) {
+		case "BOOLEAN":
+			convert[i] = func(value interface{}) interface{} {
+				if v, ok := value.(int64); ok {
+					return v != 0
+				}
+				return value
+			}
+		case "BLOB":
+			convert[i] = func(value interface{}) interface{} {
+				if v, ok := value.([]byte); ok && v == nil {
+					return []byte{}
+				}
+				return value
+			}
+		case "DATE", "DATETIME", "TIMESTAMP":
+			convert[i] = convert_time
+		}
+	}
+	return convert, nil
+}
+
+// mattnTimeFormats are the layouts mattn/go-sqlite3 parses the text of
+// time columns with, in its order.
+var mattnTimeFormats = []string{
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02T15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// convert_time converts a value of a time column the way mattn does. Text
+// that doesn't parse is the zero time, integers are unix times in seconds,
+// or milliseconds when too large for seconds. Times modernc parsed into the
+// local zone get a fixed one, as mattn parses in UTC.
+func convert_time(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		v = strings.TrimSuffix(v, "Z")
+		for _, format := range mattnTimeFormats {
+			if t, err := time.ParseInLocation(format, v, time.UTC); err == nil {
+				return t
+			}
+		}
+		return time.Time{}
+	case int64:
+		if v > 1e12 || v < -1e12 {
+			return time.UnixMilli(v).UTC()
+		}
+		return time.Unix(v, 0).UTC()
+	case time.Time:
+		if v.Location() != time.Local {
+			return v
+		}
+		if _, offset := v.Zone(); offset != 0 {
+			return v.In(time.FixedZone("", offset))
+		}
+		return v.UTC()
+	}
+	return value
+}
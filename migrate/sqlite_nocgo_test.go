@@ -0,0 +1,39 @@
+//go:build !cgo
+
+package migrate
+
+import (
+	"testing"
+	"time"
+)
+
+// TestConvertTime checks the time column values modernc returns that
+// convert_time has to turn into what mattn/go-sqlite3 would.
+func TestConvertTime(t *testing.T) {
+	local := time.Date(2023, 1, 2, 3, 4, 5, 0, time.Local)
+	_, offset := local.Zone()
+
+	tests := []struct {
+		value interface{}
+		want  interface{}
+	}{
+		{"", time.Time{}},
+		{"not a time", time.Time{}},
+		{"2023-01-02T03:04:05Z", time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{"2023-01-02 03:04", time.Date(2023, 1, 2, 3, 4, 0, 0, time.UTC)},
+		{int64(1672628645), time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{int64(1672628645123), time.Date(2023, 1, 2, 3, 4, 5, 123000000, time.UTC)},
+		{local, local.In(time.FixedZone("", offset))},
+		{nil, nil},
+		{2.5, 2.5},
+	}
+	for _, test := range tests {
+		got := convert_time(test.value)
+		if !same_value(got, test.want) {
+			t.Errorf("convert_time(%#v) = %#v, want %#v", test.value, got, test.want)
+		}
+		if tm, ok := got.(time.Time); ok && tm.Location() == time.Local {
+			t.Errorf("convert_time(%#v) is in the local zone", test.value)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package migrate
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const blobStorageFilesystem = "FILESYSTEM"
+
+// stash_blob_storage reads the blobs_storage setting from the config.yml
+// stash keeps next to its database by default. It returns "" when there is
+// no such file or setting. Only this one top-level key is needed, so the
+// file is scanned line by line rather than parsed as YAML.
+func stash_blob_storage(dbpath string) string {
+	file, err := os.Open(filepath.Join(filepath.Dir(dbpath), "config.yml"))
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		value, ok := strings.CutPrefix(scanner.Text(), "blobs_storage:")
+		if ok {
+			return strings.ToUpper(strings.Trim(strings.TrimSpace(value), `"'`))
+		}
+	}
+	return ""
+}
@@ -0,0 +1,156 @@
+package migrate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// progress is where a run is, for the systemd status line and -status-addr.
+// The batch loop updates it while the status server reads it from its own
+// goroutines. A nil *progress records nothing.
+type progress struct {
+	mu       sync.Mutex
+	started  time.Time
+	table    string
+	tableIdx int
+	tables   int
+	done     int64
+	total    int64
+	warnings int64
+}
+
+func new_progress() *progress {
+	return &progress{started: time.Now()}
+}
+
+func (p *progress) set_total(total int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.total = total
+}
+
+func (p *progress) start_table(table string, idx int, tables int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.table, p.tableIdx, p.tables = table, idx, tables
+}
+
+// add_rows counts rows read from the source, negative for a table that
+// is copied again.
+func (p *progress) add_rows(n int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done += n
+}
+
+func (p *progress) warned() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.warnings++
+}
+
+// statusDoc is the JSON document -status-addr serves at /status.
+type statusDoc struct {
+	Started       string  `json:"started"`
+	Table         string  `json:"table"`
+	TableIndex    int     `json:"table_index"`
+	Tables        int     `json:"tables"`
+	RowsDone      int64   `json:"rows_done"`
+	RowsTotal     int64   `json:"rows_total"`
+	Percent       float64 `json:"percent"`
+	RowsPerSecond float64 `json:"rows_per_second"`
+	Warnings      int64   `json:"warnings"`
+}
+
+func (p *progress) snapshot() statusDoc {
+	if p == nil {
+		return statusDoc{}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	doc := statusDoc{
+		Started:   format_time(p.started),
+		Table:     p.table,
+		Tables:    p.tables,
+		RowsDone:  p.done,
+		RowsTotal: p.total,
+		Warnings:  p.warnings,
+	}
+	if p.table != "" {
+		doc.TableIndex = p.tableIdx + 1
+	}
+	if p.total > 0 {
+		doc.Percent = float64(p.done) / float64(p.total) * 100
+	}
+	if seconds := time.Since(p.started).Seconds(); seconds > 0 {
+		doc.RowsPerSecond = float64(p.done) / seconds
+	}
+	return doc
+}
+
+// countingLogger passes messages on to a Logger, counting the warnings for
+// the status document.
+type countingLogger struct {
+	Logger
+	progress *progress
+}
+
+func (l *countingLogger) Warnf(format string, args ...interface{}) {
+	l.progress.warned()
+	l.Logger.Warnf(format, args...)
+}
+
+// statusShutdownTimeout is how long a status request in flight may take
+// once the run is over.
+const statusShutdownTimeout = 2 * time.Second
+
+// start_status serves p as JSON at /status on addr until the returned
+// function is called.
+func start_status(addr string, p *progress, log Logger) (func(), error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("-status-addr: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(p.snapshot()); err != nil {
+			log.Debugf("status: %v", err)
+		}
+	})
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Warnf("status: %v", err)
+		}
+	}()
+	log.Infof("Serving the migration status on http://%s/status", listener.Addr())
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), statusShutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			server.Close()
+		}
+	}, nil
+}
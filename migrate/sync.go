@@ -0,0 +1,99 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/doug-martin/goqu/v9"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jmoiron/sqlx"
+)
+
+// An incremental sync copies only what changed in the source since an
+// earlier run, for a cutover with little downtime: migrate while stash is
+// still running on sqlite, then stop it and sync the rest. Deleted rows are
+// not detected.
+const sync_table = "_migration_sync"
+
+const create_sync = `
+CREATE TABLE IF NOT EXISTS _migration_sync (
+	source_label text        PRIMARY KEY,
+	started_at   timestamptz NOT NULL
+);
+`
+
+// sinceLast makes --since use the start of the last successful run from the
+// same source.
+const sinceLast = "last"
+
+var since_layouts = []string{time.RFC3339Nano, "2006-01-02 15:04:05", "2006-01-02"}
+
+// resolve_since turns the --since value into the time to sync from.
+func resolve_since(ctx context.Context, destDB *sqlx.DB, value string, label string) (time.Time, error) {
+	if value != sinceLast {
+		for _, layout := range since_layouts {
+			if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+				return t, nil
+			}
+		}
+		return time.Time{}, fmt.Errorf("invalid -since %q, expected %q or a time like 2006-01-02 15:04:05", value, sinceLast)
+	}
+
+	var since time.Time
+	err := destDB.GetContext(ctx, &since, "SELECT started_at FROM "+sync_table+" WHERE source_label = $1", label)
+	if errors.Is(err, sql.ErrNoRows) || is_undefined_table(err) {
+		return time.Time{}, fmt.Errorf("no previous run from %q is recorded in %s, give -since a time instead", label, sync_table)
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("read %s: %w", sync_table, err)
+	}
+	return since, nil
+}
+
+// record_sync remembers when a successful run from label started, for the
+// next -since last.
+func record_sync(ctx context.Context, destDB *sqlx.DB, label string, started time.Time) error {
+	if _, err := destDB.ExecContext(ctx, create_sync); err != nil {
+		return fmt.Errorf("create %s: %w", sync_table, err)
+	}
+	_, err := destDB.ExecContext(ctx, "INSERT INTO "+sync_table+" (source_label, started_at) VALUES ($1, $2) "+
+		"ON CONFLICT (source_label) DO UPDATE SET started_at = EXCLUDED.started_at", label, started)
+	if err != nil {
+		return fmt.Errorf("record run in %s: %w", sync_table, err)
+	}
+	return nil
+}
+
+func is_undefined_table(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "42P01"
+}
+
+// sync_column picks the column telling when a row last changed, or "" when
+// the table has none and must be synced in full.
+func sync_column(ctx context.Context, sourceDB *sqlx.DB, table string) (string, error) {
+	columns, err := source_columns(ctx, sourceDB, table)
+	if err != nil {
+		return "", err
+	}
+	found := map[string]bool{}
+	for _, column := range columns {
+		found[column] = true
+	}
+	for _, column := range []string{"updated_at", "created_at"} {
+		if found[column] {
+			return column, nil
+		}
+	}
+	return "", nil
+}
+
+// changed_since selects the rows whose column is at or after since. Stash
+// stores times as text with an offset, so they are compared as julian days
+// rather than as strings.
+func changed_since(column string, since time.Time) goqu.Expression {
+	return goqu.L("julianday(?) >= julianday(?)", goqu.I(column), since.UTC().Format("2006-01-02 15:04:05.000"))
+}
@@ -0,0 +1,120 @@
+package migrate
+
+import (
+	"strings"
+	"time"
+)
+
+// Old stash versions wrote some timestamps postgres can't store, like
+// `0000-12-31 23:58:45` or plain garbage, which fail the whole batch with
+// "date/time field value out of range". sanitize_timestamps replaces them
+// in every date and timestamp column: with NULL where the column allows it,
+// and otherwise with the Unix epoch, which repair reports as implausible.
+
+// timestamp_layouts are the text formats accepted for values the sqlite
+// driver left as text.
+var timestamp_layouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02",
+}
+
+// valid_timestamp reports whether postgres can store value in a date or
+// timestamp column. The zero time is what an empty value scans as.
+func valid_timestamp(value interface{}) bool {
+	var t time.Time
+	switch v := value.(type) {
+	case nil:
+		return true
+	case time.Time:
+		t = v
+	case []byte:
+		return valid_timestamp(string(v))
+	case string:
+		s := strings.TrimSpace(v)
+		for _, layout := range timestamp_layouts {
+			if parsed, err := time.Parse(layout, s); err == nil {
+				return valid_timestamp(parsed)
+			}
+		}
+		return false
+	default:
+		return true
+	}
+	return !t.IsZero() && t.Year() >= 1 && t.Year() <= 9999
+}
+
+// Date columns like performers.birthdate or scenes.date often hold an empty
+// string or a sentinel like 0001-01-01 for "unknown", which is NULL in
+// postgres. Old databases also have dates with a time of day appended.
+
+// date_layouts are the text formats accepted for dates.
+var date_layouts = []string{
+	"2006-01-02",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	time.RFC3339Nano,
+}
+
+// normalize_date returns a text date as YYYY-MM-DD, or false for an empty
+// or sentinel date that means unknown. Other values are returned as they
+// are.
+func normalize_date(value interface{}) (interface{}, bool) {
+	switch v := value.(type) {
+	case time.Time:
+		return v, v.Year() > 1
+	case []byte:
+		return normalize_date(string(v))
+	case string:
+		s := strings.TrimSpace(v)
+		if s == "" || strings.HasPrefix(s, "0000-00-00") {
+			return nil, false
+		}
+		for _, layout := range date_layouts {
+			if t, err := time.Parse(layout, s); err == nil {
+				return t.Format("2006-01-02"), t.Year() > 1
+			}
+		}
+	}
+	return value, true
+}
+
+func sanitize_timestamps(table string, rows []map[string]interface{}, columns tableColumns, opts Options, stats *tableStats) {
+	log := opts.logger()
+	for _, row := range rows {
+		for name, value := range row {
+			col, ok := columns[name]
+			if !ok || !is_time_type(col.dataType) {
+				continue
+			}
+			if col.dataType == "date" && value != nil {
+				date, ok := normalize_date(value)
+				if !ok && col.nullable {
+					log.Debugf("%s (%s): %s %q stored as NULL", table, row_ident(row), name, value)
+					row[name] = nil
+					stats.modified++
+					stats.datesCleared++
+					continue
+				}
+				if s, isText := value.(string); ok && isText && date != s {
+					row[name], value = date, date
+					stats.modified++
+				}
+			}
+			if valid_timestamp(value) {
+				continue
+			}
+
+			var replacement interface{}
+			if !col.nullable {
+				replacement = time.Unix(0, 0).UTC()
+			}
+			log.Warnf("%s (%s): invalid %s %v replaced with %v", table, row_ident(row), name, value, replacement)
+			row[name] = replacement
+			stats.modified++
+			stats.timestampsFixed++
+		}
+	}
+}
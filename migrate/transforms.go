@@ -0,0 +1,106 @@
+package migrate
+
+import (
+	"fmt"
+	"maps"
+	"reflect"
+)
+
+// Transform fixes up a source row of table in place before it is inserted.
+// Returning false leaves the row out of the migration.
+type Transform func(table string, row map[string]interface{}) (keep bool, err error)
+
+// AllTables is the table name under which a transform applies to every
+// table.
+const AllTables = "*"
+
+type namedTransform struct {
+	name string
+	fn   Transform
+}
+
+// Transforms is a registry of the row transforms to run, by table. Those
+// registered under AllTables run before the table's own, each in the order
+// they were added, and all before the migration's own conversions of the
+// values for postgres.
+type Transforms struct {
+	tables map[string][]namedTransform
+}
+
+// Add registers fn for table, or for every table under AllTables. The name
+// identifies it in the report.
+func (t *Transforms) Add(table string, name string, fn Transform) {
+	if t.tables == nil {
+		t.tables = map[string][]namedTransform{}
+	}
+	t.tables[table] = append(t.tables[table], namedTransform{name: name, fn: fn})
+}
+
+// table_fixups are the migration's own transforms for tables needing
+// special handling, built for the table's destination columns.
+var table_fixups = map[string]func(columns tableColumns, opts Options) Transform{
+	"performer_custom_fields": custom_fields_transform,
+	"video_captions":          captions_transform,
+}
+
+// for_table lists the transforms to run on the rows of table: its fixup,
+// then the registered ones.
+func (t *Transforms) for_table(table string, columns tableColumns, opts Options) []namedTransform {
+	var list []namedTransform
+	if fixup, ok := table_fixups[table]; ok {
+		list = append(list, namedTransform{name: table + " fixup", fn: fixup(columns, opts)})
+	}
+	if t != nil {
+		list = append(list, t.tables[AllTables]...)
+		list = append(list, t.tables[table]...)
+	}
+	return list
+}
+
+// transformStats counts what a transform did to the rows of a table.
+type transformStats struct {
+	name    string
+	dropped int64
+	changed int64
+}
+
+// run_transforms applies transforms to rows, returning the rows kept. Rows
+// they drop count as skipped and rows they change as modified, like the
+// migration's own.
+func run_transforms(table string, offset int, rows []map[string]interface{}, transforms []namedTransform, stats *tableStats) ([]map[string]interface{}, error) {
+	if len(transforms) == 0 {
+		return rows, nil
+	}
+
+	kept := rows[:0]
+	for i, row := range rows {
+		keep := true
+		changed := false
+		for _, t := range transforms {
+			before := maps.Clone(row)
+			ok, err := t.fn(table, row)
+			if err != nil {
+				return nil, fmt.Errorf("%s (%s, row %d): transform %s: %w", table, row_ident(row), offset+i, t.name, err)
+			}
+			counts := stats.transform(t.name)
+			if !ok {
+				counts.dropped++
+				keep = false
+				break
+			}
+			if !reflect.DeepEqual(before, row) {
+				counts.changed++
+				changed = true
+			}
+		}
+		if !keep {
+			stats.skipped++
+			continue
+		}
+		if changed {
+			stats.modified++
+		}
+		kept = append(kept, row)
+	}
+	return kept, nil
+}
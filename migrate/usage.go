@@ -0,0 +1,59 @@
+package migrate
+
+import (
+	"runtime"
+	"time"
+)
+
+// resourceUsage is what the process cost, for telling CPU-bound, memory
+// constrained and IO-starved runs apart in bug reports.
+type resourceUsage struct {
+	userCPU time.Duration
+	sysCPU  time.Duration
+	// peakRSS is in bytes, zero where the platform doesn't report it.
+	peakRSS  int64
+	gcPause  time.Duration
+	gcCycles uint32
+}
+
+func read_usage() resourceUsage {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	u := process_usage()
+	u.gcPause = time.Duration(mem.PauseTotalNs)
+	u.gcCycles = mem.NumGC
+	if u.peakRSS == 0 {
+		// Without getrusage the memory obtained from the OS is the best
+		// available upper bound.
+		u.peakRSS = int64(mem.Sys)
+	}
+	return u
+}
+
+// row_bytes approximates the size of a row's values on the wire.
+func row_bytes(row map[string]interface{}) int64 {
+	var n int64
+	for _, value := range row {
+		switch v := value.(type) {
+		case nil:
+		case string:
+			n += int64(len(v))
+		case []byte:
+			n += int64(len(v))
+		case bool:
+			n++
+		default:
+			n += 8
+		}
+	}
+	return n
+}
+
+func rows_bytes(rows []map[string]interface{}) int64 {
+	var n int64
+	for _, row := range rows {
+		n += row_bytes(row)
+	}
+	return n
+}
@@ -0,0 +1,7 @@
+//go:build !unix
+
+package migrate
+
+func process_usage() resourceUsage {
+	return resourceUsage{}
+}
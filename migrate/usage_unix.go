@@ -0,0 +1,27 @@
+//go:build unix
+
+package migrate
+
+import (
+	"runtime"
+	"syscall"
+	"time"
+)
+
+func process_usage() resourceUsage {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return resourceUsage{}
+	}
+
+	// Maxrss is in bytes on darwin and in kilobytes everywhere else
+	rss := int64(ru.Maxrss)
+	if runtime.GOOS != "darwin" && runtime.GOOS != "ios" {
+		rss *= 1024
+	}
+	return resourceUsage{
+		userCPU: time.Duration(ru.Utime.Nano()),
+		sysCPU:  time.Duration(ru.Stime.Nano()),
+		peakRSS: rss,
+	}
+}
@@ -0,0 +1,221 @@
+package migrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/doug-martin/goqu/v9"
+	"github.com/jmoiron/sqlx"
+)
+
+func count_rows(ctx context.Context, db *sqlx.DB, d goqu.DialectWrapper, table string) (int64, error) {
+	sql, _, err := d.From(table).Select(goqu.COUNT(goqu.Star())).ToSQL()
+	if err != nil {
+		return 0, fmt.Errorf("failed tosql: %w", err)
+	}
+
+	var count int64
+	if err := db.GetContext(ctx, &count, sql); err != nil {
+		return 0, fmt.Errorf("count %s: %w", table, err)
+	}
+	return count, nil
+}
+
+// verify_counts compares the row count of every migrated table in both
+// databases. Rows the migration skipped on purpose are expected to be
+// missing from the destination; any other difference is an error, except
+// for extra destination rows after an incremental sync.
+func verify_counts(ctx context.Context, sourceDB *sqlx.DB, destDB *sqlx.DB, rep *Report) error {
+	log := logger(ctx)
+	log.Infof("Verifying row counts...")
+	log.Infof("%-24s %12s %12s %12s", "table", "source", "destination", "not copied")
+
+	var mismatched []string
+	for _, stats := range rep.tables {
+		source, err := count_rows(ctx, sourceDB, anon_dialect, stats.table)
+		if err != nil {
+			return fmt.Errorf("source %w", err)
+		}
+		dest, err := count_rows(ctx, destDB, dialect, stats.table)
+		if err != nil {
+			return fmt.Errorf("dest %w", err)
+		}
+
+		missing := stats.not_copied()
+		mark := ""
+		if !rep.since.IsZero() && dest > source-missing {
+			// Deletions aren't synced
+			mark = "  DELETED IN SOURCE?"
+		} else if source-missing != dest {
+			mark = "  MISMATCH"
+			mismatched = append(mismatched, stats.table)
+		}
+		log.Infof("%-24s %12d %12d %12d%s", stats.table, source, dest, missing, mark)
+	}
+
+	if len(mismatched) > 0 {
+		return classify(ErrVerify, fmt.Errorf("row counts differ for %d tables: %v", len(mismatched), mismatched))
+	}
+	return nil
+}
+
+const (
+	verifyCount    = "count"
+	verifyChecksum = "checksum"
+)
+
+// canonical_value serializes a scanned value so that the sqlite3 and pgx
+// drivers produce the same text for the same data.
+func canonical_value(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "NULL"
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case int32:
+		return strconv.FormatInt(int64(v), 10)
+	case int16:
+		return strconv.FormatInt(int64(v), 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'g', -1, 32)
+	case []byte:
+		return hex.EncodeToString(v)
+	case time.Time:
+		// Postgres rounds to microseconds, anything finer is not a difference
+		return format_time(v.Round(time.Microsecond))
+	case string:
+		return v
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// tableChecksum is an order-independent digest of a table's contents: the
+// per-row hashes are summed, so the order rows are read in doesn't matter.
+type tableChecksum struct {
+	rows   int64
+	lo, hi uint64
+}
+
+func (c *tableChecksum) add(columns []string, row map[string]interface{}) {
+	h := sha256.New()
+	for _, column := range columns {
+		h.Write([]byte(column))
+		h.Write([]byte{0})
+		h.Write([]byte(canonical_value(row[column])))
+		h.Write([]byte{0})
+	}
+	sum := h.Sum(nil)
+
+	c.rows++
+	c.lo += binary.BigEndian.Uint64(sum[0:8])
+	c.hi += binary.BigEndian.Uint64(sum[8:16])
+}
+
+func checksum_table(ctx context.Context, db *sqlx.DB, d goqu.DialectWrapper, table string, columns []string) (tableChecksum, error) {
+	var sum tableChecksum
+
+	cols := make([]interface{}, len(columns))
+	for i, column := range columns {
+		cols[i] = goqu.C(column)
+	}
+	sql, _, err := d.From(table).Select(cols...).ToSQL()
+	if err != nil {
+		return sum, fmt.Errorf("failed tosql: %w", err)
+	}
+
+	rows, err := db.QueryxContext(ctx, sql)
+	if err != nil {
+		return sum, fmt.Errorf("query `%s`: %w", sql, err)
+	}
+	defer rows.Close()
+
+	scanner, err := new_row_scanner(rows)
+	if err != nil {
+		return sum, fmt.Errorf("columns: %w", err)
+	}
+	for rows.Next() {
+		row, err := scanner.scan(rows)
+		if err != nil {
+			return sum, fmt.Errorf("failed mapscan: %w", err)
+		}
+		sum.add(columns, row)
+	}
+	return sum, rows.Err()
+}
+
+// source_columns returns the column names of a source table, sorted.
+func source_columns(ctx context.Context, sourceDB *sqlx.DB, table string) ([]string, error) {
+	sql, _, err := anon_dialect.From(table).Limit(0).ToSQL()
+	if err != nil {
+		return nil, fmt.Errorf("failed tosql: %w", err)
+	}
+
+	rows, err := sourceDB.QueryxContext(ctx, sql)
+	if err != nil {
+		return nil, fmt.Errorf("query `%s`: %w", sql, err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(columns)
+	return columns, nil
+}
+
+// verify_checksums compares the content of every migrated table. Tables the
+// migration changed on purpose (skipped rows, clamped or truncated values)
+// are reported as modified rather than mismatched. It returns the tables
+// that differ either way.
+func verify_checksums(ctx context.Context, sourceDB *sqlx.DB, destDB *sqlx.DB, rep *Report) ([]string, error) {
+	log := logger(ctx)
+	log.Infof("Verifying checksums...")
+
+	var differing, mismatched []string
+	for _, stats := range rep.tables {
+		columns, err := source_columns(ctx, sourceDB, stats.table)
+		if err != nil {
+			return nil, fmt.Errorf("source %s: %w", stats.table, err)
+		}
+
+		source, err := checksum_table(ctx, sourceDB, anon_dialect, stats.table, columns)
+		if err != nil {
+			return nil, fmt.Errorf("source %s: %w", stats.table, err)
+		}
+		dest, err := checksum_table(ctx, destDB, dialect, stats.table, columns)
+		if err != nil {
+			return nil, fmt.Errorf("dest %s: %w", stats.table, err)
+		}
+
+		result := "ok"
+		if source != dest {
+			differing = append(differing, stats.table)
+			if stats.not_copied() > 0 || stats.modified > 0 {
+				result = "modified"
+			} else {
+				result = "MISMATCH"
+				mismatched = append(mismatched, stats.table)
+			}
+		}
+		log.Infof("%-24s %s", stats.table, result)
+	}
+
+	if len(mismatched) > 0 {
+		return differing, classify(ErrVerify, fmt.Errorf("checksums differ for %d tables: %v", len(mismatched), mismatched))
+	}
+	return differing, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// stdin is shared by all prompts so that input piped in all at once isn't
+// swallowed by the buffer of the first one.
+var stdin = bufio.NewReader(os.Stdin)
+
+// ask prints question and returns the trimmed line typed in response.
+func ask(question string) (string, error) {
+	fmt.Println(question)
+	answer, err := stdin.ReadString('\n')
+	if err != nil && answer == "" {
+		return "", err
+	}
+	return strings.TrimSpace(answer), nil
+}
+
+// promptAttempts is how many answers ask_valid takes before giving up.
+const promptAttempts = 3
+
+// ask_valid asks question again while check refuses the answer, showing
+// why. Input that isn't typed is taken as it is, since the next line piped
+// in is the answer to a different question; the migration reports what's
+// wrong with it.
+func ask_valid(question string, check func(answer string) error) (string, error) {
+	for attempt := 1; ; attempt++ {
+		answer, err := ask(question)
+		if err != nil || !is_interactive() {
+			return answer, err
+		}
+		err = check(answer)
+		if err == nil {
+			return answer, nil
+		}
+		if attempt == promptAttempts {
+			return "", err
+		}
+		fmt.Printf("%v\n", err)
+	}
+}
+
+// confirm asks a yes/no question, defaulting to no.
+func confirm(question string) bool {
+	answer, err := ask(question + " [y/N]")
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(answer) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
+
+// is_interactive reports whether stdin is a terminal someone can answer
+// questions on.
+func is_interactive() bool {
+	info, err := os.Stdin.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}